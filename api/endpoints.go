@@ -5,8 +5,338 @@
 // clients.
 package api
 
-// DripperEndpoint is a data model for the dripper endpoints.
+import (
+	"time"
+)
+
+const (
+	// CommandRun sets the dripper to the run state.
+	CommandRun = "run"
+
+	// CommandDrip sets the dripper to the drip state at the supplied rate.
+	CommandDrip = "drip"
+
+	// CommandOff turns the dripper off.
+	CommandOff = "off"
+
+	// CommandSetRate changes the drip rate without changing the state.
+	CommandSetRate = "setRate"
+
+	// MessageAck is the type of messages acknowledging a command.
+	MessageAck = "ack"
+
+	// MessageEvent is the type of messages carrying an event.
+	MessageEvent = "event"
+
+	// CalibrationModeDrip calibrates the volume of a single drip pulse.
+	CalibrationModeDrip = "drip"
+
+	// CalibrationModeRun calibrates the flow of the pump in the run state.
+	CalibrationModeRun = "run"
+
+	// CalibrationDispensing means the pump is still dispensing water to be
+	// measured.
+	CalibrationDispensing = "dispensing"
+
+	// CalibrationAwaitingMeasurement means the pump has stopped and the
+	// measured volume can be submitted.
+	CalibrationAwaitingMeasurement = "awaitingMeasurement"
+
+	// SessionBrewing means the brew session is still in progress.
+	SessionBrewing = "brewing"
+
+	// SessionCompleted means the dripper or recipe finished on its own.
+	SessionCompleted = "completed"
+
+	// SessionStopped means the dripper was turned off by hand.
+	SessionStopped = "stopped"
+
+	// SessionAborted means the recipe was aborted before it finished.
+	SessionAborted = "aborted"
+
+	// SessionFailed means the recipe stopped because the dripper returned an
+	// error.
+	SessionFailed = "failed"
+
+	// SessionTripped means the watchdog turned the dripper off because a
+	// safety limit was exceeded.
+	SessionTripped = "tripped"
+
+	// SessionInterrupted means the server stopped while the session was in
+	// progress.
+	SessionInterrupted = "interrupted"
+
+	// WebhookBrewStarted is sent when a recipe starts brewing.
+	WebhookBrewStarted = "brew.started"
+
+	// WebhookStepChanged is sent when a recipe moves on to its next step.
+	WebhookStepChanged = "brew.stepChanged"
+
+	// WebhookBrewFinished is sent when a recipe ends, whether it finished,
+	// was aborted or failed.
+	WebhookBrewFinished = "brew.finished"
+
+	// WebhookStateChanged is sent when the dripper changes state.
+	WebhookStateChanged = "dripper.stateChanged"
+
+	// WebhookRateChanged is sent when the drip rate of the dripper changes.
+	WebhookRateChanged = "dripper.rateChanged"
+
+	// WebhookSafetyTrip is sent when the watchdog turns the dripper off.
+	WebhookSafetyTrip = "dripper.safetyTrip"
+
+	// WebhookMotorError is sent when the motor controller returns an error.
+	WebhookMotorError = "dripper.motorError"
+
+	// WebhookPing is sent when a webhook is tested.
+	WebhookPing = "ping"
+
+	// RoleViewer may read the state of the drippers but not change it.
+	RoleViewer = "viewer"
+
+	// RoleOperator may read and control the drippers and manage the server.
+	RoleOperator = "operator"
+)
+
+// DripperEndpoint is a data model for the dripper endpoints. A drip rate can be
+// requested either in drips per minute, as a profile which changes over time
+// or, once the dripper is calibrated, in millilitres per hour.
 type DripperEndpoint struct {
-	DripsPerMinute float64 `json:"dripsPerMinute" binding:"required"`
-	State          string  `json:"state"`
+	DripsPerMinute         float64  `json:"dripsPerMinute"`
+	MeasuredDripsPerMinute float64  `json:"measuredDripsPerMinute"`
+	MillilitresPerHour     float64  `json:"millilitresPerHour,omitempty"`
+	TargetVolume           float64  `json:"targetVolume,omitempty"`
+	DispensedVolume        float64  `json:"dispensedVolume"`
+	State                  string   `json:"state"`
+	Trip                   *Trip    `json:"trip,omitempty"`
+	Profile                *Profile `json:"profile,omitempty"`
+	ProfileElapsed         float64  `json:"profileElapsed,omitempty"`
+}
+
+// NamedDripper is a data model for one of the drippers managed by the server.
+// The default dripper is also controlled through the routes which do not name
+// a dripper.
+type NamedDripper struct {
+	Name    string          `json:"name"`
+	Default bool            `json:"default"`
+	Driver  string          `json:"driver"`
+	Dripper DripperEndpoint `json:"dripper"`
+}
+
+// Profile is a data model for a drip rate which changes over time. Linear and
+// exponential profiles move from the start rate to the end rate over Seconds,
+// which is the half-life of an exponential profile. Step profiles follow a
+// table of steps.
+type Profile struct {
+	Type                string     `json:"type" binding:"required"`
+	StartDripsPerMinute float64    `json:"startDripsPerMinute,omitempty"`
+	EndDripsPerMinute   float64    `json:"endDripsPerMinute,omitempty"`
+	Seconds             int64      `json:"seconds,omitempty"`
+	Steps               []RateStep `json:"steps,omitempty"`
+}
+
+// RateStep is a data model for one step of a step profile.
+type RateStep struct {
+	AfterSeconds   int64   `json:"afterSeconds"`
+	DripsPerMinute float64 `json:"dripsPerMinute"`
+}
+
+// Trip is a data model for the reason the safety watchdog last turned the
+// dripper off.
+type Trip struct {
+	Reason        string    `json:"reason"`
+	Time          time.Time `json:"time"`
+	SessionVolume float64   `json:"sessionVolume"`
+}
+
+// Settings is a data model for the settings of the dripper pump.
+type Settings struct {
+	DripDuration int64 `json:"dripDuration"`
+	DripSpeed    int32 `json:"dripSpeed"`
+	RunSpeed     int32 `json:"runSpeed"`
+}
+
+// SettingsVersion is a data model for one saved version of the dripper
+// settings. Versions restored by a rollback name the version they restored and
+// versions switched to from a settings profile name the profile.
+type SettingsVersion struct {
+	Version        int       `json:"version"`
+	Settings       Settings  `json:"settings"`
+	CreatedAt      time.Time `json:"createdAt"`
+	CreatedBy      string    `json:"createdBy"`
+	RolledBackFrom int       `json:"rolledBackFrom,omitempty"`
+	ProfileID      string    `json:"profileId,omitempty"`
+}
+
+// SettingsProfile is a data model for a named set of dripper settings, such as
+// the settings tuned for a kind of pump tubing or water temperature.
+type SettingsProfile struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name" binding:"required"`
+	Settings  Settings  `json:"settings"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// BrewEndpoint is a data model for starting a brew from a recipe.
+type BrewEndpoint struct {
+	RecipeID string `json:"recipeId" binding:"required"`
+}
+
+// PlanEndpoint is a data model for planning a brew which is ready by a finish
+// time. The drip rate is worked out from the start time, which defaults to now,
+// unless a drip rate is supplied, in which case the start time is worked out
+// instead.
+type PlanEndpoint struct {
+	TargetVolume   float64    `json:"targetVolume" binding:"required"`
+	FinishAt       time.Time  `json:"finishAt" binding:"required"`
+	StartAt        *time.Time `json:"startAt,omitempty"`
+	DripsPerMinute float64    `json:"dripsPerMinute,omitempty"`
+}
+
+// Plan is a data model for a brew planned to be ready by a finish time. Once
+// the plan is started, either the dripper is dripping or ScheduleID names the
+// schedule which will start it.
+type Plan struct {
+	StartAt            time.Time `json:"startAt"`
+	FinishAt           time.Time `json:"finishAt"`
+	DripsPerMinute     float64   `json:"dripsPerMinute"`
+	MillilitresPerHour float64   `json:"millilitresPerHour"`
+	Drips              uint64    `json:"drips"`
+	TargetVolume       float64   `json:"targetVolume"`
+	ScheduleID         string    `json:"scheduleId,omitempty"`
+}
+
+// Event is a data model for the events pushed to clients as the dripper
+// changes.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Command is a data model for commands sent to the dripper over the WebSocket
+// control channel.
+type Command struct {
+	ID             string  `json:"id,omitempty"`
+	Command        string  `json:"command"`
+	DripsPerMinute float64 `json:"dripsPerMinute,omitempty"`
+}
+
+// CommandAck is a data model for the acknowledgement of a command.
+type CommandAck struct {
+	ID      string          `json:"id,omitempty"`
+	Command string          `json:"command"`
+	OK      bool            `json:"ok"`
+	Error   string          `json:"error,omitempty"`
+	Dripper DripperEndpoint `json:"dripper"`
+}
+
+// Message is a data model for messages sent to clients over the WebSocket
+// control channel. Exactly one of Ack or Event is set depending on Type.
+type Message struct {
+	Type  string      `json:"type"`
+	Ack   *CommandAck `json:"ack,omitempty"`
+	Event *Event      `json:"event,omitempty"`
+}
+
+// CalibrationProcedure is a data model for the guided calibration procedure.
+// Drip mode dispenses a number of drip pulses while run mode runs the pump for
+// a number of seconds.
+type CalibrationProcedure struct {
+	Mode      string    `json:"mode" binding:"required"`
+	Drips     uint64    `json:"drips,omitempty"`
+	Seconds   float64   `json:"seconds,omitempty"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// CalibrationMeasurement is a data model for the volume measured at the end of
+// the guided calibration procedure.
+type CalibrationMeasurement struct {
+	Volume float64 `json:"volume" binding:"required"`
+}
+
+// BrewSession is a data model for the record of a single brew, from the moment
+// the dripper is started until it is turned off or its recipe ends.
+type BrewSession struct {
+	ID              string         `json:"id"`
+	StartedAt       time.Time      `json:"startedAt"`
+	EndedAt         *time.Time     `json:"endedAt,omitempty"`
+	RecipeID        string         `json:"recipeId,omitempty"`
+	RecipeName      string         `json:"recipeName,omitempty"`
+	TotalDrips      uint64         `json:"totalDrips"`
+	EstimatedVolume float64        `json:"estimatedVolume"`
+	RateChanges     []RateChange   `json:"rateChanges"`
+	DripLog         []DripLogEntry `json:"dripLog"`
+	StartedBy       string         `json:"startedBy"`
+	Outcome         string         `json:"outcome"`
+}
+
+// RateChange is a data model for a change of the state or drip rate of the
+// dripper during a brew session.
+type RateChange struct {
+	Time           time.Time `json:"time"`
+	State          string    `json:"state"`
+	DripsPerMinute float64   `json:"dripsPerMinute"`
+}
+
+// DripLogEntry is a data model for the drips dispensed during a single minute
+// of a brew session.
+type DripLogEntry struct {
+	Minute time.Time `json:"minute"`
+	Drips  uint64    `json:"drips"`
+}
+
+// Webhook is a data model for a URL which receives a signed POST for every
+// event it subscribes to. A webhook without any events subscribes to all of
+// them. The secret signs every delivery and is generated if it is not set.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url" binding:"required"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// WebhookEvent is a data model for the body of a webhook delivery. Retried
+// deliveries keep their ID.
+type WebhookEvent struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Dripper string      `json:"dripper"`
+	Data    interface{} `json:"data"`
+}
+
+// MotorError is a data model for an error returned by the motor controller.
+type MotorError struct {
+	Command string `json:"command"`
+	Error   string `json:"error"`
+}
+
+// Token is a data model for an API token, which authenticates requests with
+// the role it was given. The token itself is only returned when it is
+// created, as only its hash is stored.
+type Token struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name" binding:"required"`
+	Role      string    `json:"role" binding:"required"`
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy"`
+}
+
+// Login is a data model for the credentials of a user logging in.
+type Login struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// User is a data model for who sent a request and the role they were given.
+type User struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
 }
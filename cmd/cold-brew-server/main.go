@@ -5,6 +5,7 @@
 package main
 
 import (
+	"github.com/betterengineering/cold-brew/api"
 	"github.com/betterengineering/cold-brew/internal/server"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
@@ -12,15 +13,108 @@ import (
 
 func main() {
 	s := server.New()
-	defer s.Dripper.Off()
+	defer s.Off()
 
 	r := gin.Default()
+	r.Use(server.RequestMetrics(r))
 	r.Use(static.Serve("/", static.LocalFile("./assets/dist", true)))
+
+	// Logging in and out are registered before Authenticate is added so
+	// they are served to everyone. Every route after it is authenticated.
+	r.POST("/api/cold-brew/v1/login", s.Login)
+	r.POST("/api/cold-brew/v1/logout", s.Logout)
+	r.Use(s.Authenticate)
+	r.GET("/api/cold-brew/v1/me", s.RequireRole(api.RoleViewer), s.GetCurrentUser)
+	r.GET("/api/cold-brew/v1/tokens", s.RequireRole(api.RoleOperator), s.GetTokens)
+	r.POST("/api/cold-brew/v1/tokens", s.CreateToken)
+	r.DELETE("/api/cold-brew/v1/tokens/:id", s.DeleteToken)
 	r.GET("/api/cold-brew/v1/dripper", s.GetDripper)
+	r.GET("/api/cold-brew/v1/events", s.GetEvents)
+	r.GET("/api/cold-brew/v1/ws", s.GetWebSocket)
 	r.GET("/api/cold-brew/v1/dripper/settings", s.GetDripperSettings)
 	r.POST("/api/cold-brew/v1/dripper/settings", s.SetDripperSettings)
+	r.GET("/api/cold-brew/v1/dripper/settings/history", s.GetDripperSettingsHistory)
+	r.POST("/api/cold-brew/v1/dripper/settings/rollback/:version", s.RollbackDripperSettings)
+	r.POST("/api/cold-brew/v1/dripper/settings/profiles/:id/activate", s.ActivateSettingsProfile)
+	r.GET("/api/cold-brew/v1/dripper/calibration", s.GetDripperCalibration)
+	r.POST("/api/cold-brew/v1/dripper/calibration", s.SetDripperCalibration)
+	r.GET("/api/cold-brew/v1/dripper/calibration/procedure", s.GetCalibrationProcedure)
+	r.POST("/api/cold-brew/v1/dripper/calibration/procedure", s.StartCalibrationProcedure)
+	r.POST("/api/cold-brew/v1/dripper/calibration/procedure/measurement", s.MeasureCalibrationProcedure)
+	r.DELETE("/api/cold-brew/v1/dripper/calibration/procedure", s.CancelCalibrationProcedure)
 	r.POST("/api/cold-brew/v1/dripper/run", s.SetDripperRun)
 	r.POST("/api/cold-brew/v1/dripper/off", s.SetDripperOff)
 	r.POST("/api/cold-brew/v1/dripper/drip", s.SetDripperDrip)
+	r.GET("/api/cold-brew/v1/settings/profiles", s.GetSettingsProfiles)
+	r.POST("/api/cold-brew/v1/settings/profiles", s.CreateSettingsProfile)
+	r.GET("/api/cold-brew/v1/settings/profiles/:id", s.GetSettingsProfile)
+	r.PUT("/api/cold-brew/v1/settings/profiles/:id", s.UpdateSettingsProfile)
+	r.DELETE("/api/cold-brew/v1/settings/profiles/:id", s.DeleteSettingsProfile)
+	r.GET("/api/cold-brew/v1/recipes", s.GetRecipes)
+	r.POST("/api/cold-brew/v1/recipes", s.CreateRecipe)
+	r.GET("/api/cold-brew/v1/recipes/:id", s.GetRecipe)
+	r.PUT("/api/cold-brew/v1/recipes/:id", s.UpdateRecipe)
+	r.DELETE("/api/cold-brew/v1/recipes/:id", s.DeleteRecipe)
+	r.GET("/api/cold-brew/v1/schedules", s.GetSchedules)
+	r.POST("/api/cold-brew/v1/schedules", s.CreateSchedule)
+	r.GET("/api/cold-brew/v1/schedules/:id", s.GetSchedule)
+	r.PUT("/api/cold-brew/v1/schedules/:id", s.UpdateSchedule)
+	r.DELETE("/api/cold-brew/v1/schedules/:id", s.DeleteSchedule)
+	r.GET("/api/cold-brew/v1/schedules/:id/runs", s.GetScheduleRuns)
+	r.POST("/api/cold-brew/v1/plan", s.PreviewPlan)
+	r.POST("/api/cold-brew/v1/plan/start", s.StartPlan)
+	r.GET("/api/cold-brew/v1/sessions", s.GetSessions)
+	r.GET("/api/cold-brew/v1/sessions/:id", s.GetSession)
+	r.GET("/api/cold-brew/v1/brew", s.GetBrew)
+	r.POST("/api/cold-brew/v1/brew", s.StartBrew)
+	r.POST("/api/cold-brew/v1/brew/pause", s.PauseBrew)
+	r.POST("/api/cold-brew/v1/brew/resume", s.ResumeBrew)
+	r.POST("/api/cold-brew/v1/brew/skip", s.SkipBrewStep)
+	r.POST("/api/cold-brew/v1/brew/abort", s.AbortBrew)
+	r.GET("/api/cold-brew/v1/webhooks", s.RequireRole(api.RoleOperator), s.GetWebhooks)
+	r.POST("/api/cold-brew/v1/webhooks", s.CreateWebhook)
+	r.GET("/api/cold-brew/v1/webhooks/:id", s.RequireRole(api.RoleOperator), s.GetWebhook)
+	r.PUT("/api/cold-brew/v1/webhooks/:id", s.UpdateWebhook)
+	r.DELETE("/api/cold-brew/v1/webhooks/:id", s.DeleteWebhook)
+	r.POST("/api/cold-brew/v1/webhooks/:id/test", s.TestWebhook)
+	r.GET("/api/cold-brew/v1/drippers", s.GetDrippers)
+	r.GET("/metrics", s.GetMetrics)
+
+	// Every route above which controls the dripper is also served for each
+	// named dripper. The routes above control the default dripper.
+	d := r.Group("/api/cold-brew/v1/drippers/:name")
+	d.GET("", s.ForDripper((*server.Server).GetDripper))
+	d.GET("/events", s.ForDripper((*server.Server).GetEvents))
+	d.GET("/ws", s.ForDripper((*server.Server).GetWebSocket))
+	d.GET("/settings", s.ForDripper((*server.Server).GetDripperSettings))
+	d.POST("/settings", s.ForDripper((*server.Server).SetDripperSettings))
+	d.GET("/settings/history", s.ForDripper((*server.Server).GetDripperSettingsHistory))
+	d.POST("/settings/rollback/:version", s.ForDripper((*server.Server).RollbackDripperSettings))
+	d.POST("/settings/profiles/:id/activate", s.ForDripper((*server.Server).ActivateSettingsProfile))
+	d.GET("/calibration", s.ForDripper((*server.Server).GetDripperCalibration))
+	d.POST("/calibration", s.ForDripper((*server.Server).SetDripperCalibration))
+	d.GET("/calibration/procedure", s.ForDripper((*server.Server).GetCalibrationProcedure))
+	d.POST("/calibration/procedure", s.ForDripper((*server.Server).StartCalibrationProcedure))
+	d.POST("/calibration/procedure/measurement", s.ForDripper((*server.Server).MeasureCalibrationProcedure))
+	d.DELETE("/calibration/procedure", s.ForDripper((*server.Server).CancelCalibrationProcedure))
+	d.POST("/run", s.ForDripper((*server.Server).SetDripperRun))
+	d.POST("/off", s.ForDripper((*server.Server).SetDripperOff))
+	d.POST("/drip", s.ForDripper((*server.Server).SetDripperDrip))
+	d.GET("/schedules", s.ForDripper((*server.Server).GetSchedules))
+	d.POST("/schedules", s.ForDripper((*server.Server).CreateSchedule))
+	d.GET("/schedules/:id", s.ForDripper((*server.Server).GetSchedule))
+	d.PUT("/schedules/:id", s.ForDripper((*server.Server).UpdateSchedule))
+	d.DELETE("/schedules/:id", s.ForDripper((*server.Server).DeleteSchedule))
+	d.GET("/schedules/:id/runs", s.ForDripper((*server.Server).GetScheduleRuns))
+	d.POST("/plan", s.ForDripper((*server.Server).PreviewPlan))
+	d.POST("/plan/start", s.ForDripper((*server.Server).StartPlan))
+	d.GET("/sessions", s.ForDripper((*server.Server).GetSessions))
+	d.GET("/sessions/:id", s.ForDripper((*server.Server).GetSession))
+	d.GET("/brew", s.ForDripper((*server.Server).GetBrew))
+	d.POST("/brew", s.ForDripper((*server.Server).StartBrew))
+	d.POST("/brew/pause", s.ForDripper((*server.Server).PauseBrew))
+	d.POST("/brew/resume", s.ForDripper((*server.Server).ResumeBrew))
+	d.POST("/brew/skip", s.ForDripper((*server.Server).SkipBrewStep))
+	d.POST("/brew/abort", s.ForDripper((*server.Server).AbortBrew))
 	r.Run()
 }
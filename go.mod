@@ -1,20 +1,26 @@
 module github.com/betterengineering/cold-brew
 
 require (
-	github.com/gin-contrib/sse v0.0.0-20190301062529-5545eab6dad3 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/gin-contrib/sse v0.0.0-20190301062529-5545eab6dad3
 	github.com/gin-gonic/contrib v0.0.0-20190408155029-b5986969cb50
 	github.com/gin-gonic/gin v1.3.0
 	github.com/golang/mock v1.3.0
+	github.com/gorilla/websocket v1.4.0
 	github.com/hashicorp/go-multierror v1.0.0 // indirect
 	github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25 // indirect
 	github.com/mattn/go-isatty v0.0.7 // indirect
 	github.com/nanobox-io/golang-scribble v0.0.0-20190309225732-aa3e7c118975
 	github.com/pkg/errors v0.8.1 // indirect
+	github.com/prometheus/client_golang v0.9.2
+	github.com/robfig/cron v1.2.0
 	github.com/sigurn/crc8 v0.0.0-20160107002456-e55481d6f45c // indirect
 	github.com/sigurn/utils v0.0.0-20151230205143-f19e41f79f8f // indirect
 	github.com/sirupsen/logrus v1.4.1
 	github.com/spf13/viper v1.3.2
 	gobot.io/x/gobot v1.12.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0 // indirect
 	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
 	periph.io/x/periph v3.4.0+incompatible // indirect
 )
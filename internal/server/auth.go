@@ -0,0 +1,514 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	tokensCollection = "tokens"
+	loginsCollection = "logins"
+
+	// loginCookie carries the login of a user who logged in through the
+	// browser.
+	loginCookie = "cold_brew_login"
+
+	// userKey is the key of the authenticated user in the request context.
+	userKey = "user"
+
+	// secretBytes is the number of random bytes in a token or login, after
+	// its ID.
+	secretBytes = 32
+)
+
+var (
+	// errTokenNotFound is returned when a token does not exist in the
+	// database.
+	errTokenNotFound = errors.New("the token could not be found")
+
+	// errLoginNotFound is returned when a login does not exist in the
+	// database or has expired.
+	errLoginNotFound = errors.New("the login could not be found")
+)
+
+// storedToken is a token as it is kept in the database, with the hash of its
+// secret in place of the token itself.
+type storedToken struct {
+	api.Token
+	Hash string `json:"hash"`
+}
+
+// storedLogin is a user logged in through the browser. The role of the user
+// is looked up in the configuration on every request, so changing it does not
+// wait for the login to expire.
+type storedLogin struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Authenticate is middleware which identifies the user or token sending each
+// request and ensures it may use the route. Requests which change anything
+// need the operator role, while the rest need the viewer role unless reads are
+// public. Nothing is checked when no users are configured.
+func (s *Server) Authenticate(c *gin.Context) {
+	if !s.Config.Auth.Enabled() {
+		return
+	}
+
+	user, err := s.authenticate(c)
+	if err == errTokenNotFound {
+		unauthorized(c, "the token is not valid")
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not authenticate request")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "the request could not be authenticated"})
+		return
+	}
+	if user != nil {
+		c.Set(userKey, *user)
+	}
+
+	role := api.RoleOperator
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		if s.Config.Auth.PublicReads {
+			return
+		}
+		role = api.RoleViewer
+	}
+
+	s.authorize(c, role)
+}
+
+// RequireRole returns middleware which ensures the user or token sending a
+// request has the supplied role, for routes Authenticate would otherwise let
+// through. It must run after Authenticate.
+func (s *Server) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.authorize(c, role)
+	}
+}
+
+// authorize aborts the request unless it was sent with the supplied role.
+func (s *Server) authorize(c *gin.Context, role string) {
+	if s.hasRole(c, role) {
+		return
+	}
+
+	if _, ok := currentUser(c); !ok {
+		unauthorized(c, "authentication is required")
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the " + role + " role is required"})
+}
+
+// hasRole reports whether a request was sent with the supplied role. Every
+// request has every role when no users are configured.
+func (s *Server) hasRole(c *gin.Context, role string) bool {
+	if !s.Config.Auth.Enabled() {
+		return true
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		return false
+	}
+
+	return user.Role == api.RoleOperator || user.Role == role
+}
+
+// unauthorized aborts a request which was not authenticated.
+func unauthorized(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", `Bearer realm="cold-brew"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// currentUser returns the user or token which sent a request, if it was
+// authenticated.
+func currentUser(c *gin.Context) (api.User, bool) {
+	value, ok := c.Get(userKey)
+	if !ok {
+		return api.User{}, false
+	}
+
+	user, ok := value.(api.User)
+	return user, ok
+}
+
+// authenticate identifies the token in the Authorization header of a request
+// or the login in its cookie. A request with neither is not an error and
+// returns no user, and neither is an expired login, so the browser can carry
+// on with what the public may do.
+func (s *Server) authenticate(c *gin.Context) (*api.User, error) {
+	header := c.GetHeader("Authorization")
+	if header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, errTokenNotFound
+		}
+
+		token, err := s.checkToken(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+
+		return &api.User{Name: token.Name, Role: token.Role}, nil
+	}
+
+	cookie, err := c.Cookie(loginCookie)
+	if err != nil {
+		return nil, nil
+	}
+
+	login, err := s.checkLogin(cookie)
+	if err == errLoginNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := s.Config.Auth.user(login.Username)
+	if !ok {
+		return nil, nil
+	}
+
+	return &api.User{Name: user.Username, Role: user.Role}, nil
+}
+
+// Login checks the username and password of a user and logs them in by
+// setting a cookie, which authenticates the requests of the browser until it
+// expires.
+func (s *Server) Login(c *gin.Context) {
+	if !s.Config.Auth.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "authentication is not enabled"})
+		return
+	}
+
+	var credentials api.Login
+	err := c.BindJSON(&credentials)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	user, ok := s.Config.Auth.user(credentials.Username)
+	if !ok || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(credentials.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "the username or password is not correct"})
+		return
+	}
+
+	id, secret, value, err := newSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "a login could not be generated"})
+		return
+	}
+
+	login := storedLogin{
+		ID:        id,
+		Username:  user.Username,
+		Hash:      hashSecret(secret),
+		ExpiresAt: time.Now().Add(s.Config.Auth.LoginDuration),
+	}
+	err = s.DB.Write(loginsCollection, login.ID, login)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the login could not be written to the database"})
+		return
+	}
+	s.deleteExpiredLogins()
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  login.ExpiresAt,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.JSON(http.StatusOK, api.User{Name: user.Username, Role: user.Role})
+}
+
+// Logout ends the login of the browser, if it has one, and clears its cookie.
+func (s *Server) Logout(c *gin.Context) {
+	cookie, err := c.Cookie(loginCookie)
+	if err == nil {
+		login, err := s.checkLogin(cookie)
+		if err == nil {
+			s.DB.Delete(loginsCollection, login.ID)
+		}
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     loginCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetCurrentUser returns who sent the request and their role. Everyone is an
+// operator when no users are configured.
+func (s *Server) GetCurrentUser(c *gin.Context) {
+	if !s.Config.Auth.Enabled() {
+		c.JSON(http.StatusOK, api.User{Name: requester(c), Role: api.RoleOperator})
+		return
+	}
+
+	user, ok := currentUser(c)
+	if !ok {
+		unauthorized(c, "authentication is required")
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// GetTokens returns every API token stored in the database, without the
+// tokens themselves.
+func (s *Server) GetTokens(c *gin.Context) {
+	tokens, err := s.readTokensFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the tokens could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// CreateToken creates an API token with the supplied name and role. The token
+// is only returned by this request.
+func (s *Server) CreateToken(c *gin.Context) {
+	var token api.Token
+	err := c.BindJSON(&token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	if !isValidRole(token.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer or operator"})
+		return
+	}
+
+	id, secret, value, err := newSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "a token could not be generated"})
+		return
+	}
+
+	token.ID = id
+	token.Token = ""
+	token.CreatedAt = time.Now()
+	token.CreatedBy = requester(c)
+
+	err = s.DB.Write(tokensCollection, token.ID, storedToken{Token: token, Hash: hashSecret(secret)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the token could not be written to the database"})
+		return
+	}
+
+	token.Token = value
+	c.JSON(http.StatusCreated, token)
+}
+
+// DeleteToken revokes an API token.
+func (s *Server) DeleteToken(c *gin.Context) {
+	token, err := s.readTokenFromDB(c.Param("id"))
+	if err == errTokenNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the token could not be read from the database"})
+		return
+	}
+
+	err = s.DB.Delete(tokensCollection, token.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the token could not be deleted from the database"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// newSecret generates the ID and secret of a token or login, along with the
+// value handed to the client, which is the ID and secret joined by a dot.
+func newSecret() (string, string, string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	b := make([]byte, secretBytes)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	secret := hex.EncodeToString(b)
+	return id, secret, id + "." + secret, nil
+}
+
+// splitSecret splits the value of a token or login into its ID and secret.
+func splitSecret(value string) (string, string, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !isValidID(parts[0]) || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// hashSecret returns the hash of a secret as it is stored in the database. As
+// secrets are long and random, a single SHA-256 is enough to keep them from
+// being recovered.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchesHash reports whether a secret has the supplied hash, taking the same
+// time however much of it matches.
+func matchesHash(secret string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hash)) == 1
+}
+
+// checkToken returns the token with the supplied value.
+func (s *Server) checkToken(value string) (storedToken, error) {
+	id, secret, ok := splitSecret(value)
+	if !ok {
+		return storedToken{}, errTokenNotFound
+	}
+
+	token, err := s.readTokenFromDB(id)
+	if err != nil {
+		return token, err
+	}
+
+	if !matchesHash(secret, token.Hash) {
+		return storedToken{}, errTokenNotFound
+	}
+
+	return token, nil
+}
+
+// checkLogin returns the login with the supplied value, deleting it if it has
+// expired.
+func (s *Server) checkLogin(value string) (storedLogin, error) {
+	login := storedLogin{}
+	id, secret, ok := splitSecret(value)
+	if !ok {
+		return login, errLoginNotFound
+	}
+
+	err := s.DB.Read(loginsCollection, id, &login)
+	if isNotFound(err) {
+		return login, errLoginNotFound
+	}
+	if err != nil {
+		return login, err
+	}
+
+	if !matchesHash(secret, login.Hash) {
+		return storedLogin{}, errLoginNotFound
+	}
+
+	if time.Now().After(login.ExpiresAt) {
+		s.DB.Delete(loginsCollection, login.ID)
+		return storedLogin{}, errLoginNotFound
+	}
+
+	return login, nil
+}
+
+// deleteExpiredLogins removes the logins which have expired from the database,
+// so browsers which never come back do not leave them behind.
+func (s *Server) deleteExpiredLogins() {
+	records, err := s.DB.ReadAll(loginsCollection)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		login := storedLogin{}
+		err = json.Unmarshal([]byte(record), &login)
+		if err == nil && now.After(login.ExpiresAt) {
+			s.DB.Delete(loginsCollection, login.ID)
+		}
+	}
+}
+
+// readTokenFromDB reads a single token from the database.
+func (s *Server) readTokenFromDB(id string) (storedToken, error) {
+	token := storedToken{}
+	if !isValidID(id) {
+		return token, errTokenNotFound
+	}
+
+	err := s.DB.Read(tokensCollection, id, &token)
+	if isNotFound(err) {
+		return token, errTokenNotFound
+	}
+	if err != nil {
+		return token, err
+	}
+
+	return token, nil
+}
+
+// readTokensFromDB reads every token from the database in the order they were
+// created, without their hashes.
+func (s *Server) readTokensFromDB() ([]api.Token, error) {
+	tokens := []api.Token{}
+	records, err := s.DB.ReadAll(tokensCollection)
+	if isNotFound(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		token := storedToken{}
+		err = json.Unmarshal([]byte(record), &token)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token.Token)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
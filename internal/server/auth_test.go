@@ -0,0 +1,291 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/gin-gonic/gin"
+)
+
+// withTestAuthConfig returns an auth configuration with an operator who logs
+// in with the password espresso and a viewer who logs in with filter.
+func withTestAuthConfig() AuthConfig {
+	return AuthConfig{
+		Users: []UserConfig{
+			{Username: "barista", Role: api.RoleOperator, PasswordHash: "$2a$04$YO9u3Q/GzSa04cw7Gff4m.LKa9WDC6ccjXCyv7BCk0aY4SJ5zFd36"},
+			{Username: "office", Role: api.RoleViewer, PasswordHash: "$2a$04$SOTzl.2sMQKA7rgQNNyf5OkgXy7kFj4b2m6/8GSRTNGvLbfv7Xzqq"},
+		},
+		PublicReads:   true,
+		LoginDuration: time.Hour,
+	}
+}
+
+// withTestAuthRouter enables authentication and returns a router serving the
+// authentication routes and a read and a control route which answer with who
+// sent the request.
+func withTestAuthRouter(s *Server) *gin.Engine {
+	s.Config.Auth = withTestAuthConfig()
+	whoami := func(c *gin.Context) {
+		c.String(http.StatusOK, requester(c))
+	}
+
+	r := withTestRouter()
+	r.POST("/login", s.Login)
+	r.POST("/logout", s.Logout)
+	r.Use(s.Authenticate)
+	r.GET("/me", s.RequireRole(api.RoleViewer), s.GetCurrentUser)
+	r.GET("/tokens", s.RequireRole(api.RoleOperator), s.GetTokens)
+	r.POST("/tokens", s.CreateToken)
+	r.DELETE("/tokens/:id", s.DeleteToken)
+	r.GET("/dripper", whoami)
+	r.POST("/dripper/run", whoami)
+
+	return r
+}
+
+// withAuthRequest sends a request to the router with the supplied header set.
+func withAuthRequest(r *gin.Engine, method string, path string, body string, header string, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+// withTestLogin logs a user in and returns the cookie header of their login.
+func withTestLogin(t *testing.T, r *gin.Engine, username string, password string) string {
+	w := withTestRequest(r, http.MethodPost, "/login", `{"username": "`+username+`", "password": "`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not log in:", w.Body.String())
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == loginCookie {
+			return cookie.Name + "=" + cookie.Value
+		}
+	}
+
+	t.Fatal("login did not set a cookie")
+	return ""
+}
+
+func TestAuthenticateWhenDisabled(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestAuthRouter(s)
+	s.Config.Auth = AuthConfig{}
+
+	w := withAuthRequest(r, http.MethodPost, "/dripper/run", "", userHeader, "mark")
+	if w.Code != http.StatusOK || w.Body.String() != "mark" {
+		t.Error("request was not let through when authentication is disabled:", w.Code, w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/me", "")
+	var user api.User
+	err = json.Unmarshal(w.Body.Bytes(), &user)
+	if err != nil || user.Role != api.RoleOperator {
+		t.Error("everyone was not an operator when authentication is disabled:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/login", `{"username": "barista", "password": "espresso"}`)
+	if w.Code != http.StatusNotFound {
+		t.Error("login did not return not found when authentication is disabled:", w.Code)
+	}
+}
+
+func TestAuthenticateWithPublicReads(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestAuthRouter(s)
+
+	w := withTestRequest(r, http.MethodGet, "/dripper", "")
+	if w.Code != http.StatusOK {
+		t.Error("public read was not let through:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodPost, "/dripper/run", "", userHeader, "mark")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("control request was not refused without authentication:", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/me", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Error("current user was returned without authentication:", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/tokens", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Error("tokens were listed without authentication:", w.Code)
+	}
+
+	s.Config.Auth.PublicReads = false
+	w = withTestRequest(r, http.MethodGet, "/dripper", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Error("read was let through when reads are not public:", w.Code)
+	}
+}
+
+func TestLoginAndLogout(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestAuthRouter(s)
+
+	w := withTestRequest(r, http.MethodPost, "/login", `{"username": "barista", "password": "latte"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("login with the wrong password did not return unauthorized:", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/login", `{"username": "nobody", "password": "espresso"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("login of an unknown user did not return unauthorized:", w.Code)
+	}
+
+	operator := withTestLogin(t, r, "barista", "espresso")
+	w = withAuthRequest(r, http.MethodPost, "/dripper/run", "", "Cookie", operator)
+	if w.Code != http.StatusOK || w.Body.String() != "barista" {
+		t.Error("operator could not control the dripper:", w.Code, w.Body.String())
+	}
+
+	viewer := withTestLogin(t, r, "office", "filter")
+	w = withAuthRequest(r, http.MethodPost, "/dripper/run", "", "Cookie", viewer)
+	if w.Code != http.StatusForbidden {
+		t.Error("viewer was not forbidden from controlling the dripper:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodGet, "/me", "", "Cookie", viewer)
+	var user api.User
+	err = json.Unmarshal(w.Body.Bytes(), &user)
+	if err != nil || user.Name != "office" || user.Role != api.RoleViewer {
+		t.Error("incorrect current user returned:", w.Body.String())
+	}
+
+	w = withAuthRequest(r, http.MethodPost, "/logout", "", "Cookie", operator)
+	if w.Code != http.StatusNoContent {
+		t.Fatal("could not log out:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodPost, "/dripper/run", "", "Cookie", operator)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("login was still valid after logging out:", w.Code)
+	}
+}
+
+func TestLoginExpires(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestAuthRouter(s)
+	s.Config.Auth.LoginDuration = -time.Minute
+
+	operator := withTestLogin(t, r, "barista", "espresso")
+	w := withAuthRequest(r, http.MethodPost, "/dripper/run", "", "Cookie", operator)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("expired login was accepted:", w.Code)
+	}
+
+	records, _ := s.DB.ReadAll(loginsCollection)
+	if len(records) != 0 {
+		t.Error("expired login was not deleted:", records)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestAuthRouter(s)
+	operator := withTestLogin(t, r, "barista", "espresso")
+	viewer := withTestLogin(t, r, "office", "filter")
+
+	w := withAuthRequest(r, http.MethodPost, "/tokens", `{"name": "kitchen display", "role": "viewer"}`, "Cookie", viewer)
+	if w.Code != http.StatusForbidden {
+		t.Error("viewer was not forbidden from creating a token:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodPost, "/tokens", `{"name": "kitchen display", "role": "barista"}`, "Cookie", operator)
+	if w.Code != http.StatusBadRequest {
+		t.Error("token with an invalid role did not return bad request:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodPost, "/tokens", `{"name": "kitchen display", "role": "viewer"}`, "Cookie", operator)
+	if w.Code != http.StatusCreated {
+		t.Fatal("could not create token:", w.Body.String())
+	}
+
+	var token api.Token
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	if err != nil {
+		t.Fatal("could not decode token:", err)
+	}
+
+	if token.Token == "" || token.CreatedBy != "barista" {
+		t.Error("token was not returned or attributed to its creator:", w.Body.String())
+	}
+
+	bearer := "Bearer " + token.Token
+	w = withAuthRequest(r, http.MethodGet, "/me", "", "Authorization", bearer)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "kitchen display") {
+		t.Error("token was not accepted:", w.Code, w.Body.String())
+	}
+
+	w = withAuthRequest(r, http.MethodPost, "/dripper/run", "", "Authorization", bearer)
+	if w.Code != http.StatusForbidden {
+		t.Error("viewer token was not forbidden from controlling the dripper:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodGet, "/dripper", "", "Authorization", bearer+"0")
+	if w.Code != http.StatusUnauthorized {
+		t.Error("invalid token was not refused, even though reads are public:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodGet, "/tokens", "", "Cookie", operator)
+	if strings.Contains(w.Body.String(), token.Token) || strings.Contains(w.Body.String(), hashSecret(strings.SplitN(token.Token, ".", 2)[1])) {
+		t.Error("token or its hash was listed:", w.Body.String())
+	}
+
+	var tokens []api.Token
+	err = json.Unmarshal(w.Body.Bytes(), &tokens)
+	if err != nil || len(tokens) != 1 || tokens[0].ID != token.ID {
+		t.Error("tokens were not listed:", w.Body.String())
+	}
+
+	w = withAuthRequest(r, http.MethodDelete, "/tokens/"+token.ID, "", "Cookie", operator)
+	if w.Code != http.StatusNoContent {
+		t.Fatal("could not delete token:", w.Code)
+	}
+
+	w = withAuthRequest(r, http.MethodGet, "/me", "", "Authorization", bearer)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("deleted token was still accepted:", w.Code)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// errBrewActive is returned when a manual command is sent to the dripper while
+// a recipe owns it.
+var errBrewActive = errors.New("a recipe is being brewed; abort it first")
+
+// GetBrew returns the progress of the recipe being brewed.
+func (s *Server) GetBrew(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Executor.Status())
+}
+
+// StartBrew starts brewing a recipe.
+func (s *Server) StartBrew(c *gin.Context) {
+	var json api.BrewEndpoint
+	err := c.BindJSON(&json)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	recipe, err := s.readRecipeFromDB(json.RecipeID)
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be read from the database"})
+		return
+	}
+
+	err = s.startBrew(recipe, requester(c))
+	if err == brew.ErrBusy {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.Executor.Status())
+}
+
+// startBrew starts brewing a recipe and records its brew session. The dripper
+// is switched to the settings profile of the recipe first, and back to its
+// previous settings if the recipe can not be started.
+func (s *Server) startBrew(recipe brew.Recipe, startedBy string) error {
+	if recipe.SettingsProfileID != "" {
+		err := recipe.Validate()
+		if err != nil {
+			return err
+		}
+
+		if s.Executor.Active() {
+			return brew.ErrBusy
+		}
+
+		previous := s.Dripper.GetSettings()
+		_, err = s.activateSettingsProfile(recipe.SettingsProfileID, dripper.ApplyNow, startedBy)
+		if err != nil {
+			return err
+		}
+
+		err = s.startRecipe(recipe, startedBy)
+		if err != nil {
+			s.restoreSettings(previous, startedBy)
+		}
+
+		return err
+	}
+
+	return s.startRecipe(recipe, startedBy)
+}
+
+// startRecipe starts the executor brewing a recipe and records its brew
+// session.
+func (s *Server) startRecipe(recipe brew.Recipe, startedBy string) error {
+	// A brew started by hand is taken over by the recipe.
+	if !s.Executor.Active() {
+		s.endSession(api.SessionStopped)
+	}
+
+	s.ownerMutex.Lock()
+	err := s.Executor.Start(recipe)
+	s.ownerMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Very short recipes may have ended before their session began.
+	s.beginSession(startedBy, &recipe)
+	s.recordSessionBrewStatus(s.Executor.Status())
+
+	return nil
+}
+
+// restoreSettings switches the dripper back to the settings it had before a
+// recipe which could not be started activated its profile.
+func (s *Server) restoreSettings(settings dripper.Settings, startedBy string) {
+	_, err := s.applySettings(settings, dripper.ApplyNow, api.SettingsVersion{CreatedBy: startedBy})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not restore the dripper settings")
+	}
+}
+
+// PauseBrew stops the pump and holds the current recipe step.
+func (s *Server) PauseBrew(c *gin.Context) {
+	s.respondToBrewCommand(c, s.Executor.Pause())
+}
+
+// ResumeBrew continues a paused recipe.
+func (s *Server) ResumeBrew(c *gin.Context) {
+	s.respondToBrewCommand(c, s.Executor.Resume())
+}
+
+// SkipBrewStep ends the current recipe step and moves on to the next one.
+func (s *Server) SkipBrewStep(c *gin.Context) {
+	s.respondToBrewCommand(c, s.Executor.Skip())
+}
+
+// AbortBrew stops the pump and ends the recipe.
+func (s *Server) AbortBrew(c *gin.Context) {
+	err := s.Executor.Abort()
+	if err == nil {
+		s.Executor.Wait()
+	}
+
+	s.respondToBrewCommand(c, err)
+}
+
+// respondToBrewCommand writes the result of an executor command.
+func (s *Server) respondToBrewCommand(c *gin.Context, err error) {
+	if err == brew.ErrNotRunning || err == brew.ErrNotPaused {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.Executor.Status())
+}
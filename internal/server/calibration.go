@@ -0,0 +1,313 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	calibrationResource = "calibration"
+
+	// calibrationDripsPerMinute is the drip rate used to dispense drips during
+	// the guided calibration procedure.
+	calibrationDripsPerMinute = 60
+
+	// maxCalibrationDrips is the largest number of drips the guided
+	// calibration procedure dispenses.
+	maxCalibrationDrips = 1000
+
+	// maxCalibrationSeconds is the longest the guided calibration procedure
+	// runs the pump.
+	maxCalibrationSeconds = 300
+)
+
+// errNoCalibrationProcedure is returned when there is no guided calibration
+// procedure in progress.
+var errNoCalibrationProcedure = errors.New("no calibration procedure is in progress")
+
+// GetDripperCalibration returns the volume calibration of the dripper.
+func (s *Server) GetDripperCalibration(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Dripper.GetCalibration())
+}
+
+// SetDripperCalibration stores a volume calibration measured by hand. The
+// calibration is recorded against the current dripper settings.
+func (s *Server) SetDripperCalibration(c *gin.Context) {
+	var calibration dripper.Calibration
+	err := c.BindJSON(&calibration)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	if calibration.MillilitresPerDrip < 0 || calibration.MillilitresPerSecond < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "millilitresPerDrip and millilitresPerSecond must not be negative"})
+		return
+	}
+
+	settings := s.Dripper.GetSettings()
+	calibration.DripSpeed = settings.DripSpeed
+	calibration.DripDuration = settings.DripDuration
+	calibration.RunSpeed = settings.RunSpeed
+	calibration.CalibratedAt = time.Now()
+
+	err = s.writeCalibrationToDB(calibration)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the calibration could not be written to the database"})
+		return
+	}
+
+	s.Dripper.SetCalibration(calibration)
+	c.JSON(http.StatusOK, calibration)
+}
+
+// readCalibrationFromDB reads the volume calibration from the database.
+func (s *Server) readCalibrationFromDB() (dripper.Calibration, error) {
+	calibration := dripper.Calibration{}
+	err := s.DB.Read(s.collection(settingsCollection), calibrationResource, &calibration)
+	if err != nil {
+		return calibration, err
+	}
+
+	return calibration, nil
+}
+
+// writeCalibrationToDB writes the supplied volume calibration to the database.
+func (s *Server) writeCalibrationToDB(calibration dripper.Calibration) error {
+	err := s.DB.Write(s.collection(settingsCollection), calibrationResource, calibration)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readCalibrationOrDefault attempts to read the volume calibration from the
+// database and returns an empty calibration on error, which leaves the dripper
+// uncalibrated.
+func (s *Server) readCalibrationOrDefault() dripper.Calibration {
+	calibration, err := s.readCalibrationFromDB()
+	if err != nil {
+		return dripper.Calibration{}
+	}
+
+	return calibration
+}
+
+// calibrationProcedure tracks a guided calibration procedure along with the
+// dripper counters when it started.
+type calibrationProcedure struct {
+	api.CalibrationProcedure
+
+	// startDrips is the number of drips of the dripper when the procedure
+	// started.
+	startDrips uint64
+
+	// startRunTime is the run time of the dripper when the procedure started.
+	startRunTime time.Duration
+}
+
+// GetCalibrationProcedure returns the guided calibration procedure in progress.
+func (s *Server) GetCalibrationProcedure(c *gin.Context) {
+	s.calibrationMutex.Lock()
+	defer s.calibrationMutex.Unlock()
+
+	if s.calibration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoCalibrationProcedure.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.calibrationProcedureStatus())
+}
+
+// StartCalibrationProcedure dispenses water to be measured, either a number of
+// drip pulses or a number of seconds in the run state. The same code paths as
+// brewing are used so the measurement matches real brews.
+func (s *Server) StartCalibrationProcedure(c *gin.Context) {
+	var procedure api.CalibrationProcedure
+	err := c.BindJSON(&procedure)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	s.calibrationMutex.Lock()
+	defer s.calibrationMutex.Unlock()
+
+	if s.calibration != nil && s.calibrationProcedureStatus().State == api.CalibrationDispensing {
+		c.JSON(http.StatusConflict, gin.H{"error": "a calibration procedure is already dispensing"})
+		return
+	}
+
+	// The procedure must start the dripper itself, or it would take over a
+	// brew and count the water of the brew as well.
+	if s.Dripper.GetState() != dripper.OFF || s.Executor.Active() {
+		c.JSON(http.StatusConflict, gin.H{"error": "the dripper is in use; turn it off before calibrating"})
+		return
+	}
+
+	started := calibrationProcedure{
+		startDrips:   s.Dripper.GetDrips(),
+		startRunTime: s.Dripper.GetRunTime(),
+	}
+	started.Mode = procedure.Mode
+	started.StartedAt = time.Now()
+
+	// dispensing is true once the procedure has started the dripper.
+	dispensing := false
+
+	switch procedure.Mode {
+	case api.CalibrationModeDrip:
+		if procedure.Drips == 0 || procedure.Drips > maxCalibrationDrips {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("drips must be greater than 0 and must not exceed %d", maxCalibrationDrips)})
+			return
+		}
+
+		started.Drips = procedure.Drips
+		err = s.dripDripper(calibrationDripsPerMinute)
+		if err == nil {
+			dispensing = true
+			err = s.Dripper.SetTargetDrips(procedure.Drips)
+		}
+	case api.CalibrationModeRun:
+		if procedure.Seconds <= 0 || procedure.Seconds > maxCalibrationSeconds {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("seconds must be greater than 0 and must not exceed %d", maxCalibrationSeconds)})
+			return
+		}
+
+		started.Seconds = procedure.Seconds
+		err = s.runDripper()
+		if err == nil {
+			dispensing = true
+			err = s.Dripper.SetTargetDuration(time.Duration(procedure.Seconds * float64(time.Second)))
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be drip or run"})
+		return
+	}
+
+	if err == errBrewActive {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		if dispensing {
+			s.Dripper.Off()
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.calibration = &started
+	c.JSON(http.StatusOK, s.calibrationProcedureStatus())
+}
+
+// MeasureCalibrationProcedure takes the volume measured at the end of the
+// guided calibration procedure and stores the resulting calibration.
+func (s *Server) MeasureCalibrationProcedure(c *gin.Context) {
+	var measurement api.CalibrationMeasurement
+	err := c.BindJSON(&measurement)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	if measurement.Volume <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "volume must be greater than 0"})
+		return
+	}
+
+	s.calibrationMutex.Lock()
+	defer s.calibrationMutex.Unlock()
+
+	if s.calibration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoCalibrationProcedure.Error()})
+		return
+	}
+
+	if s.calibrationProcedureStatus().State == api.CalibrationDispensing {
+		c.JSON(http.StatusConflict, gin.H{"error": "the calibration procedure is still dispensing"})
+		return
+	}
+
+	settings := s.Dripper.GetSettings()
+	calibration := s.Dripper.GetCalibration()
+	switch s.calibration.Mode {
+	case api.CalibrationModeDrip:
+		// The actual number of drips is used in case the procedure was
+		// stopped early.
+		drips := s.Dripper.GetDrips() - s.calibration.startDrips
+		if drips == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no drips were dispensed during the calibration procedure"})
+			return
+		}
+
+		calibration.MillilitresPerDrip = measurement.Volume / float64(drips)
+		calibration.DripSpeed = settings.DripSpeed
+		calibration.DripDuration = settings.DripDuration
+	case api.CalibrationModeRun:
+		seconds := (s.Dripper.GetRunTime() - s.calibration.startRunTime).Seconds()
+		if seconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the pump did not run during the calibration procedure"})
+			return
+		}
+
+		calibration.MillilitresPerSecond = measurement.Volume / seconds
+		calibration.RunSpeed = settings.RunSpeed
+	}
+	calibration.CalibratedAt = time.Now()
+
+	err = s.writeCalibrationToDB(calibration)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the calibration could not be written to the database"})
+		return
+	}
+
+	s.Dripper.SetCalibration(calibration)
+	s.calibration = nil
+	c.JSON(http.StatusOK, calibration)
+}
+
+// CancelCalibrationProcedure stops the guided calibration procedure without
+// changing the calibration.
+func (s *Server) CancelCalibrationProcedure(c *gin.Context) {
+	s.calibrationMutex.Lock()
+	defer s.calibrationMutex.Unlock()
+
+	if s.calibration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoCalibrationProcedure.Error()})
+		return
+	}
+
+	if s.calibrationProcedureStatus().State == api.CalibrationDispensing {
+		err := s.Dripper.Off()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	s.calibration = nil
+	c.Status(http.StatusNoContent)
+}
+
+// calibrationProcedureStatus returns the calibration procedure in progress
+// with its current state. The caller must hold the calibrationMutex.
+func (s *Server) calibrationProcedureStatus() api.CalibrationProcedure {
+	procedure := s.calibration.CalibrationProcedure
+	procedure.State = api.CalibrationAwaitingMeasurement
+	if s.Dripper.GetState() != dripper.OFF {
+		procedure.State = api.CalibrationDispensing
+	}
+
+	return procedure
+}
@@ -0,0 +1,200 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+func TestWriteCalibrationToDB(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	calibration := dripper.Calibration{
+		MillilitresPerDrip:   0.4,
+		MillilitresPerSecond: 12,
+		DripSpeed:            dripper.DefaultDripSpeed,
+		DripDuration:         dripper.DefaultDripDuration,
+		RunSpeed:             dripper.DefaultRunSpeed,
+	}
+	err = s.writeCalibrationToDB(calibration)
+	if err != nil {
+		t.Fatal("could not write calibration to db:", err)
+	}
+
+	readCalibration := s.readCalibrationOrDefault()
+	if readCalibration != calibration {
+		t.Error("calibration that was read does not match what was written")
+	}
+}
+
+func TestNewDripperIsCalibratedFromDB(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	if s.Dripper.IsCalibratedFor(dripper.DRIP) {
+		t.Error("dripper was calibrated without a calibration in the db")
+	}
+
+	err = s.writeCalibrationToDB(dripper.Calibration{
+		MillilitresPerDrip: 0.4,
+		DripSpeed:          dripper.DefaultDripSpeed,
+		DripDuration:       dripper.DefaultDripDuration,
+	})
+	if err != nil {
+		t.Fatal("could not write calibration to db:", err)
+	}
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	if !s.Dripper.IsCalibratedFor(dripper.DRIP) {
+		t.Error("dripper was not calibrated from the db")
+	}
+}
+
+func TestCalibrationProcedureInRunMode(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/procedure", s.StartCalibrationProcedure)
+	r.POST("/procedure/measurement", s.MeasureCalibrationProcedure)
+
+	w := withTestRequest(r, "POST", "/procedure", `{"mode": "run", "seconds": 0.1}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not start calibration procedure:", w.Body.String())
+	}
+
+	w = withTestRequest(r, "POST", "/procedure/measurement", `{"volume": 10}`)
+	if w.Code != http.StatusConflict {
+		t.Error("measurement was accepted while still dispensing")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	w = withTestRequest(r, "POST", "/procedure/measurement", `{"volume": 10}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not submit measurement:", w.Body.String())
+	}
+
+	flow := s.Dripper.GetCalibration().MillilitresPerSecond
+	if flow < 90 || flow > 100 {
+		t.Errorf("expected roughly 100 ml per second, got %v", flow)
+	}
+
+	if s.readCalibrationOrDefault().MillilitresPerSecond != flow {
+		t.Error("calibration was not written to the db")
+	}
+}
+
+func TestCalibrationProcedureInDripMode(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.offDripper()
+
+	r := withTestRouter()
+	r.POST("/procedure", s.StartCalibrationProcedure)
+	r.POST("/procedure/measurement", s.MeasureCalibrationProcedure)
+
+	w := withTestRequest(r, "POST", "/procedure", `{"mode": "drip", "drips": 0}`)
+	if w.Code != http.StatusBadRequest {
+		t.Error("calibration procedure without drips did not return bad request:", w.Code)
+	}
+
+	w = withTestRequest(r, "POST", "/procedure", `{"mode": "drip", "drips": 1}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not start calibration procedure:", w.Body.String())
+	}
+
+	if s.Dripper.GetState() != dripper.DRIP || s.Dripper.GetDripsPerMinute() != calibrationDripsPerMinute {
+		t.Fatal("calibration procedure did not start dripping")
+	}
+
+	for i := 0; i < 50 && s.Dripper.GetState() != dripper.OFF; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	w = withTestRequest(r, "POST", "/procedure/measurement", `{"volume": 0.5}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not submit measurement:", w.Body.String())
+	}
+
+	perDrip := s.Dripper.GetCalibration().MillilitresPerDrip
+	if perDrip != 0.5/float64(s.Dripper.GetDrips()) {
+		t.Errorf("expected 0.5 ml per drip, got %v", perDrip)
+	}
+
+	if s.readCalibrationOrDefault().MillilitresPerDrip != perDrip {
+		t.Error("calibration was not written to the db")
+	}
+}
+
+func TestCalibrationProcedureWhileDripping(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.offDripper()
+
+	err = s.dripDripper(40)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/procedure", s.StartCalibrationProcedure)
+
+	w := withTestRequest(r, "POST", "/procedure", `{"mode": "drip", "drips": 10}`)
+	if w.Code != http.StatusConflict {
+		t.Error("calibration procedure took over a manual drip:", w.Code)
+	}
+
+	if s.Dripper.GetState() != dripper.DRIP || s.Dripper.GetDripsPerMinute() != 40 {
+		t.Error("manual drip was changed by the calibration procedure")
+	}
+
+	w = withTestRequest(r, "POST", "/procedure", `{"mode": "run", "seconds": 1}`)
+	if w.Code != http.StatusConflict || s.Dripper.GetState() != dripper.DRIP {
+		t.Error("calibration procedure took over a manual drip:", w.Code)
+	}
+}
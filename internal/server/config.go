@@ -5,8 +5,15 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -21,8 +28,42 @@ const (
 	// EnvTesting is a constant used to determine if the application is in a
 	// testing environment.
 	EnvTesting = "testing"
+
+	// ResumeOff leaves the dripper off when the server restarts mid-brew.
+	ResumeOff = "off"
+
+	// ResumeAlways continues an interrupted brew when the server restarts.
+	ResumeAlways = "always"
+
+	// ResumeWindow continues an interrupted brew only if the server was down
+	// for less than the resume window.
+	ResumeWindow = "window"
+
+	// DefaultDripperName is the name of the dripper when the configuration
+	// file does not list any drippers.
+	DefaultDripperName = "default"
+
+	// DefaultMQTTTopic is the topic every MQTT topic of the server is under
+	// unless configured otherwise.
+	DefaultMQTTTopic = "cold-brew"
+
+	// DefaultMQTTClientID is the client ID the server connects to the MQTT
+	// broker with unless configured otherwise.
+	DefaultMQTTClientID = "cold-brew"
+
+	// DefaultDiscoveryPrefix is the topic Home Assistant looks for discovery
+	// payloads under unless configured otherwise.
+	DefaultDiscoveryPrefix = "homeassistant"
+
+	// DefaultLoginHours is how many hours a login lasts unless configured
+	// otherwise.
+	DefaultLoginHours = 7 * 24
 )
 
+// dripperNamePattern matches the names drippers may be given. Since names
+// become directories in the database, they are kept to plain path segments.
+var dripperNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
 // Config is a configuration struct used by the server package to configure
 // downstream dependencies.
 type Config struct {
@@ -32,6 +73,105 @@ type Config struct {
 
 	// DatabaseDir is the absolute path of the SQLite database.
 	DatabaseDir string
+
+	// Driver is the name of the motor controller used to drive the pump of
+	// drippers which do not set their own. It defaults to the Adafruit Motor
+	// HAT when it is not set.
+	Driver string
+
+	// DriverOptions parameterise the motor driver, such as the pins the pump
+	// is connected to, for drippers which do not set their own.
+	DriverOptions dripper.DriverOptions
+
+	// Drippers are the drippers managed by the server. The first one is the
+	// default dripper, which is also controlled through the routes which do
+	// not name a dripper.
+	Drippers []DripperConfig
+
+	// Resume decides whether a brew interrupted by a restart is continued. It
+	// defaults to leaving the dripper off when it is not set.
+	Resume string
+
+	// ResumeWindow is the longest outage after which a brew is continued when
+	// Resume is set to window.
+	ResumeWindow time.Duration
+
+	// Limits are the safety limits enforced by the dripper watchdog. They are
+	// not enforced when they are not set.
+	Limits dripper.Limits
+
+	// MQTT configures the connection to an MQTT broker. The server does not
+	// connect to a broker when no broker is set.
+	MQTT MQTTConfig
+
+	// Auth configures who may use the API. Requests are not authenticated
+	// when no users are set.
+	Auth AuthConfig
+}
+
+// DripperConfig configures one of the drippers managed by the server.
+type DripperConfig struct {
+	// Name identifies the dripper in the API.
+	Name string `mapstructure:"name"`
+
+	// Driver is the name of the motor controller used to drive the pump.
+	Driver string `mapstructure:"driver"`
+
+	// DriverOptions parameterise the motor driver.
+	DriverOptions dripper.DriverOptions `mapstructure:"driverOptions"`
+}
+
+// MQTTConfig configures the connection to an MQTT broker.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, such as tcp://localhost:1883.
+	Broker string `mapstructure:"broker"`
+
+	// ClientID identifies the server to the broker.
+	ClientID string `mapstructure:"clientId"`
+
+	// Username and Password authenticate the server with the broker, if it
+	// requires them.
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	// Topic is the topic every topic of the server is published under.
+	Topic string `mapstructure:"topic"`
+
+	// Discovery publishes Home Assistant discovery payloads so every dripper
+	// appears in Home Assistant as a device.
+	Discovery bool `mapstructure:"discovery"`
+
+	// DiscoveryPrefix is the topic Home Assistant looks for discovery
+	// payloads under.
+	DiscoveryPrefix string `mapstructure:"discoveryPrefix"`
+}
+
+// AuthConfig configures the users who may log in and what anyone else may
+// do.
+type AuthConfig struct {
+	// Users are the people who may log in. API tokens are created by users
+	// with the operator role.
+	Users []UserConfig `mapstructure:"users"`
+
+	// PublicReads lets requests which only read the state of the drippers
+	// through without authenticating.
+	PublicReads bool `mapstructure:"publicReads"`
+
+	// LoginDuration is how long a user stays logged in.
+	LoginDuration time.Duration
+}
+
+// UserConfig configures a user who may log in.
+type UserConfig struct {
+	// Username identifies the user when logging in and in the brew sessions
+	// they start.
+	Username string `mapstructure:"username"`
+
+	// Role is what the user may do, either viewer or operator.
+	Role string `mapstructure:"role"`
+
+	// PasswordHash is the bcrypt hash of the password of the user.
+	PasswordHash string `mapstructure:"passwordHash"`
 }
 
 // NewConfig returns a new configuration struct populated from a config file.
@@ -57,12 +197,239 @@ func NewConfig() (*Config, error) {
 		return nil, errors.New("environment is not valid")
 	}
 
+	driver := dripper.DriverAdafruitHat
+	if viper.IsSet("driver") {
+		driver = viper.GetString("driver")
+	}
+	if !dripper.IsValidDriver(driver) {
+		return nil, errors.New("driver is not valid")
+	}
+
+	driverOptions := dripper.DefaultDriverOptions()
+	err = viper.UnmarshalKey("driverOptions", &driverOptions)
+	if err != nil {
+		return nil, fmt.Errorf("driverOptions are not valid: %v", err)
+	}
+
+	drippers, err := readDripperConfigs(driver, driverOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	resume := ResumeOff
+	if viper.IsSet("resume") {
+		resume = viper.GetString("resume")
+	}
+	if !isValidResumePolicy(resume) {
+		return nil, errors.New("resume is not valid")
+	}
+
+	var resumeWindow time.Duration
+	if resume == ResumeWindow {
+		if !viper.IsSet("resumeWindow") {
+			return nil, errors.New("resumeWindow key is not set in the configuration file")
+		}
+
+		resumeWindow = time.Duration(viper.GetInt("resumeWindow")) * time.Minute
+		if resumeWindow <= 0 {
+			return nil, errors.New("resumeWindow must be a positive number of minutes")
+		}
+	}
+
+	limits := dripper.Limits{
+		MaxRunDuration:   time.Duration(viper.GetInt("maxRunSeconds")) * time.Second,
+		MaxSessionVolume: viper.GetFloat64("maxSessionVolume"),
+	}
+	if limits.MaxRunDuration < 0 || limits.MaxSessionVolume < 0 {
+		return nil, errors.New("maxRunSeconds and maxSessionVolume must not be negative")
+	}
+
+	mqtt := MQTTConfig{
+		ClientID:        DefaultMQTTClientID,
+		Topic:           DefaultMQTTTopic,
+		DiscoveryPrefix: DefaultDiscoveryPrefix,
+	}
+	err = viper.UnmarshalKey("mqtt", &mqtt)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt is not valid: %v", err)
+	}
+	if mqtt.Topic == "" || strings.ContainsAny(mqtt.Topic, "+#") {
+		return nil, errors.New("mqtt topic must be set and must not contain wildcards")
+	}
+	if mqtt.DiscoveryPrefix == "" || strings.ContainsAny(mqtt.DiscoveryPrefix, "+#") {
+		return nil, errors.New("mqtt discoveryPrefix must be set and must not contain wildcards")
+	}
+
+	auth, err := readAuthConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
-		Environment: env,
-		DatabaseDir: dbFile,
+		Environment:   env,
+		DatabaseDir:   dbFile,
+		Driver:        driver,
+		DriverOptions: driverOptions,
+		Drippers:      drippers,
+		Resume:        resume,
+		ResumeWindow:  resumeWindow,
+		Limits:        limits,
+		MQTT:          mqtt,
+		Auth:          auth,
 	}, nil
 }
 
+// readAuthConfig reads the users who may log in from the configuration file.
+func readAuthConfig() (AuthConfig, error) {
+	var auth AuthConfig
+	err := viper.UnmarshalKey("auth", &auth)
+	if err != nil {
+		return auth, fmt.Errorf("auth is not valid: %v", err)
+	}
+
+	hours := DefaultLoginHours
+	if viper.IsSet("auth.loginHours") {
+		hours = viper.GetInt("auth.loginHours")
+	}
+	auth.LoginDuration = time.Duration(hours) * time.Hour
+	if auth.LoginDuration <= 0 {
+		return auth, errors.New("auth loginHours must be a positive number of hours")
+	}
+
+	return auth, validateAuthConfig(auth)
+}
+
+// validateAuthConfig ensures every user has a unique username, a valid role and
+// a bcrypt password hash. At least one of them must be an operator, as only
+// operators can create API tokens.
+func validateAuthConfig(auth AuthConfig) error {
+	if len(auth.Users) == 0 {
+		return nil
+	}
+
+	usernames := make(map[string]bool)
+	operator := false
+	for _, u := range auth.Users {
+		if u.Username == "" || usernames[u.Username] {
+			return fmt.Errorf("username %q is empty or used more than once", u.Username)
+		}
+		usernames[u.Username] = true
+
+		if !isValidRole(u.Role) {
+			return fmt.Errorf("user %q: role is not valid", u.Username)
+		}
+		operator = operator || u.Role == api.RoleOperator
+
+		_, err := bcrypt.Cost([]byte(u.PasswordHash))
+		if err != nil {
+			return fmt.Errorf("user %q: passwordHash is not a bcrypt hash", u.Username)
+		}
+	}
+
+	if !operator {
+		return errors.New("auth users must include an operator")
+	}
+
+	return nil
+}
+
+// user returns the configuration of the user with the supplied username.
+func (a AuthConfig) user(username string) (UserConfig, bool) {
+	for _, u := range a.Users {
+		if u.Username == username {
+			return u, true
+		}
+	}
+
+	return UserConfig{}, false
+}
+
+// Enabled reports whether requests have to be authenticated.
+func (a AuthConfig) Enabled() bool {
+	return len(a.Users) > 0
+}
+
+// readDripperConfigs reads the drippers listed in the configuration file.
+// Drippers inherit the driver and driver options they do not set. A single
+// dripper named default is returned when none are listed.
+func readDripperConfigs(driver string, driverOptions dripper.DriverOptions) ([]DripperConfig, error) {
+	listed, _ := viper.Get("drippers").([]interface{})
+	if len(listed) == 0 {
+		err := dripper.ValidateDriver(driver, driverOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		return []DripperConfig{{
+			Name:          DefaultDripperName,
+			Driver:        driver,
+			DriverOptions: driverOptions,
+		}}, nil
+	}
+
+	// Decoding into configs which are already populated keeps the inherited
+	// values for any keys a dripper does not set.
+	drippers := make([]DripperConfig, len(listed))
+	for i := range drippers {
+		drippers[i].Driver = driver
+		drippers[i].DriverOptions = driverOptions
+		drippers[i].DriverOptions.StepPins = append([]string(nil), driverOptions.StepPins...)
+	}
+
+	err := viper.UnmarshalKey("drippers", &drippers)
+	if err != nil {
+		return nil, fmt.Errorf("drippers are not valid: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, d := range drippers {
+		if !dripperNamePattern.MatchString(d.Name) {
+			return nil, fmt.Errorf("dripper name %q is not valid", d.Name)
+		}
+
+		if names[d.Name] {
+			return nil, fmt.Errorf("dripper name %q is used more than once", d.Name)
+		}
+		names[d.Name] = true
+
+		err = dripper.ValidateDriver(d.Driver, d.DriverOptions)
+		if err != nil {
+			return nil, fmt.Errorf("dripper %q: %v", d.Name, err)
+		}
+	}
+
+	return drippers, nil
+}
+
+// dripper returns the configuration of the named dripper. The driver and
+// driver options shared by every dripper are returned for unknown names.
+func (c *Config) dripper(name string) DripperConfig {
+	for _, d := range c.Drippers {
+		if d.Name == name {
+			return d
+		}
+	}
+
+	return DripperConfig{
+		Name:          name,
+		Driver:        c.Driver,
+		DriverOptions: c.DriverOptions,
+	}
+}
+
+// ShouldResume reports whether a brew interrupted by an outage of the supplied
+// length is continued.
+func (c *Config) ShouldResume(outage time.Duration) bool {
+	switch c.Resume {
+	case ResumeAlways:
+		return true
+	case ResumeWindow:
+		return outage < c.ResumeWindow
+	default:
+		return false
+	}
+}
+
 // isValidEnvironment validates that an environment is one that the application
 // respects.
 func isValidEnvironment(env string) bool {
@@ -80,3 +447,14 @@ func isValidEnvironment(env string) bool {
 
 	return false
 }
+
+// isValidRole validates that a role is one that the application respects.
+func isValidRole(role string) bool {
+	return role == api.RoleViewer || role == api.RoleOperator
+}
+
+// isValidResumePolicy validates that a resume policy is one that the
+// application respects.
+func isValidResumePolicy(resume string) bool {
+	return resume == ResumeOff || resume == ResumeAlways || resume == ResumeWindow
+}
@@ -5,6 +5,10 @@ package server
 
 import (
 	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
 )
 
 func TestNewConfigReadsFromTestData(t *testing.T) {
@@ -20,6 +24,115 @@ func TestNewConfigReadsFromTestData(t *testing.T) {
 	if config.Environment != "testing" {
 		t.Error("incorrect environment loaded from config file")
 	}
+
+	if config.Driver != dripper.DriverSimulator {
+		t.Error("incorrect driver loaded from config file")
+	}
+
+	if config.DriverOptions.Motor != 1 || config.DriverOptions.StepMicroseconds != dripper.DefaultStepMicroseconds {
+		t.Error("incorrect driver options loaded from config file")
+	}
+
+	if config.Resume != ResumeWindow || config.ResumeWindow != 10*time.Minute {
+		t.Error("incorrect resume policy loaded from config file")
+	}
+
+	if config.Limits.MaxRunDuration != 2*time.Minute || config.Limits.MaxSessionVolume != 2000 {
+		t.Error("incorrect watchdog limits loaded from config file")
+	}
+
+	if config.MQTT.Broker != "tcp://localhost:1883" || config.MQTT.Topic != "office/cold-brew" || config.MQTT.ClientID != DefaultMQTTClientID {
+		t.Error("incorrect mqtt configuration loaded from config file:", config.MQTT)
+	}
+
+	if !config.MQTT.Discovery || config.MQTT.DiscoveryPrefix != DefaultDiscoveryPrefix {
+		t.Error("incorrect home assistant discovery loaded from config file:", config.MQTT)
+	}
+
+	if config.Auth.Enabled() || !config.Auth.PublicReads || config.Auth.LoginDuration != 12*time.Hour {
+		t.Error("incorrect auth configuration loaded from config file:", config.Auth)
+	}
+}
+
+func TestNewConfigReadsDrippers(t *testing.T) {
+	config, err := NewConfig()
+	if err != nil {
+		t.Fatal("could not load configuration file:", err)
+	}
+
+	if len(config.Drippers) != 2 || config.Drippers[0].Name != "left" || config.Drippers[1].Name != "right" {
+		t.Fatal("incorrect drippers loaded from config file:", config.Drippers)
+	}
+
+	left := config.Drippers[0]
+	if left.Driver != dripper.DriverSimulator || left.DriverOptions.Motor != 1 {
+		t.Error("dripper did not inherit the driver from the config file:", left)
+	}
+
+	right := config.Drippers[1]
+	if right.DriverOptions.Motor != 3 || right.DriverOptions.StepMicroseconds != dripper.DefaultStepMicroseconds {
+		t.Error("dripper did not override the driver options from the config file:", right)
+	}
+
+	if config.dripper("right").DriverOptions.Motor != 3 || config.dripper("foo").DriverOptions.Motor != 1 {
+		t.Error("incorrect dripper configuration looked up by name")
+	}
+}
+
+func TestValidateAuthConfig(t *testing.T) {
+	auth := withTestAuthConfig()
+	err := validateAuthConfig(auth)
+	if err != nil {
+		t.Error("valid auth configuration was not valid:", err)
+	}
+
+	if user, ok := auth.user("office"); !ok || user.Role != api.RoleViewer {
+		t.Error("incorrect user looked up by username:", user)
+	}
+
+	auth.Users = append(auth.Users, UserConfig{Username: "barista", Role: api.RoleViewer, PasswordHash: auth.Users[1].PasswordHash})
+	if validateAuthConfig(auth) == nil {
+		t.Error("duplicate username was valid")
+	}
+
+	auth = withTestAuthConfig()
+	auth.Users[1].Role = "barista"
+	if validateAuthConfig(auth) == nil {
+		t.Error("invalid role was valid")
+	}
+
+	auth = withTestAuthConfig()
+	auth.Users[1].PasswordHash = "filter"
+	if validateAuthConfig(auth) == nil {
+		t.Error("password which is not a bcrypt hash was valid")
+	}
+
+	auth = withTestAuthConfig()
+	auth.Users = auth.Users[1:]
+	if validateAuthConfig(auth) == nil {
+		t.Error("users without an operator were valid")
+	}
+}
+
+func TestShouldResume(t *testing.T) {
+	config := Config{Resume: ResumeWindow, ResumeWindow: 10 * time.Minute}
+	if !config.ShouldResume(time.Minute) {
+		t.Error("brew was not resumed after a short outage")
+	}
+
+	if config.ShouldResume(time.Hour) {
+		t.Error("brew was resumed after an outage longer than the resume window")
+	}
+
+	config.Resume = ResumeAlways
+	if !config.ShouldResume(time.Hour) {
+		t.Error("brew was not resumed with the always policy")
+	}
+
+	config.Resume = ResumeOff
+	if config.ShouldResume(0) {
+		t.Error("brew was resumed with the off policy")
+	}
 }
 
 func TestIsValidEnvironmentWhenEnvironmentIsValid(t *testing.T) {
@@ -4,9 +4,16 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+
 	scribble "github.com/nanobox-io/golang-scribble"
 )
 
+// idBytes is the number of random bytes used to generate resource IDs.
+const idBytes = 8
+
 // NewDatabase creates a new filesystem based database given the base directory.
 func NewDatabase(dir string) (*scribble.Driver, error) {
 	db, err := scribble.New(dir, nil)
@@ -16,3 +23,32 @@ func NewDatabase(dir string) (*scribble.Driver, error) {
 
 	return db, nil
 }
+
+// newID generates a random ID for a resource stored in the database.
+func newID() (string, error) {
+	b := make([]byte, idBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// isValidID validates that an ID supplied by a client is one that could have
+// been generated by newID. Since IDs become file names in the database, this
+// keeps clients from reaching outside of a collection.
+func isValidID(id string) bool {
+	if len(id) != idBytes*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// isNotFound determines if an error returned by the database was caused by a
+// missing collection or resource.
+func isNotFound(err error) bool {
+	return os.IsNotExist(err)
+}
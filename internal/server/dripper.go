@@ -4,46 +4,43 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
 	"github.com/gin-gonic/gin"
 )
 
+var (
+	// errInvalidRate is returned when a drip rate outside of what the dripper
+	// supports is requested.
+	errInvalidRate = fmt.Errorf("dripsPerMinute must be greater than 0 and must not exceed %v", dripper.MaxDripsPerMinute)
+
+	// errInvalidTarget is returned when a negative target volume is requested.
+	errInvalidTarget = errors.New("targetVolume must not be negative")
+)
+
 // GetDripper returns the current state of the cold brew dripper.
 func (s *Server) GetDripper(c *gin.Context) {
-	c.JSON(http.StatusOK, api.DripperEndpoint{
-		State:          s.Dripper.GetState(),
-		DripsPerMinute: s.Dripper.GetDripsPerMinute(),
-	})
+	c.JSON(http.StatusOK, s.dripperStatus())
 }
 
 // SetDripperRun sets the dripper to the run state.
 func (s *Server) SetDripperRun(c *gin.Context) {
-	err := s.Dripper.Run()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
-		return
+	err := s.runDripper()
+	if err == nil {
+		s.beginSession(requester(c), nil)
 	}
 
-	c.JSON(http.StatusOK, api.DripperEndpoint{
-		State:          s.Dripper.GetState(),
-		DripsPerMinute: s.Dripper.GetDripsPerMinute(),
-	})
+	s.respondToDripperCommand(c, err)
 }
 
-// SetDripperOff sets the dripper to the off state.
+// SetDripperOff sets the dripper to the off state. Turning the dripper off
+// always works, so a recipe being brewed is aborted first.
 func (s *Server) SetDripperOff(c *gin.Context) {
-	err := s.Dripper.Off()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
-		return
-	}
-
-	c.JSON(http.StatusOK, api.DripperEndpoint{
-		State:          s.Dripper.GetState(),
-		DripsPerMinute: s.Dripper.GetDripsPerMinute(),
-	})
+	s.respondToDripperCommand(c, s.offDripper())
 }
 
 // SetDripperDrip sets the dripper to the drip state.
@@ -55,19 +52,239 @@ func (s *Server) SetDripperDrip(c *gin.Context) {
 		return
 	}
 
-	if json.DripsPerMinute > 240.0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "dripsPerMinute must not exceed 240"})
+	if json.Profile != nil {
+		profile := dripperProfile(*json.Profile)
+		err = profile.Validate()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = s.dripProfileUntil(profile, json.TargetVolume)
+		if err == nil {
+			s.beginSession(requester(c), nil)
+		}
+
+		s.respondToDripperCommand(c, err)
 		return
 	}
 
-	err = s.Dripper.Drip(json.DripsPerMinute)
+	dripsPerMin := json.DripsPerMinute
+	if json.MillilitresPerHour > 0 {
+		dripsPerMin, err = s.Dripper.GetCalibration().DripsPerMinute(json.MillilitresPerHour, s.Dripper.GetSettings())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err = s.dripDripperUntil(dripsPerMin, json.TargetVolume)
+	if err == nil {
+		s.beginSession(requester(c), nil)
+	}
+
+	s.respondToDripperCommand(c, err)
+}
+
+// runDripper sets the dripper to the run state unless a recipe owns it.
+func (s *Server) runDripper() error {
+	return s.controlDripper(s.Dripper.Run)
+}
+
+// dripDripper sets the dripper to the drip state unless a recipe owns it.
+func (s *Server) dripDripper(dripsPerMin float64) error {
+	return s.dripDripperUntil(dripsPerMin, 0)
+}
+
+// dripDripperUntil sets the dripper to the drip state and, if a target volume
+// is supplied, turns it off once that many millilitres have been dispensed.
+func (s *Server) dripDripperUntil(dripsPerMin float64, targetVolume float64) error {
+	if !isValidRate(dripsPerMin) {
+		return errInvalidRate
+	}
+
+	return s.dripUntil(targetVolume, func() error {
+		return s.Dripper.Drip(dripsPerMin)
+	})
+}
+
+// dripProfileUntil sets the dripper to the drip state following a rate
+// profile and, if a target volume is supplied, turns it off once that many
+// millilitres have been dispensed. A recipe owning the dripper is left alone.
+func (s *Server) dripProfileUntil(profile dripper.Profile, targetVolume float64) error {
+	return s.dripUntil(targetVolume, func() error {
+		return s.Dripper.DripProfile(profile, 0)
+	})
+}
+
+// dripUntil starts dripping with the supplied function and then sets the
+// target volume, if there is one, unless a recipe owns the dripper. No recipe
+// can start in between, so none inherits the target.
+func (s *Server) dripUntil(targetVolume float64, drip func() error) error {
+	if targetVolume < 0 {
+		return errInvalidTarget
+	}
+
+	if targetVolume > 0 && !s.Dripper.IsCalibratedFor(dripper.DRIP) {
+		return dripper.ErrNotCalibrated
+	}
+
+	return s.controlDripper(func() error {
+		err := drip()
+		if err != nil || targetVolume == 0 {
+			return err
+		}
+
+		return s.Dripper.SetTargetVolume(targetVolume)
+	})
+}
+
+// setDripperRate changes the drip rate without changing the state of the
+// dripper unless a recipe owns it.
+func (s *Server) setDripperRate(dripsPerMin float64) error {
+	if !isValidRate(dripsPerMin) {
+		return errInvalidRate
+	}
+
+	return s.controlDripper(func() error {
+		s.Dripper.SetDripsPerMinute(dripsPerMin)
+		return nil
+	})
+}
+
+// controlDripper runs a manual command on the dripper unless a recipe owns
+// it. Recipes are only started while holding the ownerMutex too, so a recipe
+// never starts between the check and the command.
+func (s *Server) controlDripper(command func() error) error {
+	s.ownerMutex.Lock()
+	defer s.ownerMutex.Unlock()
+
+	if s.Executor.Active() {
+		return errBrewActive
+	}
+
+	return command()
+}
+
+// offDripper aborts any recipe being brewed, ends the brew session and turns
+// the dripper off.
+func (s *Server) offDripper() error {
+	err := s.Executor.Abort()
+	if err == nil {
+		s.Executor.Wait()
+	}
+
+	s.endSession(api.SessionStopped)
+
+	return s.Dripper.Off()
+}
+
+// dripperStatus returns the current state of the dripper, including the drip
+// rate it has actually achieved next to the requested one.
+func (s *Server) dripperStatus() api.DripperEndpoint {
+	dpm := s.Dripper.GetDripsPerMinute()
+	profile, elapsed := s.Dripper.GetProfile()
+	return api.DripperEndpoint{
+		State:                  s.Dripper.GetState(),
+		DripsPerMinute:         dpm,
+		MeasuredDripsPerMinute: s.Dripper.GetMeasuredDripsPerMinute(),
+		MillilitresPerHour:     s.Dripper.GetCalibration().MillilitresPerHour(dpm, s.Dripper.GetSettings()),
+		TargetVolume:           s.Dripper.GetTargetVolume(),
+		DispensedVolume:        s.Dripper.GetDispensedVolume(),
+		Trip:                   tripStatus(s.Dripper.GetTrip()),
+		Profile:                profileStatus(profile),
+		ProfileElapsed:         elapsed.Seconds(),
+	}
+}
+
+// profileStatus converts a rate profile to its API representation.
+func profileStatus(profile *dripper.Profile) *api.Profile {
+	if profile == nil {
+		return nil
+	}
+
+	status := api.Profile{
+		Type:                profile.Type,
+		StartDripsPerMinute: profile.StartDripsPerMinute,
+		EndDripsPerMinute:   profile.EndDripsPerMinute,
+		Seconds:             profile.Seconds,
+	}
+
+	for _, step := range profile.Steps {
+		status.Steps = append(status.Steps, api.RateStep{
+			AfterSeconds:   step.AfterSeconds,
+			DripsPerMinute: step.DripsPerMinute,
+		})
+	}
+
+	return &status
+}
+
+// dripperProfile converts a rate profile submitted by a client to the one
+// the dripper follows.
+func dripperProfile(profile api.Profile) dripper.Profile {
+	converted := dripper.Profile{
+		Type:                profile.Type,
+		StartDripsPerMinute: profile.StartDripsPerMinute,
+		EndDripsPerMinute:   profile.EndDripsPerMinute,
+		Seconds:             profile.Seconds,
+	}
+
+	for _, step := range profile.Steps {
+		converted.Steps = append(converted.Steps, dripper.RateStep{
+			AfterSeconds:   step.AfterSeconds,
+			DripsPerMinute: step.DripsPerMinute,
+		})
+	}
+
+	return converted
+}
+
+// tripStatus converts a watchdog trip to its API representation.
+func tripStatus(trip *dripper.Trip) *api.Trip {
+	if trip == nil {
+		return nil
+	}
+
+	return &api.Trip{
+		Reason:        trip.Reason,
+		Time:          trip.Time,
+		SessionVolume: trip.SessionVolume,
+	}
+}
+
+// abortBrewOnTrip is a dripper listener which aborts the recipe being brewed
+// when the watchdog turns the dripper off. Until the abort lands, the dripper
+// refuses to start again, so the next step can not turn it back on.
+func (s *Server) abortBrewOnTrip(e dripper.Event) {
+	if e.Type != dripper.EventTrip {
+		return
+	}
+
+	// The dripper is locked while its listeners run and aborting waits for
+	// the executor, which may be waiting on the dripper.
+	go s.Executor.Abort()
+}
+
+// respondToDripperCommand writes the result of a dripper command.
+func (s *Server) respondToDripperCommand(c *gin.Context, err error) {
+	if err == errInvalidRate || err == errInvalidTarget || err == dripper.ErrNotCalibrated {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err == errBrewActive || err == dripper.ErrTripped {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, api.DripperEndpoint{
-		State:          s.Dripper.GetState(),
-		DripsPerMinute: s.Dripper.GetDripsPerMinute(),
-	})
+	c.JSON(http.StatusOK, s.dripperStatus())
+}
+
+// isValidRate validates that a drip rate is one the dripper supports.
+func isValidRate(dripsPerMin float64) bool {
+	return dripsPerMin > 0 && dripsPerMin <= dripper.MaxDripsPerMinute
 }
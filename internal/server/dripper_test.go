@@ -0,0 +1,181 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+func TestGetDripperReportsWatchdogTrip(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	s.Dripper.SetLimits(dripper.Limits{MaxRunDuration: 20 * time.Millisecond})
+
+	r := withTestRouter()
+	r.GET("/dripper", s.GetDripper)
+	r.POST("/dripper/run", s.SetDripperRun)
+
+	w := withTestRequest(r, http.MethodPost, "/dripper/run", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not run dripper:", w.Body.String())
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	w = withTestRequest(r, http.MethodGet, "/dripper", "")
+	var status api.DripperEndpoint
+	err = json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal("could not decode dripper status:", err)
+	}
+
+	if status.State != dripper.OFF || status.Trip == nil || status.Trip.Reason != dripper.TripRunDuration {
+		t.Error("watchdog trip was not reported:", w.Body.String())
+	}
+
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		t.Fatal("could not read sessions from db:", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Outcome != api.SessionTripped {
+		t.Error("session did not end as tripped")
+	}
+}
+
+func TestWatchdogTripAbortsBrew(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	s.Dripper.SetLimits(dripper.Limits{MaxRunDuration: 20 * time.Millisecond})
+
+	err = s.Executor.Start(withTestRecipe(t))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	s.Executor.Wait()
+
+	if s.Executor.Status().State != brew.StatusAborted {
+		t.Error("recipe was not aborted when the watchdog tripped")
+	}
+
+	if s.Dripper.GetState() != dripper.OFF {
+		t.Error("dripper was turned back on after the watchdog tripped")
+	}
+}
+
+func TestSetDripperDripWithProfile(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.GET("/dripper", s.GetDripper)
+	r.POST("/dripper/drip", s.SetDripperDrip)
+
+	w := withTestRequest(r, http.MethodPost, "/dripper/drip", `{"profile": {"type": "sine", "seconds": 60}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Error("invalid profile returned", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/drip", `{"profile": {"type": "linear", "startDripsPerMinute": 120, "endDripsPerMinute": 40, "seconds": 3600}}`)
+	defer s.offDripper()
+	if w.Code != http.StatusOK {
+		t.Fatal("could not start profile:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/dripper", "")
+	var status api.DripperEndpoint
+	err = json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal("could not decode dripper status:", err)
+	}
+
+	if status.State != dripper.DRIP || status.Profile == nil || status.Profile.Type != dripper.ProfileLinear {
+		t.Error("active profile was not reported:", w.Body.String())
+	}
+
+	if status.DripsPerMinute > 120 || status.DripsPerMinute < 119 {
+		t.Error("profile did not start at its start rate:", status.DripsPerMinute)
+	}
+}
+
+func TestManualCommandsNeverFightARecipe(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.offDripper()
+
+	recipe := withTestRecipe(t)
+	recipe.Steps = []brew.Step{{Action: brew.ActionDrip, DripsPerMinute: 40, Seconds: 60}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := s.dripDripper(55)
+				if err == errBrewActive {
+					return
+				}
+				if err != nil {
+					t.Error("could not start dripping:", err)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	err = s.startBrew(recipe, "barista")
+	if err != nil {
+		t.Fatal("could not start brew:", err)
+	}
+	wg.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	if s.Dripper.GetState() != dripper.DRIP || s.Dripper.GetDripsPerMinute() != 40 {
+		t.Error("manual drip overrode the recipe:", s.Dripper.GetDripsPerMinute())
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/gin-gonic/gin"
+)
+
+// drippersCollection is the directory in the database holding the collections
+// of every dripper other than the default one.
+const drippersCollection = "drippers"
+
+// GetDrippers returns every dripper managed by the server in the order they
+// are configured.
+func (s *Server) GetDrippers(c *gin.Context) {
+	drippers := []api.NamedDripper{}
+	for i, dc := range s.Config.Drippers {
+		d, ok := s.drippers[dc.Name]
+		if !ok {
+			continue
+		}
+
+		named := api.NamedDripper{
+			Name:    dc.Name,
+			Default: i == 0,
+			Driver:  dc.Driver,
+		}
+		if d.Dripper != nil {
+			named.Dripper = d.dripperStatus()
+		}
+
+		drippers = append(drippers, named)
+	}
+
+	c.JSON(http.StatusOK, drippers)
+}
+
+// ForDripper adapts a handler so it is served by the server of the dripper
+// named in the request path.
+func (s *Server) ForDripper(handler func(*Server, *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d, ok := s.drippers[c.Param("name")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "dripper not found"})
+			return
+		}
+
+		handler(d, c)
+	}
+}
+
+// Off turns every dripper managed by the server off and disconnects from the
+// MQTT broker.
+func (s *Server) Off() {
+	for _, d := range s.drippers {
+		if d.Dripper != nil {
+			d.Dripper.Off()
+		}
+	}
+
+	if s.mqtt != nil {
+		s.mqtt.close()
+	}
+}
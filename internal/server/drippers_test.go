@@ -0,0 +1,108 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+// withTestDrippers creates a server for each of the drippers in the test
+// configuration, sharing a single database, and returns the default one.
+func withTestDrippers() (*Server, string, error) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.drippers = make(map[string]*Server)
+	for i, dc := range s.Config.Drippers {
+		d := s
+		if i > 0 {
+			d = &Server{
+				Events:    NewHub(),
+				Config:    s.Config,
+				DB:        s.DB,
+				namespace: path.Join(drippersCollection, dc.Name),
+				drippers:  s.drippers,
+			}
+		}
+		d.Name = dc.Name
+
+		err = withTestDripper(d)
+		if err != nil {
+			return nil, dir, err
+		}
+		s.drippers[dc.Name] = d
+	}
+
+	return s, dir, nil
+}
+
+func TestForDripperControlsNamedDripper(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	r := withTestRouter()
+	r.POST("/drippers/:name/run", s.ForDripper((*Server).SetDripperRun))
+	r.GET("/drippers", s.GetDrippers)
+
+	w := withTestRequest(r, http.MethodPost, "/drippers/right/run", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not run named dripper:", w.Body.String())
+	}
+
+	if s.drippers["right"].Dripper.GetState() != dripper.RUN || s.Dripper.GetState() != dripper.OFF {
+		t.Error("request did not control only the named dripper")
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/drippers/foo/run", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("unknown dripper did not return not found:", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/drippers", "")
+	var drippers []api.NamedDripper
+	err = json.Unmarshal(w.Body.Bytes(), &drippers)
+	if err != nil {
+		t.Fatal("could not decode drippers:", err)
+	}
+
+	if len(drippers) != 2 || drippers[0].Name != "left" || !drippers[0].Default || drippers[1].Dripper.State != dripper.RUN {
+		t.Error("drippers were not listed:", w.Body.String())
+	}
+}
+
+func TestNamedDrippersKeepTheirOwnSettings(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	settings := dripper.DefaultSettings()
+	settings.DripSpeed = 200
+	err = s.drippers["right"].writeDripperSettingsToDB(settings)
+	if err != nil {
+		t.Fatal("could not write settings:", err)
+	}
+
+	if s.readSettingsOrDefault().DripSpeed == 200 {
+		t.Error("settings of a named dripper were read by the default dripper")
+	}
+
+	if s.drippers["right"].readSettingsOrDefault().DripSpeed != 200 {
+		t.Error("settings of a named dripper were not read back")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventHistorySize is the number of events kept so that reconnecting
+	// clients can resume where they left off.
+	eventHistorySize = 256
+
+	// subscriptionBuffer is the number of events buffered for each subscriber.
+	// A subscriber which falls further behind is disconnected and is expected
+	// to reconnect using the last event ID it received.
+	subscriptionBuffer = 64
+
+	// heartbeatInterval is how often a heartbeat is sent to idle event
+	// streams.
+	heartbeatInterval = 15 * time.Second
+
+	// eventSettings is published when new dripper settings take effect.
+	eventSettings = "settings"
+
+	// eventHeartbeat is sent to event streams to keep them open.
+	eventHeartbeat = "heartbeat"
+)
+
+// Subscription receives events published to a hub.
+type Subscription struct {
+	// C receives published events. It is closed when the subscription is
+	// removed or the subscriber falls too far behind.
+	C chan api.Event
+}
+
+// Hub fans out events to every subscriber and keeps a short history of
+// events for clients resuming a stream.
+type Hub struct {
+	// nextID is the ID assigned to the next published event. It is seeded
+	// from the clock so IDs keep increasing across restarts.
+	nextID uint64
+
+	// history is the most recently published events, oldest first.
+	history []api.Event
+
+	// subscribers are the active subscriptions.
+	subscribers map[*Subscription]struct{}
+
+	// mutex is used to access the hub across multiple goroutines.
+	mutex sync.Mutex
+}
+
+// NewHub creates a new event hub.
+func NewHub() *Hub {
+	return &Hub{
+		nextID:      uint64(time.Now().UnixNano()),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber. It never blocks.
+func (h *Hub) Publish(eventType string, data interface{}) api.Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	event := api.Event{
+		ID:   h.nextID,
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+	h.nextID++
+
+	h.history = append(h.history, event)
+	if len(h.history) > eventHistorySize {
+		h.history = h.history[len(h.history)-eventHistorySize:]
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.C <- event:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.C)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a new subscriber. Events published after lastID which
+// are still in the history are returned so the subscriber can catch up. A
+// lastID of zero skips the history.
+func (h *Hub) Subscribe(lastID uint64) ([]api.Event, *Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var missed []api.Event
+	if lastID != 0 {
+		for _, event := range h.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	sub := &Subscription{
+		C: make(chan api.Event, subscriptionBuffer),
+	}
+	h.subscribers[sub] = struct{}{}
+
+	return missed, sub
+}
+
+// Unsubscribe removes a subscriber from the hub.
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	_, ok := h.subscribers[sub]
+	if ok {
+		delete(h.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// GetEvents streams dripper events to the client using Server-Sent Events.
+// Clients can resume a stream by sending the Last-Event-ID header.
+func (s *Server) GetEvents(c *gin.Context) {
+	lastID, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+	missed, sub := s.Events.Subscribe(lastID)
+	defer s.Events.Unsubscribe(sub)
+
+	for _, event := range missed {
+		renderEvent(c, event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	done := c.Request.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			renderEvent(c, event)
+		case now := <-heartbeat.C:
+			c.Render(-1, sse.Event{
+				Event: eventHeartbeat,
+				Data:  now.Format(time.RFC3339),
+			})
+		}
+		c.Writer.Flush()
+	}
+}
+
+// renderEvent writes a single event to an event stream.
+func renderEvent(c *gin.Context, event api.Event) {
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(event.ID, 10),
+		Event: event.Type,
+		Data:  event,
+	})
+}
+
+// publishDripperEvent is a dripper listener which publishes dripper events to
+// the hub. Settings events carry the settings which took effect.
+func (s *Server) publishDripperEvent(e dripper.Event) {
+	if e.Type == dripper.EventSettings {
+		s.Events.Publish(eventSettings, s.Dripper.GetSettings())
+		return
+	}
+
+	s.Events.Publish(e.Type, api.DripperEndpoint{
+		State:                  e.State,
+		DripsPerMinute:         e.DripsPerMinute,
+		MeasuredDripsPerMinute: e.MeasuredDripsPerMinute,
+		DispensedVolume:        e.DispensedVolume,
+		Trip:                   tripStatus(e.Trip),
+	})
+}
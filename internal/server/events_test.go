@@ -0,0 +1,69 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestHubPublishesToSubscribers(t *testing.T) {
+	h := NewHub()
+	_, sub := h.Subscribe(0)
+	defer h.Unsubscribe(sub)
+
+	published := h.Publish("foo", "bar")
+
+	event := <-sub.C
+	if event.ID != published.ID || event.Type != "foo" || event.Data != "bar" {
+		t.Error("subscriber did not receive the published event")
+	}
+}
+
+func TestHubSubscribeReturnsMissedEvents(t *testing.T) {
+	h := NewHub()
+	first := h.Publish("foo", 1)
+	h.Publish("foo", 2)
+	h.Publish("foo", 3)
+
+	missed, sub := h.Subscribe(first.ID)
+	defer h.Unsubscribe(sub)
+
+	if len(missed) != 2 || missed[0].Data != 2 || missed[1].Data != 3 {
+		t.Error("events after the last event ID were not returned")
+	}
+
+	missed, sub = h.Subscribe(0)
+	defer h.Unsubscribe(sub)
+
+	if len(missed) != 0 {
+		t.Error("events were returned without a last event ID")
+	}
+}
+
+func TestHubDisconnectsSlowSubscribers(t *testing.T) {
+	h := NewHub()
+	_, sub := h.Subscribe(0)
+
+	for i := 0; i <= subscriptionBuffer; i++ {
+		h.Publish("foo", i)
+	}
+
+	for range sub.C {
+	}
+
+	// Unsubscribing a disconnected subscriber must not close the channel
+	// twice.
+	h.Unsubscribe(sub)
+}
+
+func TestHubHistoryIsCapped(t *testing.T) {
+	h := NewHub()
+	for i := 0; i < eventHistorySize+10; i++ {
+		h.Publish("foo", i)
+	}
+
+	if len(h.history) != eventHistorySize {
+		t.Error("event history was not capped")
+	}
+}
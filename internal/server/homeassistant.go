@@ -0,0 +1,114 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/sirupsen/logrus"
+)
+
+// haDevice describes a dripper to Home Assistant as a device, which groups
+// together the entities of the dripper.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haEntity is the discovery payload of a single Home Assistant entity.
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	Device            haDevice `json:"device"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	PayloadPress      string   `json:"payload_press,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	Options           []string `json:"options,omitempty"`
+	Min               float64  `json:"min,omitempty"`
+	Max               float64  `json:"max,omitempty"`
+	Step              float64  `json:"step,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+}
+
+// publishDiscovery publishes the Home Assistant discovery payloads of a
+// dripper so it appears as a device with a state sensor, a drip rate number,
+// run and off buttons and a dispensed volume sensor.
+func (b *mqttBridge) publishDiscovery(s *Server) {
+	name := s.Name
+	device := haDevice{
+		Identifiers:  []string{b.config.ClientID + "_" + name},
+		Name:         "Cold Brew " + name,
+		Manufacturer: "Cold Brew",
+		Model:        s.Config.dripper(name).Driver,
+	}
+
+	entities := []struct {
+		component string
+		object    string
+		entity    haEntity
+	}{
+		{"sensor", "state", haEntity{
+			Name:        "State",
+			StateTopic:  b.dripperTopic(name, "state"),
+			DeviceClass: "enum",
+			Options:     []string{dripper.RUN, dripper.DRIP, dripper.OFF},
+			Icon:        "mdi:coffee-maker",
+		}},
+		{"number", "drip_rate", haEntity{
+			Name:              "Drip rate",
+			StateTopic:        b.dripperTopic(name, "dripsPerMinute"),
+			CommandTopic:      b.dripperTopic(name, "command/drip"),
+			UnitOfMeasurement: "drips/min",
+			Min:               1,
+			Max:               dripper.MaxDripsPerMinute,
+			Step:              1,
+			Icon:              "mdi:water",
+		}},
+		{"button", "run", haEntity{
+			Name:         "Run",
+			CommandTopic: b.dripperTopic(name, "command/run"),
+			PayloadPress: dripper.RUN,
+			Icon:         "mdi:play",
+		}},
+		{"button", "off", haEntity{
+			Name:         "Off",
+			CommandTopic: b.dripperTopic(name, "command/off"),
+			PayloadPress: dripper.OFF,
+			Icon:         "mdi:stop",
+		}},
+		{"sensor", "dispensed_volume", haEntity{
+			Name:              "Dispensed volume",
+			StateTopic:        b.dripperTopic(name, "dispensedVolume"),
+			DeviceClass:       "volume",
+			StateClass:        "total_increasing",
+			UnitOfMeasurement: "mL",
+		}},
+	}
+
+	for _, e := range entities {
+		entity := e.entity
+		entity.UniqueID = device.Identifiers[0] + "_" + e.object
+		entity.Device = device
+		entity.AvailabilityTopic = b.statusTopic()
+
+		payload, err := json.Marshal(entity)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"entity": e.object,
+				"error":  err,
+			}).Error("could not encode home assistant discovery payload")
+			continue
+		}
+
+		topic := b.config.DiscoveryPrefix + "/" + e.component + "/" + device.Identifiers[0] + "/" + e.object + "/config"
+		b.client.Publish(topic, string(payload), true)
+	}
+}
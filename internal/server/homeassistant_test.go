@@ -0,0 +1,65 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMQTTPublishesHomeAssistantDiscovery(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	client := withTestMQTT(s, true)
+
+	topics := []string{
+		"homeassistant/sensor/cold-brew_right/state/config",
+		"homeassistant/number/cold-brew_right/drip_rate/config",
+		"homeassistant/button/cold-brew_right/run/config",
+		"homeassistant/button/cold-brew_right/off/config",
+		"homeassistant/sensor/cold-brew_right/dispensed_volume/config",
+	}
+	for _, topic := range topics {
+		if client.message(topic) == "" {
+			t.Error("discovery payload was not published to", topic)
+		}
+	}
+
+	var rate haEntity
+	err = json.Unmarshal([]byte(client.message("homeassistant/number/cold-brew_right/drip_rate/config")), &rate)
+	if err != nil {
+		t.Fatal("could not decode discovery payload:", err)
+	}
+
+	if rate.CommandTopic != "cold-brew/right/command/drip" || rate.StateTopic != "cold-brew/right/dripsPerMinute" {
+		t.Error("drip rate was not backed by the dripper topics:", rate)
+	}
+
+	if rate.UniqueID != "cold-brew_right_drip_rate" || rate.Device.Identifiers[0] != "cold-brew_right" {
+		t.Error("drip rate was not identified by the dripper:", rate)
+	}
+
+	if rate.AvailabilityTopic != "cold-brew/status" {
+		t.Error("drip rate did not follow the availability of the server")
+	}
+}
+
+func TestMQTTSkipsDiscoveryWhenDisabled(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	client := withTestMQTT(s, false)
+	if client.message("homeassistant/button/cold-brew_left/run/config") != "" {
+		t.Error("discovery payload was published when discovery is disabled")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// metricsNamespace prefixes the name of every metric the server exports.
+	metricsNamespace = "cold_brew"
+
+	// otherRoute is the route label of requests which did not match a route,
+	// such as static files, so they can not grow the number of series.
+	otherRoute = "other"
+)
+
+var (
+	// motorCommands counts the commands sent to the motor of each dripper.
+	motorCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "motor_commands_total",
+		Help:      "Number of commands sent to the motor controller.",
+	}, []string{"dripper", "command"})
+
+	// motorErrors counts the errors returned by the motor controller of each
+	// dripper.
+	motorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "motor_errors_total",
+		Help:      "Number of errors returned by the motor controller.",
+	}, []string{"dripper", "command"})
+
+	// requestDuration measures how long the server takes to answer each
+	// route.
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to answer HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// newMetricsRegistry creates the registry of every metric served by the
+// server, including the state of each of the drippers.
+func newMetricsRegistry(drippers map[string]*Server) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		motorCommands,
+		motorErrors,
+		requestDuration,
+		newDripperCollector(drippers),
+	)
+
+	return registry
+}
+
+// GetMetrics serves the metrics of the server and every dripper in the
+// Prometheus exposition format.
+func (s *Server) GetMetrics(c *gin.Context) {
+	promhttp.HandlerFor(s.metrics, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
+
+// RequestMetrics returns middleware which measures how long the router takes
+// to answer each of its routes.
+func RequestMetrics(r *gin.Engine) gin.HandlerFunc {
+	var (
+		routes map[string]bool
+		once   sync.Once
+	)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// The routes are only listed once the first request arrives, as the
+		// middleware is added before any of them are registered.
+		once.Do(func() {
+			routes = make(map[string]bool)
+			for _, route := range r.Routes() {
+				routes[route.Method+" "+route.Path] = true
+			}
+		})
+
+		route := routePath(c)
+		if !routes[c.Request.Method+" "+route] {
+			route = otherRoute
+		}
+
+		requestDuration.WithLabelValues(
+			c.Request.Method,
+			route,
+			strconv.Itoa(c.Writer.Status()),
+		).Observe(time.Since(start).Seconds())
+	}
+}
+
+// routePath recovers the path of the route which matched the request by
+// putting the names of the path parameters back in place of their values.
+func routePath(c *gin.Context) string {
+	segments := strings.Split(c.Request.URL.Path, "/")
+
+	// Parameters are matched from the end of the path so a value which is
+	// also the name of an earlier part of the route is not mistaken for it.
+	p := len(c.Params) - 1
+	for i := len(segments) - 1; i >= 0 && p >= 0; i-- {
+		if segments[i] == c.Params[p].Value {
+			segments[i] = ":" + c.Params[p].Key
+			p--
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// countingMotor wraps a motor controller to count the commands sent to it and
+// the errors it returns. The result of every command is also passed to the
+// supplied function, if there is one.
+type countingMotor struct {
+	dripper.MotorController
+	name   string
+	result func(command string, err error)
+}
+
+// Start starts the motor controller, counting any error.
+func (m countingMotor) Start() error {
+	return m.count("start", m.MotorController.Start())
+}
+
+// RunMotor starts or releases the motor, counting the command.
+func (m countingMotor) RunMotor(dir motor.Direction) error {
+	command := "on"
+	if dir == motor.Release {
+		command = "off"
+	}
+
+	motorCommands.WithLabelValues(m.name, command).Inc()
+	return m.count(command, m.MotorController.RunMotor(dir))
+}
+
+// SetMotorSpeed sets the speed of the motor, counting the command.
+func (m countingMotor) SetMotorSpeed(speed int32) error {
+	motorCommands.WithLabelValues(m.name, "speed").Inc()
+	return m.count("speed", m.MotorController.SetMotorSpeed(speed))
+}
+
+// count counts the error returned by a command, if any, and returns it.
+func (m countingMotor) count(command string, err error) error {
+	if err != nil {
+		motorErrors.WithLabelValues(m.name, command).Inc()
+	}
+
+	if m.result != nil {
+		m.result(command, err)
+	}
+
+	return err
+}
+
+// dripperCollector reads the state of every dripper each time the metrics
+// are collected.
+type dripperCollector struct {
+	drippers map[string]*Server
+
+	state          *prometheus.Desc
+	dripsPerMinute *prometheus.Desc
+	measured       *prometheus.Desc
+	drips          *prometheus.Desc
+	runSeconds     *prometheus.Desc
+	dispensed      *prometheus.Desc
+}
+
+// newDripperCollector creates a collector for the supplied drippers.
+func newDripperCollector(drippers map[string]*Server) *dripperCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "dripper", name),
+			help,
+			append([]string{"dripper"}, labels...),
+			nil,
+		)
+	}
+
+	return &dripperCollector{
+		drippers:       drippers,
+		state:          desc("state", "Whether the dripper is in the state, one of run, drip or off.", "state"),
+		dripsPerMinute: desc("drips_per_minute", "Drip rate the dripper has been asked for."),
+		measured:       desc("measured_drips_per_minute", "Drip rate measured over the most recent drips."),
+		drips:          desc("drips_total", "Number of drip pulses since the server started."),
+		runSeconds:     desc("run_seconds_total", "Time spent in the run state since the server started."),
+		dispensed:      desc("dispensed_millilitres_total", "Estimated volume dispensed since the server started."),
+	}
+}
+
+// Describe sends the descriptions of the dripper metrics.
+func (d *dripperCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.state
+	ch <- d.dripsPerMinute
+	ch <- d.measured
+	ch <- d.drips
+	ch <- d.runSeconds
+	ch <- d.dispensed
+}
+
+// Collect sends the current metrics of every dripper which is running.
+func (d *dripperCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, s := range d.drippers {
+		dr := s.Dripper
+		if dr == nil {
+			continue
+		}
+
+		current := dr.GetState()
+		for _, state := range []string{dripper.RUN, dripper.DRIP, dripper.OFF} {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(d.state, prometheus.GaugeValue, value, name, state)
+		}
+
+		ch <- prometheus.MustNewConstMetric(d.dripsPerMinute, prometheus.GaugeValue, dr.GetDripsPerMinute(), name)
+		ch <- prometheus.MustNewConstMetric(d.measured, prometheus.GaugeValue, dr.GetMeasuredDripsPerMinute(), name)
+		ch <- prometheus.MustNewConstMetric(d.drips, prometheus.CounterValue, float64(dr.GetDrips()), name)
+		ch <- prometheus.MustNewConstMetric(d.runSeconds, prometheus.CounterValue, dr.GetRunTime().Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(d.dispensed, prometheus.CounterValue, dr.GetDispensedVolume(), name)
+	}
+}
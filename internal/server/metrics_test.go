@@ -0,0 +1,118 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingMotor is a motor controller which fails every command.
+type failingMotor struct{}
+
+func (failingMotor) Start() error                   { return nil }
+func (failingMotor) RunMotor(motor.Direction) error { return errors.New("motor failed") }
+func (failingMotor) SetMotorSpeed(int32) error      { return errors.New("motor failed") }
+
+func TestGetMetricsReportsDrippers(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+	s.metrics = newMetricsRegistry(s.drippers)
+
+	on := testutil.ToFloat64(motorCommands.WithLabelValues("right", "on"))
+	err = s.drippers["right"].Dripper.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	if testutil.ToFloat64(motorCommands.WithLabelValues("right", "on")) != on+1 {
+		t.Error("motor command was not counted")
+	}
+
+	r := withTestRouter()
+	r.GET("/metrics", s.GetMetrics)
+
+	w := withTestRequest(r, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not get metrics:", w.Code)
+	}
+
+	expected := []string{
+		`cold_brew_dripper_state{dripper="right",state="run"} 1`,
+		`cold_brew_dripper_state{dripper="left",state="off"} 1`,
+		`cold_brew_dripper_drips_per_minute{dripper="left"} 0`,
+		`cold_brew_dripper_run_seconds_total{dripper="right"}`,
+		`cold_brew_dripper_dispensed_millilitres_total{dripper="right"}`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Error("metrics did not include", line)
+		}
+	}
+}
+
+func TestCountingMotorCountsErrors(t *testing.T) {
+	m := countingMotor{failingMotor{}, "failing", nil}
+	errs := testutil.ToFloat64(motorErrors.WithLabelValues("failing", "off"))
+
+	err := m.RunMotor(motor.Release)
+	if err == nil {
+		t.Fatal("motor error was not returned")
+	}
+
+	if testutil.ToFloat64(motorErrors.WithLabelValues("failing", "off")) != errs+1 {
+		t.Error("motor error was not counted")
+	}
+}
+
+func TestRequestMetricsLabelsRoutes(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+	s.metrics = newMetricsRegistry(s.drippers)
+
+	r := withTestRouter()
+	r.Use(RequestMetrics(r))
+	r.POST("/drippers/:name/off", s.ForDripper((*Server).SetDripperOff))
+	r.GET("/metrics", s.GetMetrics)
+
+	withTestRequest(r, http.MethodPost, "/drippers/left/off", "")
+	withTestRequest(r, http.MethodGet, "/favicon.ico", "")
+
+	w := withTestRequest(r, http.MethodGet, "/metrics", "")
+	expected := []string{
+		`cold_brew_http_request_duration_seconds_count{method="POST",route="/drippers/:name/off",status="200"}`,
+		`cold_brew_http_request_duration_seconds_count{method="GET",route="other",status="404"}`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Error("metrics did not include", line)
+		}
+	}
+
+	if strings.Contains(w.Body.String(), "favicon") {
+		t.Error("unmatched path was used as a route")
+	}
+}
+
+func TestDripperMetricsSkipMissingDripper(t *testing.T) {
+	drippers := map[string]*Server{"broken": {Name: "broken"}}
+	c := newDripperCollector(drippers)
+
+	if testutil.CollectAndCompare(c, strings.NewReader("")) != nil {
+		t.Error("dripper which could not be created reported metrics")
+	}
+}
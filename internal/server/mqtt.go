@@ -0,0 +1,348 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mqttRequester is recorded as having started the brew sessions begun by
+	// MQTT commands.
+	mqttRequester = "mqtt"
+
+	// mqttOnline and mqttOffline are published to the status topic when the
+	// server connects to and disconnects from the broker.
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+
+	// mqttQoS is the quality of service every message is sent with.
+	mqttQoS = 1
+
+	// mqttRetryInterval is how long the server waits before trying to
+	// connect to the broker again.
+	mqttRetryInterval = 10 * time.Second
+
+	// mqttTimeout is how long the server waits for the broker to acknowledge
+	// a message.
+	mqttTimeout = 10 * time.Second
+
+	// mqttQuiesce is how long the server gives the broker to finish sending
+	// messages when it disconnects, in milliseconds.
+	mqttQuiesce = 250
+
+	// mqttVolumeInterval is how often the dispensed volume is published while
+	// the dripper is on, rather than after every drip.
+	mqttVolumeInterval = 10 * time.Second
+)
+
+// mqttClient publishes and subscribes to MQTT topics. It lets the bridge be
+// tested without a broker.
+type mqttClient interface {
+	// Connect connects to the broker, retrying until it succeeds.
+	Connect()
+
+	// Publish sends the payload to the topic without waiting for the broker.
+	Publish(topic string, payload string, retained bool)
+
+	// Subscribe calls the handler with every message sent to the topic.
+	Subscribe(topic string, handler func(topic string, payload []byte))
+
+	// Disconnect closes the connection to the broker.
+	Disconnect()
+}
+
+// mqttBridge publishes the state of every dripper to retained MQTT topics and
+// runs the commands sent to its command topics. For a dripper named left under
+// the default topic, the topics are:
+//
+//	cold-brew/status                      online or offline
+//	cold-brew/left/state                  run, drip or off
+//	cold-brew/left/dripsPerMinute         the requested drip rate
+//	cold-brew/left/dispensedVolume        the estimated millilitres dispensed
+//	cold-brew/left/command/run            runs the dripper
+//	cold-brew/left/command/drip           drips at the rate in the payload
+//	cold-brew/left/command/off            turns the dripper off
+type mqttBridge struct {
+	client   mqttClient
+	config   MQTTConfig
+	drippers map[string]*Server
+
+	// volumePublished is when the dispensed volume of each dripper was last
+	// published.
+	volumePublished map[string]time.Time
+
+	// volumeMutex is used to access when the volume was published across
+	// multiple goroutines.
+	volumeMutex sync.Mutex
+}
+
+// newMQTTBridge creates a bridge between the drippers and the broker in the
+// configuration. It does not connect until it is started.
+func newMQTTBridge(config MQTTConfig, drippers map[string]*Server) *mqttBridge {
+	b := &mqttBridge{
+		config:          config,
+		drippers:        drippers,
+		volumePublished: make(map[string]time.Time),
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetWill(b.statusTopic(), mqttOffline, mqttQoS, true).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(mqtt.Client) { b.connected() }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("lost connection to mqtt broker")
+		})
+
+	b.client = pahoClient{client: mqtt.NewClient(options), broker: config.Broker}
+	return b
+}
+
+// start connects to the broker in the background, so the drippers can be
+// used while the broker is down.
+func (b *mqttBridge) start() {
+	go b.client.Connect()
+	go b.publishVolumesPeriodically()
+}
+
+// publishVolumesPeriodically keeps the dispensed volume fresh while the
+// drippers are on, since no drip events are sent in the run state. It never
+// returns.
+func (b *mqttBridge) publishVolumesPeriodically() {
+	ticker := time.NewTicker(mqttVolumeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.publishVolumes()
+	}
+}
+
+// publishVolumes publishes the dispensed volume of every dripper which is on
+// and has not had it published for a while.
+func (b *mqttBridge) publishVolumes() {
+	for _, s := range b.drippers {
+		if s.Dripper != nil && s.Dripper.GetState() != dripper.OFF && b.volumeDue(s.Name) {
+			b.publishVolume(s.Name, s.Dripper.GetDispensedVolume())
+		}
+	}
+}
+
+// connected announces the server, publishes the state of every dripper and
+// subscribes to the command topics each time the server connects to the
+// broker.
+func (b *mqttBridge) connected() {
+	logrus.Info("connected to mqtt broker")
+	b.client.Publish(b.statusTopic(), mqttOnline, true)
+
+	for _, s := range b.drippers {
+		if s.Dripper == nil {
+			continue
+		}
+
+		if b.config.Discovery {
+			b.publishDiscovery(s)
+		}
+
+		b.publishState(s.Name, s.Dripper.GetState(), s.Dripper.GetDripsPerMinute(), s.Dripper.GetDispensedVolume())
+	}
+
+	b.client.Subscribe(b.config.Topic+"/+/command/+", b.handleCommand)
+}
+
+// close announces the server is going offline and disconnects from the
+// broker.
+func (b *mqttBridge) close() {
+	b.client.Publish(b.statusTopic(), mqttOffline, true)
+	b.client.Disconnect()
+}
+
+// publishState publishes the state, drip rate and dispensed volume of the
+// named dripper.
+func (b *mqttBridge) publishState(name string, state string, dripsPerMin float64, dispensed float64) {
+	b.client.Publish(b.dripperTopic(name, "state"), state, true)
+	b.client.Publish(b.dripperTopic(name, "dripsPerMinute"), formatFloat(dripsPerMin), true)
+	b.publishVolume(name, dispensed)
+}
+
+// publishVolume publishes the dispensed volume of the named dripper.
+func (b *mqttBridge) publishVolume(name string, dispensed float64) {
+	b.volumeMutex.Lock()
+	b.volumePublished[name] = time.Now()
+	b.volumeMutex.Unlock()
+
+	b.client.Publish(b.dripperTopic(name, "dispensedVolume"), formatFloat(dispensed), true)
+}
+
+// volumeDue reports whether the dispensed volume of the named dripper has not
+// been published for a while.
+func (b *mqttBridge) volumeDue(name string) bool {
+	b.volumeMutex.Lock()
+	defer b.volumeMutex.Unlock()
+
+	return time.Since(b.volumePublished[name]) >= mqttVolumeInterval
+}
+
+// handleCommand runs a command sent to the command topic of a dripper.
+func (b *mqttBridge) handleCommand(topic string, payload []byte) {
+	fields := logrus.Fields{
+		"topic":   topic,
+		"payload": string(payload),
+	}
+
+	parts := strings.Split(strings.TrimPrefix(topic, b.config.Topic+"/"), "/")
+	if len(parts) != 3 || parts[1] != "command" {
+		logrus.WithFields(fields).Warn("ignoring message sent to unknown mqtt topic")
+		return
+	}
+
+	s, ok := b.drippers[parts[0]]
+	if !ok || s.Dripper == nil {
+		logrus.WithFields(fields).Warn("ignoring mqtt command for unknown dripper")
+		return
+	}
+
+	err := s.runCommand(parts[2], strings.TrimSpace(string(payload)))
+	if err != nil {
+		fields["error"] = err
+		logrus.WithFields(fields).Error("could not run mqtt command")
+		return
+	}
+
+	logrus.WithFields(fields).Info("ran mqtt command")
+}
+
+// statusTopic returns the topic the server announces itself on.
+func (b *mqttBridge) statusTopic() string {
+	return b.config.Topic + "/status"
+}
+
+// dripperTopic returns the named topic of a dripper.
+func (b *mqttBridge) dripperTopic(name string, topic string) string {
+	return b.config.Topic + "/" + name + "/" + topic
+}
+
+// formatFloat formats a number as the payload of a message.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// runCommand runs a command received over MQTT the same way the equivalent
+// route would.
+func (s *Server) runCommand(command string, payload string) error {
+	var err error
+	switch command {
+	case "run":
+		err = s.runDripper()
+	case "drip":
+		var dripsPerMin float64
+		dripsPerMin, err = strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return errInvalidRate
+		}
+		err = s.dripDripper(dripsPerMin)
+	case "off":
+		return s.offDripper()
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+
+	if err == nil {
+		s.beginSession(mqttRequester, nil)
+	}
+
+	return err
+}
+
+// publishMQTTEvent is a dripper listener which publishes changes to the state
+// and drip rate of the dripper to the broker, along with the dispensed volume
+// every so often while it drips.
+func (s *Server) publishMQTTEvent(e dripper.Event) {
+	if s.mqtt == nil {
+		return
+	}
+
+	switch {
+	case e.Type == dripper.EventState || e.Type == dripper.EventRate:
+		s.mqtt.publishState(s.Name, e.State, e.DripsPerMinute, e.DispensedVolume)
+	case e.Type == dripper.EventDrip && s.mqtt.volumeDue(s.Name):
+		s.mqtt.publishVolume(s.Name, e.DispensedVolume)
+	}
+}
+
+// pahoClient adapts a Paho MQTT client to the bridge.
+type pahoClient struct {
+	client mqtt.Client
+	broker string
+}
+
+// Connect connects to the broker, retrying until it succeeds. Once connected
+// the client reconnects by itself.
+func (p pahoClient) Connect() {
+	for {
+		token := p.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"broker": p.broker,
+			"error":  token.Error(),
+		}).Error("could not connect to mqtt broker")
+		time.Sleep(mqttRetryInterval)
+	}
+}
+
+// Publish sends the payload to the topic and logs any error once the broker
+// has answered.
+func (p pahoClient) Publish(topic string, payload string, retained bool) {
+	token := p.client.Publish(topic, mqttQoS, retained, payload)
+	go logTokenError(token, topic, "could not publish to mqtt topic")
+}
+
+// Subscribe calls the handler with every message sent to the topic.
+func (p pahoClient) Subscribe(topic string, handler func(topic string, payload []byte)) {
+	token := p.client.Subscribe(topic, mqttQoS, func(_ mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	})
+	go logTokenError(token, topic, "could not subscribe to mqtt topic")
+}
+
+// Disconnect closes the connection to the broker once the messages being
+// sent have been delivered.
+func (p pahoClient) Disconnect() {
+	p.client.Disconnect(mqttQuiesce)
+}
+
+// logTokenError waits for the broker to answer and logs the error it returned,
+// if any.
+func logTokenError(token mqtt.Token, topic string, message string) {
+	if !token.WaitTimeout(mqttTimeout) {
+		logrus.WithFields(logrus.Fields{
+			"topic": topic,
+		}).Warn(message + ": timed out")
+		return
+	}
+
+	if token.Error() != nil {
+		logrus.WithFields(logrus.Fields{
+			"topic": topic,
+			"error": token.Error(),
+		}).Warn(message)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+// fakeMQTTClient records the messages published by the bridge instead of
+// sending them to a broker.
+type fakeMQTTClient struct {
+	retained     map[string]string
+	subscription string
+	handler      func(topic string, payload []byte)
+	disconnected bool
+	mutex        sync.Mutex
+}
+
+func (f *fakeMQTTClient) Connect() {}
+
+func (f *fakeMQTTClient) Publish(topic string, payload string, retained bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if retained {
+		f.retained[topic] = payload
+	}
+}
+
+func (f *fakeMQTTClient) Subscribe(topic string, handler func(topic string, payload []byte)) {
+	f.subscription = topic
+	f.handler = handler
+}
+
+func (f *fakeMQTTClient) Disconnect() {
+	f.disconnected = true
+}
+
+// message returns the retained message on a topic.
+func (f *fakeMQTTClient) message(topic string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.retained[topic]
+}
+
+// withTestMQTT connects every test dripper to a fake broker.
+func withTestMQTT(s *Server, discovery bool) *fakeMQTTClient {
+	client := &fakeMQTTClient{retained: make(map[string]string)}
+	bridge := &mqttBridge{
+		client: client,
+		config: MQTTConfig{
+			ClientID:        DefaultMQTTClientID,
+			Topic:           DefaultMQTTTopic,
+			Discovery:       discovery,
+			DiscoveryPrefix: DefaultDiscoveryPrefix,
+		},
+		drippers:        s.drippers,
+		volumePublished: make(map[string]time.Time),
+	}
+	for _, d := range s.drippers {
+		d.mqtt = bridge
+	}
+
+	bridge.connected()
+	return client
+}
+
+func TestMQTTPublishesStateOnConnect(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	client := withTestMQTT(s, false)
+
+	if client.message("cold-brew/status") != mqttOnline {
+		t.Error("server did not announce it is online")
+	}
+
+	if client.message("cold-brew/left/state") != dripper.OFF || client.message("cold-brew/right/dripsPerMinute") != "0" {
+		t.Error("state of the drippers was not published")
+	}
+
+	if client.subscription != "cold-brew/+/command/+" {
+		t.Error("server did not subscribe to the command topics:", client.subscription)
+	}
+
+	s.Off()
+	if client.message("cold-brew/status") != mqttOffline || !client.disconnected {
+		t.Error("server did not announce it is offline")
+	}
+}
+
+func TestMQTTCommandsControlDripper(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	client := withTestMQTT(s, false)
+	right := s.drippers["right"].Dripper
+
+	client.handler("cold-brew/right/command/drip", []byte("40"))
+	if right.GetState() != dripper.DRIP || right.GetDripsPerMinute() != 40 {
+		t.Fatal("drip command did not start dripping")
+	}
+
+	if client.message("cold-brew/right/state") != dripper.DRIP || client.message("cold-brew/right/dripsPerMinute") != "40" {
+		t.Error("new state was not published")
+	}
+
+	if s.Dripper.GetState() != dripper.OFF {
+		t.Error("command controlled the wrong dripper")
+	}
+
+	client.handler("cold-brew/right/command/drip", []byte("fast"))
+	client.handler("cold-brew/right/command/drip", []byte("1000"))
+	if right.GetDripsPerMinute() != 40 {
+		t.Error("invalid drip rate was used")
+	}
+
+	client.handler("cold-brew/right/command/run", nil)
+	if right.GetState() != dripper.RUN {
+		t.Error("run command did not run the dripper")
+	}
+
+	client.handler("cold-brew/right/command/off", nil)
+	if right.GetState() != dripper.OFF || client.message("cold-brew/right/state") != dripper.OFF {
+		t.Error("off command did not turn the dripper off")
+	}
+
+	client.handler("cold-brew/foo/command/run", nil)
+	client.handler("cold-brew/right/command/foo", nil)
+	if right.GetState() != dripper.OFF {
+		t.Error("unknown command changed the dripper")
+	}
+}
+
+func TestMQTTPublishesDispensedVolume(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	client := withTestMQTT(s, false)
+	if client.message("cold-brew/left/dispensedVolume") != "0" {
+		t.Error("dispensed volume was not published on connect")
+	}
+
+	s.publishMQTTEvent(dripper.Event{Type: dripper.EventDrip, DispensedVolume: 12.5})
+	if client.message("cold-brew/left/dispensedVolume") != "0" {
+		t.Error("dispensed volume was published straight after the last time")
+	}
+
+	s.mqtt.volumePublished["left"] = time.Now().Add(-mqttVolumeInterval)
+	s.publishMQTTEvent(dripper.Event{Type: dripper.EventDrip, DispensedVolume: 12.5})
+	if client.message("cold-brew/left/dispensedVolume") != "12.5" {
+		t.Error("dispensed volume was not published while dripping")
+	}
+}
+
+func TestMQTTPublishesDispensedVolumeWhileRunning(t *testing.T) {
+	s, dir, err := withTestDrippers()
+	if err != nil {
+		t.Fatal("could not create test drippers:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+	defer s.Off()
+
+	client := withTestMQTT(s, false)
+	s.mqtt.volumePublished["left"] = time.Now().Add(-mqttVolumeInterval)
+	s.mqtt.publishVolumes()
+	if client.message("cold-brew/left/dispensedVolume") != "0" || !s.mqtt.volumeDue("left") {
+		t.Error("dispensed volume was published while the dripper was off")
+	}
+
+	err = s.Dripper.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	s.mqtt.volumePublished["left"] = time.Now().Add(-mqttVolumeInterval)
+	s.mqtt.publishVolumes()
+	if s.mqtt.volumeDue("left") {
+		t.Error("dispensed volume was not published while running")
+	}
+}
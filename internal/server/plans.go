@@ -0,0 +1,158 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-gonic/gin"
+)
+
+// planStartWindow is how soon a plan has to start for it to be started right
+// away instead of being scheduled.
+const planStartWindow = time.Minute
+
+// PreviewPlan works out the drip rate and start time of a brew which is ready
+// by a finish time without starting it.
+func (s *Server) PreviewPlan(c *gin.Context) {
+	var json api.PlanEndpoint
+	err := c.BindJSON(&json)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	plan, err := s.planBrew(json, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.planStatus(plan))
+}
+
+// StartPlan works out the drip rate and start time of a brew which is ready by
+// a finish time. The dripper starts dripping right away if the plan starts
+// now, otherwise a one-off schedule is created to start it later.
+func (s *Server) StartPlan(c *gin.Context) {
+	var json api.PlanEndpoint
+	err := c.BindJSON(&json)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	now := time.Now()
+	plan, err := s.planBrew(json, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if plan.StartAt.Sub(now) <= planStartWindow {
+		err = s.dripDripperUntil(plan.DripsPerMinute, plan.Volume)
+		if err != nil {
+			s.respondToDripperCommand(c, err)
+			return
+		}
+
+		s.beginSession(requester(c), nil)
+		c.JSON(http.StatusOK, s.planStatus(plan))
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "an ID could not be generated for the schedule"})
+		return
+	}
+
+	schedule := brew.Schedule{
+		ID:             id,
+		Name:           "ready by " + plan.FinishAt.Format(time.RFC3339),
+		At:             &plan.StartAt,
+		DripsPerMinute: plan.DripsPerMinute,
+		TargetVolume:   plan.Volume,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	err = s.validateSchedule(schedule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.scheduleMutex.Lock()
+	err = s.writeScheduleToDB(schedule)
+	s.scheduleMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be written to the database"})
+		return
+	}
+
+	s.wakeScheduler()
+
+	status := s.planStatus(plan)
+	status.ScheduleID = schedule.ID
+	c.JSON(http.StatusCreated, status)
+}
+
+// planBrew works out a plan for the request with the current settings and
+// calibration of the dripper. A plan with a drip rate starts as late as it
+// can, otherwise the drip rate is spread between the start time and the
+// finish time.
+func (s *Server) planBrew(json api.PlanEndpoint, now time.Time) (dripper.Plan, error) {
+	if json.DripsPerMinute < 0 {
+		return dripper.Plan{}, errInvalidRate
+	}
+
+	if json.DripsPerMinute > 0 && json.StartAt != nil {
+		return dripper.Plan{}, errors.New("only one of startAt or dripsPerMinute can be set")
+	}
+
+	settings := s.Dripper.GetSettings()
+	calibration := s.Dripper.GetCalibration()
+
+	if json.DripsPerMinute > 0 {
+		plan, err := calibration.PlanAtRate(settings, json.TargetVolume, json.DripsPerMinute, json.FinishAt)
+		if err != nil {
+			return plan, err
+		}
+
+		if plan.StartAt.Before(now) {
+			return plan, errors.New("the volume can not be dispensed by finishAt at this drip rate")
+		}
+
+		return plan, nil
+	}
+
+	startAt := now
+	if json.StartAt != nil {
+		if json.StartAt.Before(now) {
+			return dripper.Plan{}, errors.New("startAt must not be in the past")
+		}
+
+		startAt = *json.StartAt
+	}
+
+	return calibration.PlanBetween(settings, json.TargetVolume, startAt, json.FinishAt)
+}
+
+// planStatus converts a plan to its API representation.
+func (s *Server) planStatus(plan dripper.Plan) api.Plan {
+	return api.Plan{
+		StartAt:            plan.StartAt,
+		FinishAt:           plan.FinishAt,
+		DripsPerMinute:     plan.DripsPerMinute,
+		MillilitresPerHour: s.Dripper.GetCalibration().MillilitresPerHour(plan.DripsPerMinute, s.Dripper.GetSettings()),
+		Drips:              plan.Drips,
+		TargetVolume:       plan.Volume,
+	}
+}
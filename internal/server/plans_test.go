@@ -0,0 +1,181 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+func TestPreviewPlan(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestPlanDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/plan", s.PreviewPlan)
+
+	w := withTestRequest(r, http.MethodPost, "/plan", withTestPlanBody(1200, 10*time.Hour, ""))
+	if w.Code != http.StatusOK {
+		t.Fatal("could not preview plan:", w.Body.String())
+	}
+
+	var plan api.Plan
+	err = json.Unmarshal(w.Body.Bytes(), &plan)
+	if err != nil {
+		t.Fatal("could not decode plan:", err)
+	}
+
+	if plan.Drips != 2400 || plan.DripsPerMinute < 3.99 || plan.DripsPerMinute > 4.01 {
+		t.Errorf("expected 2400 drips at 4 drips per minute, got %v at %v", plan.Drips, plan.DripsPerMinute)
+	}
+
+	if s.Dripper.GetState() != dripper.OFF {
+		t.Error("previewing a plan changed the state of the dripper")
+	}
+}
+
+func TestPreviewPlanWhenPlanIsInvalid(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestPlanDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/plan", s.PreviewPlan)
+
+	bodies := []string{
+		withTestPlanBody(1200, time.Minute, ""),
+		withTestPlanBody(1200, time.Hour, `, "dripsPerMinute": 10`),
+		withTestPlanBody(1200, time.Hour, fmt.Sprintf(`, "startAt": %q`, time.Now().Add(-time.Hour).Format(time.RFC3339))),
+		`{"targetVolume": 1200}`,
+	}
+
+	for _, body := range bodies {
+		w := withTestRequest(r, http.MethodPost, "/plan", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("invalid plan %s returned %d", body, w.Code)
+		}
+	}
+
+	s.Dripper.SetCalibration(dripper.Calibration{})
+	w := withTestRequest(r, http.MethodPost, "/plan", withTestPlanBody(1200, 10*time.Hour, ""))
+	if w.Code != http.StatusBadRequest {
+		t.Error("plan without a calibration returned", w.Code)
+	}
+}
+
+func TestStartPlanWhenPlanStartsNow(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestPlanDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/plan/start", s.StartPlan)
+
+	w := withTestRequest(r, http.MethodPost, "/plan/start", withTestPlanBody(1200, 10*time.Hour, ""))
+	defer s.offDripper()
+	if w.Code != http.StatusOK {
+		t.Fatal("could not start plan:", w.Body.String())
+	}
+
+	if s.Dripper.GetState() != dripper.DRIP || s.Dripper.GetTargetVolume() != 1200 {
+		t.Error("plan did not start dripping towards its volume")
+	}
+
+	if s.session == nil {
+		t.Error("plan did not begin a brew session")
+	}
+}
+
+func TestStartPlanWhenPlanStartsLater(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestPlanDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/plan/start", s.StartPlan)
+
+	w := withTestRequest(r, http.MethodPost, "/plan/start", withTestPlanBody(1200, 10*time.Hour, `, "dripsPerMinute": 10`))
+	if w.Code != http.StatusCreated {
+		t.Fatal("could not start plan:", w.Body.String())
+	}
+
+	if s.Dripper.GetState() != dripper.OFF {
+		t.Error("plan which starts later started dripping")
+	}
+
+	var plan api.Plan
+	err = json.Unmarshal(w.Body.Bytes(), &plan)
+	if err != nil {
+		t.Fatal("could not decode plan:", err)
+	}
+
+	schedule, err := s.readScheduleFromDB(plan.ScheduleID)
+	if err != nil {
+		t.Fatal("could not read schedule from db:", err)
+	}
+
+	if schedule.At == nil || !schedule.At.Equal(plan.StartAt) || schedule.DripsPerMinute != 10 || schedule.TargetVolume != 1200 {
+		t.Error("schedule does not match the plan:", schedule)
+	}
+}
+
+// withTestPlanDripper attaches a dripper calibrated to dispense half a
+// millilitre per drip to the server.
+func withTestPlanDripper(s *Server) error {
+	err := withTestDripper(s)
+	if err != nil {
+		return err
+	}
+
+	s.Dripper.SetCalibration(dripper.Calibration{
+		MillilitresPerDrip: 0.5,
+		DripSpeed:          dripper.DefaultDripSpeed,
+		DripDuration:       dripper.DefaultDripDuration,
+		RunSpeed:           dripper.DefaultRunSpeed,
+	})
+
+	return nil
+}
+
+// withTestPlanBody returns a plan request for the supplied volume which
+// finishes after the supplied duration.
+func withTestPlanBody(volume float64, finishIn time.Duration, extra string) string {
+	finishAt := time.Now().Add(finishIn).Format(time.RFC3339Nano)
+	return fmt.Sprintf(`{"targetVolume": %v, "finishAt": %q%s}`, volume, finishAt, extra)
+}
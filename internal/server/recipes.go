@@ -0,0 +1,235 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	recipesCollection = "recipes"
+)
+
+var (
+	// errRecipeNotFound is returned when a recipe does not exist in the
+	// database.
+	errRecipeNotFound = errors.New("the recipe could not be found")
+
+	// errUnknownSettingsProfile is returned when a recipe references a
+	// settings profile which does not exist.
+	errUnknownSettingsProfile = errors.New("settingsProfileId does not name a settings profile")
+)
+
+// GetRecipes returns every recipe stored in the database.
+func (s *Server) GetRecipes(c *gin.Context) {
+	recipes, err := s.readRecipesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipes could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, recipes)
+}
+
+// GetRecipe returns a single recipe.
+func (s *Server) GetRecipe(c *gin.Context) {
+	recipe, err := s.readRecipeFromDB(c.Param("id"))
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, recipe)
+}
+
+// CreateRecipe saves a new recipe.
+func (s *Server) CreateRecipe(c *gin.Context) {
+	var recipe brew.Recipe
+	err := c.BindJSON(&recipe)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = recipe.Validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = s.checkSettingsProfile(recipe)
+	if err == errUnknownSettingsProfile {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be read from the database"})
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "an ID could not be generated for the recipe"})
+		return
+	}
+
+	now := time.Now()
+	recipe.ID = id
+	recipe.CreatedAt = now
+	recipe.UpdatedAt = now
+
+	err = s.writeRecipeToDB(recipe)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be written to the database"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, recipe)
+}
+
+// UpdateRecipe replaces an existing recipe.
+func (s *Server) UpdateRecipe(c *gin.Context) {
+	existing, err := s.readRecipeFromDB(c.Param("id"))
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be read from the database"})
+		return
+	}
+
+	var recipe brew.Recipe
+	err = c.BindJSON(&recipe)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = recipe.Validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = s.checkSettingsProfile(recipe)
+	if err == errUnknownSettingsProfile {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be read from the database"})
+		return
+	}
+
+	recipe.ID = existing.ID
+	recipe.CreatedAt = existing.CreatedAt
+	recipe.UpdatedAt = time.Now()
+
+	err = s.writeRecipeToDB(recipe)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be written to the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, recipe)
+}
+
+// DeleteRecipe removes a recipe from the database.
+func (s *Server) DeleteRecipe(c *gin.Context) {
+	_, err := s.readRecipeFromDB(c.Param("id"))
+	if err == errRecipeNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be read from the database"})
+		return
+	}
+
+	err = s.DB.Delete(recipesCollection, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipe could not be deleted from the database"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// checkSettingsProfile ensures the settings profile a recipe references, if
+// any, exists.
+func (s *Server) checkSettingsProfile(recipe brew.Recipe) error {
+	if recipe.SettingsProfileID == "" {
+		return nil
+	}
+
+	_, err := s.readSettingsProfileFromDB(recipe.SettingsProfileID)
+	if err == errSettingsProfileNotFound {
+		return errUnknownSettingsProfile
+	}
+
+	return err
+}
+
+// readRecipeFromDB reads a single recipe from the database.
+func (s *Server) readRecipeFromDB(id string) (brew.Recipe, error) {
+	recipe := brew.Recipe{}
+	if !isValidID(id) {
+		return recipe, errRecipeNotFound
+	}
+
+	err := s.DB.Read(recipesCollection, id, &recipe)
+	if isNotFound(err) {
+		return recipe, errRecipeNotFound
+	}
+	if err != nil {
+		return recipe, err
+	}
+
+	return recipe, nil
+}
+
+// readRecipesFromDB reads every recipe from the database sorted by name.
+func (s *Server) readRecipesFromDB() ([]brew.Recipe, error) {
+	recipes := []brew.Recipe{}
+	records, err := s.DB.ReadAll(recipesCollection)
+	if isNotFound(err) {
+		return recipes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		recipe := brew.Recipe{}
+		err = json.Unmarshal([]byte(record), &recipe)
+		if err != nil {
+			return nil, err
+		}
+
+		recipes = append(recipes, recipe)
+	}
+
+	sort.Slice(recipes, func(i, j int) bool {
+		return recipes[i].Name < recipes[j].Name
+	})
+
+	return recipes, nil
+}
+
+// writeRecipeToDB writes the supplied recipe to the database.
+func (s *Server) writeRecipeToDB(recipe brew.Recipe) error {
+	return s.DB.Write(recipesCollection, recipe.ID, recipe)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/betterengineering/cold-brew/pkg/brew"
+)
+
+func TestWriteRecipeToDB(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	recipe := withTestRecipe(t)
+	err = s.writeRecipeToDB(recipe)
+	if err != nil {
+		t.Fatal("could not write recipe to db:", err)
+	}
+
+	readRecipe, err := s.readRecipeFromDB(recipe.ID)
+	if err != nil {
+		t.Fatal("could not read recipe from db:", err)
+	}
+
+	if !reflect.DeepEqual(recipe.Steps, readRecipe.Steps) || recipe.Name != readRecipe.Name {
+		t.Error("recipe that was read does not match what was written")
+	}
+}
+
+func TestReadRecipeFromDBWhenRecipeDoesNotExist(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	_, err = s.readRecipeFromDB(id)
+	if err != errRecipeNotFound {
+		t.Error("missing recipe did not return not found")
+	}
+
+	_, err = s.readRecipeFromDB("..")
+	if err != errRecipeNotFound {
+		t.Error("invalid recipe id did not return not found")
+	}
+}
+
+func TestReadRecipesFromDBWhenCollectionDoesNotExist(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	recipes, err := s.readRecipesFromDB()
+	if err != nil {
+		t.Fatal("could not read recipes from db:", err)
+	}
+
+	if len(recipes) != 0 {
+		t.Error("recipes were returned from an empty database")
+	}
+}
+
+func withTestRecipe(t *testing.T) brew.Recipe {
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	return brew.Recipe{
+		ID:   id,
+		Name: "kyoto",
+		Steps: []brew.Step{
+			{Action: brew.ActionRun, Seconds: 20},
+			{Action: brew.ActionDrip, DripsPerMinute: 40, Seconds: 10800},
+			{Action: brew.ActionOff},
+		},
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	schedulesCollection = "schedules"
+
+	// scheduleGrace is how late a run may start, for example after the server
+	// restarts, before it is skipped.
+	scheduleGrace = 10 * time.Minute
+
+	// scheduleMaxSleep bounds how long the scheduler sleeps so that changes to
+	// the system clock are noticed.
+	scheduleMaxSleep = time.Minute
+
+	// defaultSchedulePreview and maxSchedulePreview bound the number of runs
+	// returned by the preview endpoint.
+	defaultSchedulePreview = 5
+	maxSchedulePreview     = 100
+)
+
+// errScheduleNotFound is returned when a schedule does not exist in the
+// database.
+var errScheduleNotFound = errors.New("the schedule could not be found")
+
+// GetSchedules returns every schedule stored in the database.
+func (s *Server) GetSchedules(c *gin.Context) {
+	schedules, err := s.readSchedulesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedules could not be read from the database"})
+		return
+	}
+
+	now := time.Now()
+	for i := range schedules {
+		schedules[i] = withNextRun(schedules[i], now)
+	}
+
+	c.JSON(http.StatusOK, schedules)
+}
+
+// GetSchedule returns a single schedule.
+func (s *Server) GetSchedule(c *gin.Context) {
+	schedule, err := s.readScheduleFromDB(c.Param("id"))
+	if err == errScheduleNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, withNextRun(schedule, time.Now()))
+}
+
+// GetScheduleRuns previews the upcoming runs of a schedule. The number of runs
+// is set with the count query parameter.
+func (s *Server) GetScheduleRuns(c *gin.Context) {
+	count := defaultSchedulePreview
+	if c.Query("count") != "" {
+		var err error
+		count, err = strconv.Atoi(c.Query("count"))
+		if err != nil || count <= 0 || count > maxSchedulePreview {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be greater than 0 and must not exceed %d", maxSchedulePreview)})
+			return
+		}
+	}
+
+	schedule, err := s.readScheduleFromDB(c.Param("id"))
+	if err == errScheduleNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule.Preview(time.Now(), count))
+}
+
+// CreateSchedule saves a new schedule.
+func (s *Server) CreateSchedule(c *gin.Context) {
+	var schedule brew.Schedule
+	err := c.BindJSON(&schedule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = s.validateSchedule(schedule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "an ID could not be generated for the schedule"})
+		return
+	}
+
+	now := time.Now()
+	schedule.ID = id
+	schedule.LastRunAt = nil
+	schedule.LastError = ""
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+
+	s.scheduleMutex.Lock()
+	err = s.writeScheduleToDB(schedule)
+	s.scheduleMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be written to the database"})
+		return
+	}
+
+	s.wakeScheduler()
+	c.JSON(http.StatusCreated, withNextRun(schedule, now))
+}
+
+// UpdateSchedule replaces an existing schedule. Changing when a one-off
+// schedule runs lets it run again.
+func (s *Server) UpdateSchedule(c *gin.Context) {
+	var schedule brew.Schedule
+	err := c.BindJSON(&schedule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = s.validateSchedule(schedule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	existing, err := s.readScheduleFromDB(c.Param("id"))
+	if err == errScheduleNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be read from the database"})
+		return
+	}
+
+	now := time.Now()
+	schedule.ID = existing.ID
+	schedule.CreatedAt = existing.CreatedAt
+	schedule.UpdatedAt = now
+	schedule.LastError = existing.LastError
+	schedule.LastRunAt = existing.LastRunAt
+	if schedule.At != nil {
+		schedule.LastRunAt = nil
+	}
+
+	err = s.writeScheduleToDB(schedule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be written to the database"})
+		return
+	}
+
+	s.wakeScheduler()
+	c.JSON(http.StatusOK, withNextRun(schedule, now))
+}
+
+// DeleteSchedule removes a schedule from the database.
+func (s *Server) DeleteSchedule(c *gin.Context) {
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	_, err := s.readScheduleFromDB(c.Param("id"))
+	if err == errScheduleNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be read from the database"})
+		return
+	}
+
+	err = s.DB.Delete(s.collection(schedulesCollection), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the schedule could not be deleted from the database"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// validateSchedule ensures a schedule submitted by a client can run.
+func (s *Server) validateSchedule(schedule brew.Schedule) error {
+	err := schedule.Validate()
+	if err != nil {
+		return err
+	}
+
+	if schedule.At != nil && !schedule.At.After(time.Now()) {
+		return errors.New("at must be in the future")
+	}
+
+	if schedule.RecipeID != "" {
+		_, err = s.readRecipeFromDB(schedule.RecipeID)
+		if err != nil {
+			return fmt.Errorf("recipe %q could not be read: %v", schedule.RecipeID, err)
+		}
+	}
+
+	return nil
+}
+
+// withNextRun fills in when the schedule runs next.
+func withNextRun(schedule brew.Schedule, now time.Time) brew.Schedule {
+	schedule.NextRunAt = nil
+	next, ok := schedule.Next(now)
+	if ok {
+		schedule.NextRunAt = &next
+	}
+
+	return schedule
+}
+
+// runSchedules runs schedules as they come due for as long as the server is
+// up. Runs missed by less than the grace period, for example while the server
+// was restarting, still happen. It never returns.
+func (s *Server) runSchedules() {
+	checked := time.Now().Add(-scheduleGrace)
+	for {
+		now := time.Now()
+		s.runDueSchedules(checked, now)
+		checked = now
+
+		sleep := scheduleMaxSleep
+		next, ok := s.nextScheduledRun(now)
+		if ok && next.Sub(now) < sleep {
+			sleep = next.Sub(now)
+		}
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-s.scheduleWake:
+			timer.Stop()
+		}
+	}
+}
+
+// wakeScheduler makes the scheduler look at the schedules again after they
+// have changed.
+func (s *Server) wakeScheduler() {
+	select {
+	case s.scheduleWake <- struct{}{}:
+	default:
+	}
+}
+
+// runDueSchedules runs every schedule due after from and no later than to.
+// Each schedule runs at most once, however many runs it missed.
+func (s *Server) runDueSchedules(from time.Time, to time.Time) {
+	schedules, err := s.readSchedulesFromDB()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not read schedules from the database")
+		return
+	}
+
+	for _, schedule := range schedules {
+		next, ok := schedule.Next(from)
+		if ok && !next.After(to) {
+			s.runSchedule(schedule.ID)
+		}
+	}
+}
+
+// nextScheduledRun returns the earliest time after now any schedule runs.
+func (s *Server) nextScheduledRun(now time.Time) (time.Time, bool) {
+	schedules, err := s.readSchedulesFromDB()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var earliest time.Time
+	for _, schedule := range schedules {
+		next, ok := schedule.Next(now)
+		if ok && (earliest.IsZero() || next.Before(earliest)) {
+			earliest = next
+		}
+	}
+
+	return earliest, !earliest.IsZero()
+}
+
+// runSchedule starts the recipe or drip rate of a schedule and records the
+// outcome of the run.
+func (s *Server) runSchedule(id string) {
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	// The schedule is read again in case it changed since it was found due.
+	schedule, err := s.readScheduleFromDB(id)
+	if err != nil {
+		return
+	}
+
+	startedBy := "schedule:" + schedule.Name
+	if schedule.RecipeID != "" {
+		var recipe brew.Recipe
+		recipe, err = s.readRecipeFromDB(schedule.RecipeID)
+		if err == nil {
+			err = s.startBrew(recipe, startedBy)
+		}
+	} else {
+		err = s.dripDripperUntil(schedule.DripsPerMinute, schedule.TargetVolume)
+		if err == nil {
+			s.beginSession(startedBy, nil)
+		}
+	}
+
+	now := time.Now()
+	schedule.LastRunAt = &now
+	schedule.LastError = ""
+	fields := logrus.Fields{
+		"schedule": schedule.Name,
+	}
+
+	if err != nil {
+		schedule.LastError = err.Error()
+		fields["error"] = err
+		logrus.WithFields(fields).Error("scheduled brew could not be started")
+	} else {
+		logrus.WithFields(fields).Info("scheduled brew started")
+	}
+
+	err = s.writeScheduleToDB(schedule)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"schedule": schedule.Name,
+			"error":    err,
+		}).Error("could not write schedule to the database")
+	}
+}
+
+// readScheduleFromDB reads a single schedule from the database.
+func (s *Server) readScheduleFromDB(id string) (brew.Schedule, error) {
+	schedule := brew.Schedule{}
+	if !isValidID(id) {
+		return schedule, errScheduleNotFound
+	}
+
+	err := s.DB.Read(s.collection(schedulesCollection), id, &schedule)
+	if isNotFound(err) {
+		return schedule, errScheduleNotFound
+	}
+	if err != nil {
+		return schedule, err
+	}
+
+	return schedule, nil
+}
+
+// readSchedulesFromDB reads every schedule from the database sorted by name.
+func (s *Server) readSchedulesFromDB() ([]brew.Schedule, error) {
+	schedules := []brew.Schedule{}
+	records, err := s.DB.ReadAll(s.collection(schedulesCollection))
+	if isNotFound(err) {
+		return schedules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		schedule := brew.Schedule{}
+		err = json.Unmarshal([]byte(record), &schedule)
+		if err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, schedule)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+
+	return schedules, nil
+}
+
+// writeScheduleToDB writes the supplied schedule to the database.
+func (s *Server) writeScheduleToDB(schedule brew.Schedule) error {
+	return s.DB.Write(s.collection(schedulesCollection), schedule.ID, schedule)
+}
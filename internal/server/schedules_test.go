@@ -0,0 +1,178 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+func TestCreateSchedule(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestRouter()
+	r.POST("/schedules", s.CreateSchedule)
+	r.GET("/schedules/:id", s.GetSchedule)
+	r.GET("/schedules/:id/runs", s.GetScheduleRuns)
+
+	w := withTestRequest(r, http.MethodPost, "/schedules", `{"name": "morning", "cron": "0 5 * * *", "dripsPerMinute": 40}`)
+	if w.Code != http.StatusCreated {
+		t.Fatal("could not create schedule:", w.Body.String())
+	}
+
+	var schedule brew.Schedule
+	err = json.Unmarshal(w.Body.Bytes(), &schedule)
+	if err != nil {
+		t.Fatal("could not decode schedule:", err)
+	}
+
+	if schedule.NextRunAt == nil || schedule.NextRunAt.Hour() != 5 {
+		t.Error("next run was not filled in:", schedule.NextRunAt)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/schedules/"+schedule.ID, "")
+	if w.Code != http.StatusOK {
+		t.Error("created schedule could not be read:", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/schedules/"+schedule.ID+"/runs?count=3", "")
+	var runs []time.Time
+	err = json.Unmarshal(w.Body.Bytes(), &runs)
+	if err != nil {
+		t.Fatal("could not decode runs:", err)
+	}
+
+	if len(runs) != 3 {
+		t.Error("expected a preview of three runs, got", len(runs))
+	}
+}
+
+func TestCreateScheduleWhenScheduleIsInvalid(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestRouter()
+	r.POST("/schedules", s.CreateSchedule)
+
+	bodies := []string{
+		`{"name": "past", "at": "2019-01-01T05:00:00Z", "dripsPerMinute": 40}`,
+		`{"name": "missing recipe", "cron": "0 5 * * *", "recipeId": "0123456789abcdef"}`,
+		`{"name": "bad cron", "cron": "whenever", "dripsPerMinute": 40}`,
+	}
+
+	for _, body := range bodies {
+		w := withTestRequest(r, http.MethodPost, "/schedules", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("invalid schedule %s returned %d", body, w.Code)
+		}
+	}
+}
+
+func TestDeleteSchedule(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	schedule := withTestSchedule(t, s)
+
+	r := withTestRouter()
+	r.DELETE("/schedules/:id", s.DeleteSchedule)
+
+	w := withTestRequest(r, http.MethodDelete, "/schedules/"+schedule.ID, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatal("could not delete schedule:", w.Code)
+	}
+
+	_, err = s.readScheduleFromDB(schedule.ID)
+	if err != errScheduleNotFound {
+		t.Error("deleted schedule could still be read")
+	}
+}
+
+func TestRunDueSchedulesStartsDripping(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	schedule := withTestSchedule(t, s)
+	at := *schedule.At
+
+	s.runDueSchedules(at.Add(-time.Minute), at.Add(-time.Second))
+	if s.Dripper.GetState() != dripper.OFF {
+		t.Fatal("schedule ran before it was due")
+	}
+
+	s.runDueSchedules(at.Add(-time.Second), at)
+	defer s.offDripper()
+
+	if s.Dripper.GetState() != dripper.DRIP || s.Dripper.GetDripsPerMinute() != 40 {
+		t.Error("schedule did not start dripping")
+	}
+
+	schedule, err = s.readScheduleFromDB(schedule.ID)
+	if err != nil {
+		t.Fatal("could not read schedule from db:", err)
+	}
+
+	if schedule.LastRunAt == nil || schedule.LastError != "" {
+		t.Error("run was not recorded:", schedule.LastError)
+	}
+
+	if _, ok := schedule.Next(at.Add(-time.Minute)); ok {
+		t.Error("one-off schedule would run again")
+	}
+
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		t.Fatal("could not read sessions from db:", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].StartedBy != "schedule:"+schedule.Name || sessions[0].Outcome != api.SessionBrewing {
+		t.Error("scheduled brew session was not recorded")
+	}
+}
+
+func withTestSchedule(t *testing.T, s *Server) brew.Schedule {
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	at := time.Now().Add(time.Hour)
+	schedule := brew.Schedule{
+		ID:             id,
+		Name:           "tomorrow",
+		At:             &at,
+		DripsPerMinute: 40,
+	}
+
+	err = s.writeScheduleToDB(schedule)
+	if err != nil {
+		t.Fatal("could not write schedule to db:", err)
+	}
+
+	return schedule
+}
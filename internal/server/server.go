@@ -7,19 +7,116 @@ package server
 
 import (
 	"log"
+	"path"
+	"sync"
 
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
 	"github.com/betterengineering/cold-brew/pkg/dripper"
 	scribble "github.com/nanobox-io/golang-scribble"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Server is a base object which provide HTTP requests access to the dripper.
+// The server of the default dripper also serves the other drippers listed in
+// the configuration, each of which is controlled by a server of its own.
 type Server struct {
-	Dripper *dripper.Dripper
-	Config  *Config
-	DB      *scribble.Driver
+	// Name is the name of the dripper controlled by the server.
+	Name string
+
+	Dripper  *dripper.Dripper
+	Executor *brew.Executor
+	Events   *Hub
+	Config   *Config
+	DB       *scribble.Driver
+
+	// calibration is the guided calibration procedure in progress, if any.
+	calibration *calibrationProcedure
+
+	// calibrationMutex is used to access the calibration procedure across
+	// multiple goroutines.
+	calibrationMutex sync.Mutex
+
+	// ownerMutex is held while starting a recipe and while sending a manual
+	// command to the dripper, so the two never fight over the dripper.
+	ownerMutex sync.Mutex
+
+	// session is the brew session being recorded, if any.
+	session *activeSession
+
+	// sessionMutex is used to access the brew session across multiple
+	// goroutines.
+	sessionMutex sync.Mutex
+
+	// queuedSessions are the latest copies of the brew sessions waiting to be
+	// written to the database by a single writer, which sessionWriterOnce
+	// starts with the first copy. sessionWake tells the writer more were
+	// queued and sessionsWritten tells readers the writer has caught up.
+	queuedSessions    map[string]api.BrewSession
+	writingSessions   bool
+	sessionQueueMutex sync.Mutex
+	sessionsWritten   *sync.Cond
+	sessionWake       chan struct{}
+	sessionWriterOnce sync.Once
+
+	// settingsMutex serializes new versions of the settings in the database
+	// and applying them to the dripper.
+	settingsMutex sync.Mutex
+
+	// stateMutex serializes queueing copies of the dripper state, so they
+	// are written to the database in order.
+	stateMutex sync.Mutex
+
+	// stateQueue holds the copy of the dripper state waiting to be written
+	// to the database by a single writer, which stateOnce starts with the
+	// first copy.
+	stateQueue chan dripperState
+	stateOnce  sync.Once
+
+	// scheduleMutex serializes changes to the schedules in the database.
+	scheduleMutex sync.Mutex
+
+	// scheduleWake tells the scheduler the schedules have changed.
+	scheduleWake chan struct{}
+
+	// lastBrewStatus is the status of the executor the webhooks were last
+	// told about.
+	lastBrewStatus brew.Status
+
+	// motorFailing is true while the motor controller is returning errors, so
+	// the webhooks are only told when it starts failing.
+	motorFailing bool
+
+	// webhookMutex is used to access what the webhooks were last told across
+	// multiple goroutines.
+	webhookMutex sync.Mutex
+
+	// webhookQueue holds the events waiting to be delivered to the webhooks
+	// by a single worker, which webhookOnce starts with the first event.
+	webhookQueue chan api.WebhookEvent
+	webhookOnce  sync.Once
+
+	// namespace is the directory in the database holding the collections
+	// which belong to the dripper. The default dripper uses the top of the
+	// database so its data is found where a single dripper keeps it.
+	namespace string
+
+	// drippers are the servers of every dripper by name. It is shared by all
+	// of them and not changed once the server is created.
+	drippers map[string]*Server
+
+	// metrics is the registry of the metrics of every dripper. It is shared
+	// by all of the servers.
+	metrics *prometheus.Registry
+
+	// mqtt publishes the state of every dripper to the MQTT broker and runs
+	// the commands it sends, or is nil if no broker is configured. It is
+	// shared by all of the servers.
+	mqtt *mqttBridge
 }
 
-// New creates a new server instance.
+// New creates a server for every dripper in the configuration and returns the
+// server of the default dripper.
 func New() *Server {
 	config, err := NewConfig()
 	if err != nil {
@@ -31,23 +128,121 @@ func New() *Server {
 		log.Fatal(err)
 	}
 
-	s := Server{
-		Config: config,
-		DB:     db,
+	drippers := make(map[string]*Server, len(config.Drippers))
+	metrics := newMetricsRegistry(drippers)
+
+	var bridge *mqttBridge
+	if config.MQTT.Broker != "" {
+		bridge = newMQTTBridge(config.MQTT, drippers)
+	}
+	for i, dc := range config.Drippers {
+		s := &Server{
+			Name:         dc.Name,
+			Events:       NewHub(),
+			Config:       config,
+			DB:           db,
+			scheduleWake: make(chan struct{}, 1),
+			drippers:     drippers,
+			metrics:      metrics,
+			mqtt:         bridge,
+		}
+		if i > 0 {
+			s.namespace = path.Join(drippersCollection, dc.Name)
+		}
+
+		drippers[dc.Name] = s
+		s.createDripper()
+	}
+
+	// Every motor controller is started before any brew is resumed, since
+	// starting a controller can stop the motors of one sharing its hardware.
+	for _, dc := range config.Drippers {
+		drippers[dc.Name].start()
+	}
+
+	if bridge != nil {
+		bridge.start()
 	}
 
+	return drippers[config.Drippers[0].Name]
+}
+
+// createDripper creates the dripper controlled by the server and starts its
+// motor controller.
+func (s *Server) createDripper() {
 	settings := s.readSettingsOrDefault()
 
-	d, err := dripper.New(settings)
+	d, err := s.newDripper(settings)
 	if err != nil {
-		if config.Environment == EnvDevelopment {
+		if s.Config.Environment == EnvDevelopment {
 			log.Println(err)
 		} else {
 			log.Fatal(err)
 		}
 	}
 
+	s.setDripper(d)
+}
+
+// start continues any brew the dripper was interrupted in and starts the
+// background tasks of the server.
+func (s *Server) start() {
+	// The saved state is read before anything can overwrite it.
+	state, err := s.readStateFromDB()
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = s.interruptSessions(state.UpdatedAt)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if s.Dripper != nil {
+		s.resumeState(state)
+		go s.saveStatePeriodically()
+		go s.runSchedules()
+	}
+}
+
+// collection returns the name of a database collection which belongs to the
+// dripper controlled by the server.
+func (s *Server) collection(name string) string {
+	return path.Join(s.namespace, name)
+}
+
+// setDripper makes the supplied dripper the one controlled by the server.
+func (s *Server) setDripper(d *dripper.Dripper) {
 	s.Dripper = d
+	s.Executor = brew.NewExecutor(d)
+	s.Executor.AddListener(s.recordSessionBrewStatus)
+	s.Executor.AddListener(s.recordStateBrewStatus)
+	s.Executor.AddListener(s.sendBrewWebhooks)
+
+	if d != nil {
+		d.AddListener(s.publishDripperEvent)
+		d.AddListener(s.recordSessionEvent)
+		d.AddListener(s.recordStateEvent)
+		d.AddListener(s.abortBrewOnTrip)
+		d.AddListener(s.publishMQTTEvent)
+		d.AddListener(s.sendDripperWebhooks)
+	}
+}
+
+// newDripper creates a new dripper with the supplied settings using the motor
+// driver from the configuration.
+func (s *Server) newDripper(settings dripper.Settings) (*dripper.Dripper, error) {
+	dc := s.Config.dripper(s.Name)
+	pump, err := dripper.NewMotorController(dc.Driver, dc.DriverOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := dripper.New(settings, countingMotor{pump, s.Name, s.recordMotorResult})
+	if d != nil {
+		d.SetCalibration(s.readCalibrationOrDefault())
+		d.SetLimits(s.Config.Limits)
+	}
 
-	return &s
+	return d, err
 }
@@ -3,6 +3,14 @@
 
 package server
 
+import (
+	"net/http/httptest"
+	"strings"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-gonic/gin"
+)
+
 func withTestServerStruct() (*Server, string, error) {
 	db, dir, err := withNewTempDatabase()
 	if err != nil {
@@ -15,9 +23,38 @@ func withTestServerStruct() (*Server, string, error) {
 	}
 
 	s := Server{
+		Events: NewHub(),
 		Config: config,
 		DB:     db,
 	}
 
 	return &s, dir, nil
 }
+
+// withTestDripper attaches a dripper backed by the simulator to the server.
+func withTestDripper(s *Server) error {
+	d, err := s.newDripper(dripper.DefaultSettings())
+	if err != nil {
+		return err
+	}
+
+	s.setDripper(d)
+	return nil
+}
+
+// withTestRouter returns a bare router for exercising handlers.
+func withTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	return gin.New()
+}
+
+// withTestRequest sends a request with a JSON body to the router and returns
+// the recorded response.
+func withTestRequest(r *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
@@ -0,0 +1,470 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sessionsCollection = "sessions"
+
+	// userHeader names the person sending a request which was not
+	// authenticated. Requests without it are attributed to the address of
+	// the client.
+	userHeader = "X-Cold-Brew-User"
+
+	// sessionProfileInterval is how often a rate change made by a profile is
+	// recorded, so a long ramp does not record every step of it.
+	sessionProfileInterval = 5 * time.Minute
+)
+
+// errSessionNotFound is returned when a brew session does not exist in the
+// database.
+var errSessionNotFound = errors.New("the brew session could not be found")
+
+// activeSession is the brew session in progress along with the counters of
+// the dripper when it began.
+type activeSession struct {
+	api.BrewSession
+
+	// startDrips is the number of drips of the dripper when the session began.
+	startDrips uint64
+
+	// startVolume is the dispensed volume of the dripper when the session
+	// began.
+	startVolume float64
+
+	// priorDrips is the number of drips dispensed by a session before it was
+	// interrupted by a restart.
+	priorDrips uint64
+
+	// priorVolume is the volume dispensed by a session before it was
+	// interrupted by a restart.
+	priorVolume float64
+}
+
+// GetSessions returns every brew session stored in the database, most recent
+// first.
+func (s *Server) GetSessions(c *gin.Context) {
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the brew sessions could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// GetSession returns a single brew session.
+func (s *Server) GetSession(c *gin.Context) {
+	session, err := s.readSessionFromDB(c.Param("id"))
+	if err == errSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the brew session could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// requester returns who sent a request: the user or token which
+// authenticated it, otherwise the user named in its header or the address of
+// the client.
+func requester(c *gin.Context) string {
+	if authenticated, ok := currentUser(c); ok {
+		return authenticated.Name
+	}
+
+	user := c.GetHeader(userHeader)
+	if user != "" {
+		return user
+	}
+
+	return c.ClientIP()
+}
+
+// beginSession starts recording a brew session. Starting the dripper by hand
+// while a manual session is in progress continues that session, while
+// starting a recipe always ends the previous session.
+func (s *Server) beginSession(startedBy string, recipe *brew.Recipe) {
+	// Deferred first so the state is saved with the new session once it has
+	// been unlocked.
+	defer s.saveState()
+
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	if s.session != nil {
+		if recipe == nil && s.session.RecipeID == "" {
+			return
+		}
+
+		s.endSessionLocked(api.SessionStopped)
+	}
+
+	id, err := newID()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not generate brew session id")
+		return
+	}
+
+	now := time.Now()
+	session := activeSession{
+		startDrips:  s.Dripper.GetDrips(),
+		startVolume: s.Dripper.GetDispensedVolume(),
+	}
+	session.ID = id
+	session.StartedAt = now
+	session.StartedBy = startedBy
+	session.Outcome = api.SessionBrewing
+	session.RateChanges = []api.RateChange{
+		{
+			Time:           now,
+			State:          s.Dripper.GetState(),
+			DripsPerMinute: s.Dripper.GetDripsPerMinute(),
+		},
+	}
+	session.DripLog = []api.DripLogEntry{}
+
+	if recipe != nil {
+		session.RecipeID = recipe.ID
+		session.RecipeName = recipe.Name
+	}
+
+	s.session = &session
+	s.saveSession()
+	s.Dripper.BeginSession()
+}
+
+// resumeSession continues recording a brew session which was interrupted by a
+// restart.
+func (s *Server) resumeSession(id string) {
+	session, err := s.readSessionFromDB(id)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"session": id,
+			"error":   err,
+		}).Warn("could not resume brew session")
+		return
+	}
+
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	resumed := activeSession{
+		BrewSession: session,
+		startDrips:  s.Dripper.GetDrips(),
+		startVolume: s.Dripper.GetDispensedVolume(),
+		priorDrips:  session.TotalDrips,
+		priorVolume: session.EstimatedVolume,
+	}
+	resumed.EndedAt = nil
+	resumed.Outcome = api.SessionBrewing
+	resumed.RateChanges = append(resumed.RateChanges, api.RateChange{
+		Time:           time.Now(),
+		State:          s.Dripper.GetState(),
+		DripsPerMinute: s.Dripper.GetDripsPerMinute(),
+	})
+
+	s.session = &resumed
+	s.saveSession()
+	s.Dripper.BeginSession()
+}
+
+// endSession stops recording the brew session in progress, if any, with the
+// supplied outcome.
+func (s *Server) endSession(outcome string) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	s.endSessionLocked(outcome)
+}
+
+// endSessionLocked stops recording the brew session in progress. The caller
+// must hold the sessionMutex.
+func (s *Server) endSessionLocked(outcome string) {
+	if s.session == nil {
+		return
+	}
+
+	now := time.Now()
+	s.session.EndedAt = &now
+	s.session.Outcome = outcome
+	s.saveSession()
+	s.session = nil
+	s.Dripper.EndSession()
+}
+
+// recordSessionEvent adds a dripper event to the brew session in progress. A
+// manual session ends when the dripper turns off, while recipe sessions last
+// until the recipe ends.
+func (s *Server) recordSessionEvent(event dripper.Event) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	if s.session == nil {
+		return
+	}
+
+	switch event.Type {
+	case dripper.EventDrip:
+		// The session is only saved once per minute while dripping.
+		minute := event.Time.Truncate(time.Minute)
+		last := len(s.session.DripLog) - 1
+		if last >= 0 && s.session.DripLog[last].Minute.Equal(minute) {
+			s.session.DripLog[last].Drips++
+			return
+		}
+
+		s.session.DripLog = append(s.session.DripLog, api.DripLogEntry{
+			Minute: minute,
+			Drips:  1,
+		})
+	case dripper.EventTrip:
+		s.endSessionLocked(api.SessionTripped)
+		return
+	case dripper.EventState, dripper.EventRate:
+		if event.State == dripper.OFF && s.session.RecipeID == "" {
+			s.endSessionLocked(api.SessionCompleted)
+			return
+		}
+
+		if event.Type == dripper.EventRate && s.followingProfile() {
+			last := s.session.RateChanges[len(s.session.RateChanges)-1]
+			if event.Time.Sub(last.Time) < sessionProfileInterval {
+				return
+			}
+		}
+
+		s.session.RateChanges = append(s.session.RateChanges, api.RateChange{
+			Time:           event.Time,
+			State:          event.State,
+			DripsPerMinute: event.DripsPerMinute,
+		})
+	}
+
+	s.saveSession()
+}
+
+// recordSessionBrewStatus ends the brew session of a recipe once the executor
+// has finished brewing it.
+func (s *Server) recordSessionBrewStatus(status brew.Status) {
+	var outcome string
+	switch status.State {
+	case brew.StatusFinished:
+		outcome = api.SessionCompleted
+	case brew.StatusAborted:
+		outcome = api.SessionAborted
+	case brew.StatusFailed:
+		outcome = api.SessionFailed
+	default:
+		return
+	}
+
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	if s.session == nil || status.Recipe == nil || s.session.RecipeID != status.Recipe.ID {
+		return
+	}
+
+	s.endSessionLocked(outcome)
+}
+
+// followingProfile reports whether the dripper is following a rate profile.
+func (s *Server) followingProfile() bool {
+	profile, _ := s.Dripper.GetProfile()
+	return profile != nil
+}
+
+// saveSession updates the totals of the brew session in progress and queues
+// a copy of it to be written to the database. The caller must hold the
+// sessionMutex.
+func (s *Server) saveSession() {
+	drips := s.Dripper.GetDrips()
+	if drips >= s.session.startDrips {
+		s.session.TotalDrips = s.session.priorDrips + drips - s.session.startDrips
+	}
+
+	volume := s.Dripper.GetDispensedVolume()
+	if volume >= s.session.startVolume {
+		s.session.EstimatedVolume = s.session.priorVolume + volume - s.session.startVolume
+	}
+
+	s.queueSession(s.session.BrewSession)
+}
+
+// startSessionWriter starts the goroutine which writes queued brew sessions to
+// the database, unless it is already running.
+func (s *Server) startSessionWriter() {
+	s.sessionWriterOnce.Do(func() {
+		s.queuedSessions = make(map[string]api.BrewSession)
+		s.sessionsWritten = sync.NewCond(&s.sessionQueueMutex)
+		s.sessionWake = make(chan struct{}, 1)
+		go s.writeQueuedSessions()
+	})
+}
+
+// queueSession queues a copy of a brew session to be written to the database
+// by the session writer, so it never waits for the database. A copy of the
+// same session still waiting to be written is replaced by the new one.
+func (s *Server) queueSession(session api.BrewSession) {
+	s.startSessionWriter()
+
+	// The copy must not share the logs the session keeps appending to.
+	session.RateChanges = append([]api.RateChange(nil), session.RateChanges...)
+	session.DripLog = append([]api.DripLogEntry(nil), session.DripLog...)
+
+	s.sessionQueueMutex.Lock()
+	s.queuedSessions[session.ID] = session
+	s.sessionQueueMutex.Unlock()
+
+	select {
+	case s.sessionWake <- struct{}{}:
+	default:
+	}
+}
+
+// writeQueuedSessions writes the queued brew sessions to the database each
+// time more are queued. It never returns.
+func (s *Server) writeQueuedSessions() {
+	for range s.sessionWake {
+		s.sessionQueueMutex.Lock()
+		queued := s.queuedSessions
+		s.queuedSessions = make(map[string]api.BrewSession)
+		s.writingSessions = true
+		s.sessionQueueMutex.Unlock()
+
+		for _, session := range queued {
+			err := s.writeSessionToDB(session)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"session": session.ID,
+					"error":   err,
+				}).Error("could not write brew session to the database")
+			}
+		}
+
+		s.sessionQueueMutex.Lock()
+		s.writingSessions = false
+		s.sessionsWritten.Broadcast()
+		s.sessionQueueMutex.Unlock()
+	}
+}
+
+// waitForSessions waits until every queued brew session has been written to
+// the database, so reads see the latest copy of each session.
+func (s *Server) waitForSessions() {
+	s.startSessionWriter()
+
+	s.sessionQueueMutex.Lock()
+	defer s.sessionQueueMutex.Unlock()
+
+	for len(s.queuedSessions) > 0 || s.writingSessions {
+		s.sessionsWritten.Wait()
+	}
+}
+
+// interruptSessions marks every brew session left in progress by a previous
+// run of the server as interrupted, ending them when the state of the dripper
+// was last saved.
+func (s *Server) interruptSessions(lastSaved time.Time) error {
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.Outcome != api.SessionBrewing {
+			continue
+		}
+
+		endedAt := lastSaved
+		if endedAt.Before(session.StartedAt) {
+			endedAt = session.StartedAt
+		}
+
+		session.Outcome = api.SessionInterrupted
+		session.EndedAt = &endedAt
+		err = s.writeSessionToDB(session)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSessionFromDB reads a single brew session from the database.
+func (s *Server) readSessionFromDB(id string) (api.BrewSession, error) {
+	session := api.BrewSession{}
+	if !isValidID(id) {
+		return session, errSessionNotFound
+	}
+
+	s.waitForSessions()
+
+	err := s.DB.Read(s.collection(sessionsCollection), id, &session)
+	if isNotFound(err) {
+		return session, errSessionNotFound
+	}
+	if err != nil {
+		return session, err
+	}
+
+	return session, nil
+}
+
+// readSessionsFromDB reads every brew session from the database, most recent
+// first.
+func (s *Server) readSessionsFromDB() ([]api.BrewSession, error) {
+	s.waitForSessions()
+
+	sessions := []api.BrewSession{}
+	records, err := s.DB.ReadAll(s.collection(sessionsCollection))
+	if isNotFound(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		session := api.BrewSession{}
+		err = json.Unmarshal([]byte(record), &session)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.After(sessions[j].StartedAt)
+	})
+
+	return sessions, nil
+}
+
+// writeSessionToDB writes the supplied brew session to the database.
+func (s *Server) writeSessionToDB(session api.BrewSession) error {
+	return s.DB.Write(s.collection(sessionsCollection), session.ID, session)
+}
@@ -0,0 +1,271 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+func TestSessionRecordsManualBrew(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/dripper/drip", s.SetDripperDrip)
+	r.POST("/dripper/off", s.SetDripperOff)
+	r.GET("/sessions", s.GetSessions)
+
+	req := httptest.NewRequest(http.MethodPost, "/dripper/drip", strings.NewReader(`{"dripsPerMinute": 60}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(userHeader, "barista")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := withTestRequest(r, http.MethodPost, "/dripper/drip", `{"dripsPerMinute": 120}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not change the drip rate:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/off", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not turn the dripper off:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/sessions", "")
+	var sessions []api.BrewSession
+	err = json.Unmarshal(w.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatal("could not decode sessions:", err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatal("expected a single session, got", len(sessions))
+	}
+
+	session := sessions[0]
+	if session.StartedBy != "barista" {
+		t.Error("session was not attributed to the user who started it:", session.StartedBy)
+	}
+
+	if session.Outcome != api.SessionStopped || session.EndedAt == nil {
+		t.Error("session did not end when the dripper was turned off:", session.Outcome)
+	}
+
+	if len(session.RateChanges) != 2 || session.RateChanges[1].DripsPerMinute != 120 {
+		t.Error("rate changes were not recorded:", session.RateChanges)
+	}
+}
+
+func TestSessionRecordsRecipe(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	recipe := withTestRecipe(t)
+	recipe.Steps = []brew.Step{
+		{Action: brew.ActionDrip, DripsPerMinute: 60, Seconds: 0.01},
+	}
+	err = s.writeRecipeToDB(recipe)
+	if err != nil {
+		t.Fatal("could not write recipe to db:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/brew", s.StartBrew)
+
+	w := withTestRequest(r, http.MethodPost, "/brew", `{"recipeId": "`+recipe.ID+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not start brew:", w.Body.String())
+	}
+	s.Executor.Wait()
+
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		t.Fatal("could not read sessions from db:", err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatal("expected a single session, got", len(sessions))
+	}
+
+	if sessions[0].RecipeID != recipe.ID || sessions[0].RecipeName != recipe.Name {
+		t.Error("session did not record the recipe")
+	}
+
+	if sessions[0].Outcome != api.SessionCompleted {
+		t.Error("session did not complete with the recipe:", sessions[0].Outcome)
+	}
+}
+
+func TestSessionEndsWhenTargetIsReached(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	err = s.runDripper()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+	s.beginSession("barista", nil)
+
+	err = s.Dripper.SetTargetDuration(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal("could not set target duration:", err)
+	}
+
+	for i := 0; i < 100 && s.Dripper.GetState() != dripper.OFF; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		t.Fatal("could not read sessions from db:", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Outcome != api.SessionCompleted {
+		t.Error("session did not complete when the dripper turned itself off")
+	}
+
+	if sessions[0].RateChanges[0].State != dripper.RUN {
+		t.Error("session did not record the initial state of the dripper")
+	}
+}
+
+func TestSessionCoalescesProfileRateChanges(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.offDripper()
+
+	err = s.dripProfileUntil(dripper.Profile{
+		Type:                dripper.ProfileLinear,
+		StartDripsPerMinute: 120,
+		EndDripsPerMinute:   40,
+		Seconds:             3600,
+	}, 0)
+	if err != nil {
+		t.Fatal("could not drip with profile:", err)
+	}
+	s.beginSession("barista", nil)
+
+	start := time.Now()
+	for i := 1; i <= 10; i++ {
+		s.recordSessionEvent(dripper.Event{
+			Type:           dripper.EventRate,
+			Time:           start.Add(time.Duration(i) * time.Minute),
+			State:          dripper.DRIP,
+			DripsPerMinute: float64(120 - i),
+		})
+	}
+
+	sessions, err := s.readSessionsFromDB()
+	if err != nil {
+		t.Fatal("could not read sessions from db:", err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatal("expected a single session, got", len(sessions))
+	}
+
+	changes := sessions[0].RateChanges
+	if len(changes) != 3 || changes[1].DripsPerMinute != 115 || changes[2].DripsPerMinute != 110 {
+		t.Error("profile rate changes were not recorded every five minutes:", changes)
+	}
+}
+
+func TestInterruptSessions(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	startedAt := time.Now().Add(-time.Hour)
+	err = s.writeSessionToDB(api.BrewSession{ID: id, StartedAt: startedAt, Outcome: api.SessionBrewing})
+	if err != nil {
+		t.Fatal("could not write session to db:", err)
+	}
+
+	lastSaved := startedAt.Add(30 * time.Minute)
+	err = s.interruptSessions(lastSaved)
+	if err != nil {
+		t.Fatal("could not interrupt sessions:", err)
+	}
+
+	session, err := s.readSessionFromDB(id)
+	if err != nil {
+		t.Fatal("could not read session from db:", err)
+	}
+
+	if session.Outcome != api.SessionInterrupted {
+		t.Error("session left in progress was not interrupted")
+	}
+
+	if session.EndedAt == nil || !session.EndedAt.Equal(lastSaved) {
+		t.Error("interrupted session did not end when the state was last saved:", session.EndedAt)
+	}
+}
+
+func TestGetSessionWhenSessionDoesNotExist(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestRouter()
+	r.GET("/sessions/:id", s.GetSession)
+
+	w := withTestRequest(r, http.MethodGet, "/sessions/0123456789abcdef", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("missing session did not return not found:", w.Code)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/sessions/..", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("invalid session id did not return not found:", w.Code)
+	}
+}
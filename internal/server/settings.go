@@ -4,23 +4,50 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
+	"github.com/betterengineering/cold-brew/api"
 	"github.com/betterengineering/cold-brew/pkg/dripper"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	settingsCollection = "settings"
-	settingsResource   = "dripper"
+	settingsCollection         = "settings"
+	settingsResource           = "dripper"
+	settingsVersionsCollection = "settingsVersions"
+)
+
+var (
+	// errSettingsVersionNotFound is returned when a version of the settings
+	// does not exist in the database.
+	errSettingsVersionNotFound = errors.New("the settings version could not be found")
+
+	// errSettingsNotSaved is returned when new settings could not be written
+	// to the database.
+	errSettingsNotSaved = errors.New("the settings could not be written to the database")
+
+	// errSettingsNotApplied is returned when new settings could not be applied
+	// to the dripper.
+	errSettingsNotApplied = errors.New("the settings could not be applied to the dripper")
 )
 
 // GetDripperSettings returns the current configuration of the dripper.
 func (s *Server) GetDripperSettings(c *gin.Context) {
-	c.JSON(http.StatusOK, s.Dripper.Settings)
+	c.JSON(http.StatusOK, s.Dripper.GetSettings())
 }
 
-// SetDripperSettings reinitializes the dripper with the supplied config.
+// SetDripperSettings applies the supplied config to the dripper without
+// interrupting it and saves it as a new version. The apply query parameter
+// chooses whether the settings take effect now, which is the default, or at
+// the next drip. Settings which the dripper holds back until later are
+// accepted rather than applied.
 func (s *Server) SetDripperSettings(c *gin.Context) {
 	var settings dripper.Settings
 	err := c.BindJSON(&settings)
@@ -29,28 +56,227 @@ func (s *Server) SetDripperSettings(c *gin.Context) {
 		return
 	}
 
-	err = s.writeDripperSettingsToDB(settings)
+	err = settings.Validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, settingsErrorBody(err))
+		return
+	}
+
+	apply, ok := applyMode(c)
+	if !ok {
+		return
+	}
+
+	_, err = s.applySettings(settings, apply, api.SettingsVersion{CreatedBy: requester(c)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(s.settingsStatusCode(), settings)
+}
+
+// GetDripperSettingsHistory returns every saved version of the dripper
+// settings, most recent first.
+func (s *Server) GetDripperSettingsHistory(c *gin.Context) {
+	versions, err := s.readSettingsVersionsFromDB()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings could not be written to the database"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings history could not be read from the database"})
 		return
 	}
 
-	s.Dripper.Off()
+	c.JSON(http.StatusOK, versions)
+}
 
-	d, err := dripper.New(settings)
+// RollbackDripperSettings restores a previous version of the dripper settings
+// to the dripper and saves it as a new version. It takes the same apply query
+// parameter as SetDripperSettings.
+func (s *Server) RollbackDripperSettings(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": errSettingsVersionNotFound.Error()})
+		return
+	}
+
+	previous, err := s.readSettingsVersionFromDB(version)
+	if err == errSettingsVersionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "the dripper could not be reinitialized"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings version could not be read from the database"})
 		return
 	}
 
-	s.Dripper = d
-	c.JSON(http.StatusOK, s.Dripper.Settings)
+	settings := dripperSettings(previous.Settings)
+	err = settings.Validate()
+	if err != nil {
+		c.JSON(http.StatusConflict, settingsErrorBody(err))
+		return
+	}
+
+	apply, ok := applyMode(c)
+	if !ok {
+		return
+	}
+
+	restored, err := s.applySettings(settings, apply, api.SettingsVersion{
+		CreatedBy:      requester(c),
+		RolledBackFrom: version,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(s.settingsStatusCode(), restored)
+}
+
+// applyMode returns the apply query parameter of the request, responding with
+// an error if it is not valid.
+func applyMode(c *gin.Context) (string, bool) {
+	apply := c.DefaultQuery("apply", dripper.ApplyNow)
+	if apply != dripper.ApplyNow && apply != dripper.ApplyNextDrip {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("apply must be %q or %q", dripper.ApplyNow, dripper.ApplyNextDrip)})
+		return "", false
+	}
+
+	return apply, true
+}
+
+// applySettings saves valid settings as a new version, taking its author and
+// origin from the supplied version, and applies them to the dripper. Both
+// happen under one lock so the dripper always holds the current version.
+func (s *Server) applySettings(settings dripper.Settings, apply string, origin api.SettingsVersion) (api.SettingsVersion, error) {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+
+	version, err := s.saveSettingsVersion(settings, origin)
+	if err != nil {
+		return version, errSettingsNotSaved
+	}
+
+	err = s.Dripper.SetSettings(settings, apply)
+	if err != nil {
+		return version, errSettingsNotApplied
+	}
+
+	return version, nil
+}
+
+// settingsStatusCode returns the status of a settings update, which is
+// accepted rather than OK while the dripper holds the settings back.
+func (s *Server) settingsStatusCode() int {
+	if s.Dripper.GetPendingSettings() != nil {
+		return http.StatusAccepted
+	}
+
+	return http.StatusOK
+}
+
+// saveSettingsVersion writes the supplied settings to the database as both the
+// current settings and the next version in their history. The author and
+// origin of the version are taken from the supplied version. The settings
+// saved before there was a history become its first version, so they can be
+// rolled back to. It must be called while holding the settingsMutex.
+func (s *Server) saveSettingsVersion(settings dripper.Settings, version api.SettingsVersion) (api.SettingsVersion, error) {
+	versions, err := s.readSettingsVersionsFromDB()
+	if err != nil {
+		return version, err
+	}
+
+	if len(versions) == 0 {
+		var first api.SettingsVersion
+		first, err = s.seedSettingsVersion()
+		if err != nil {
+			return version, err
+		}
+		if first.Version != 0 {
+			versions = append(versions, first)
+		}
+	}
+
+	version.Version = 1
+	version.Settings = settingsStatus(settings)
+	version.CreatedAt = time.Now()
+	if len(versions) > 0 {
+		version.Version = versions[0].Version + 1
+	}
+
+	err = s.DB.Write(s.collection(settingsVersionsCollection), strconv.Itoa(version.Version), version)
+	if err != nil {
+		return version, err
+	}
+
+	return version, s.writeDripperSettingsToDB(settings)
+}
+
+// seedSettingsVersion writes the settings saved before there was a history to
+// the database as the first version. It returns an empty version if no
+// settings were saved.
+func (s *Server) seedSettingsVersion() (api.SettingsVersion, error) {
+	settings, err := s.readDripperSettingsFromDB()
+	if isNotFound(err) {
+		return api.SettingsVersion{}, nil
+	}
+	if err != nil {
+		return api.SettingsVersion{}, err
+	}
+
+	version := api.SettingsVersion{
+		Version:   1,
+		Settings:  settingsStatus(settings),
+		CreatedAt: time.Now(),
+	}
+
+	return version, s.DB.Write(s.collection(settingsVersionsCollection), strconv.Itoa(version.Version), version)
+}
+
+// readSettingsVersionFromDB reads a single version of the settings from the
+// database.
+func (s *Server) readSettingsVersionFromDB(version int) (api.SettingsVersion, error) {
+	v := api.SettingsVersion{}
+	err := s.DB.Read(s.collection(settingsVersionsCollection), strconv.Itoa(version), &v)
+	if isNotFound(err) {
+		return v, errSettingsVersionNotFound
+	}
+
+	return v, err
+}
+
+// readSettingsVersionsFromDB reads every version of the settings from the
+// database, most recent first.
+func (s *Server) readSettingsVersionsFromDB() ([]api.SettingsVersion, error) {
+	versions := []api.SettingsVersion{}
+	records, err := s.DB.ReadAll(s.collection(settingsVersionsCollection))
+	if isNotFound(err) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		version := api.SettingsVersion{}
+		err = json.Unmarshal([]byte(record), &version)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	return versions, nil
 }
 
 // readDripperSettingsFromDB reads the dripper settings from the database.
 func (s *Server) readDripperSettingsFromDB() (dripper.Settings, error) {
 	settings := dripper.Settings{}
-	err := s.DB.Read(settingsCollection, settingsResource, &settings)
+	err := s.DB.Read(s.collection(settingsCollection), settingsResource, &settings)
 	if err != nil {
 		return settings, err
 	}
@@ -61,7 +287,7 @@ func (s *Server) readDripperSettingsFromDB() (dripper.Settings, error) {
 // writeDripperSettingsToDB writes the supplied dripper settings to the
 // database.
 func (s *Server) writeDripperSettingsToDB(settings dripper.Settings) error {
-	err := s.DB.Write(settingsCollection, settingsResource, settings)
+	err := s.DB.Write(s.collection(settingsCollection), settingsResource, settings)
 	if err != nil {
 		return err
 	}
@@ -71,12 +297,52 @@ func (s *Server) writeDripperSettingsToDB(settings dripper.Settings) error {
 
 // readSettingsOrDefault attempts to read the dripper settings from the database
 // and returns the default dripper settings on error. This allows the server to
-// start up even if the dripper settings have not yet been modified.
+// start up even if the dripper settings have not yet been modified, or were
+// saved before they were validated.
 func (s *Server) readSettingsOrDefault() dripper.Settings {
 	settings, err := s.readDripperSettingsFromDB()
 	if err != nil {
 		return dripper.DefaultSettings()
 	}
 
+	err = settings.Validate()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("using default dripper settings")
+		return dripper.DefaultSettings()
+	}
+
 	return settings
 }
+
+// settingsErrorBody returns the response body for settings which are not
+// valid, listing why each field is not valid.
+func settingsErrorBody(err error) gin.H {
+	body := gin.H{"error": err.Error()}
+	if settingsErr, ok := err.(*dripper.SettingsError); ok {
+		body["error"] = "the settings are not valid"
+		body["fields"] = settingsErr.Fields
+	}
+
+	return body
+}
+
+// settingsStatus converts dripper settings to their API representation.
+func settingsStatus(settings dripper.Settings) api.Settings {
+	return api.Settings{
+		DripDuration: settings.DripDuration,
+		DripSpeed:    settings.DripSpeed,
+		RunSpeed:     settings.RunSpeed,
+	}
+}
+
+// dripperSettings converts the API representation of settings to dripper
+// settings.
+func dripperSettings(settings api.Settings) dripper.Settings {
+	return dripper.Settings{
+		DripDuration: settings.DripDuration,
+		DripSpeed:    settings.DripSpeed,
+		RunSpeed:     settings.RunSpeed,
+	}
+}
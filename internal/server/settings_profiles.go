@@ -0,0 +1,256 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	settingsProfilesCollection = "settingsProfiles"
+)
+
+var (
+	// errSettingsProfileNotFound is returned when a settings profile does not
+	// exist in the database.
+	errSettingsProfileNotFound = errors.New("the settings profile could not be found")
+
+	// errSettingsProfileInUse is returned when a settings profile referenced
+	// by a recipe is deleted.
+	errSettingsProfileInUse = errors.New("the settings profile is used by a recipe")
+)
+
+// GetSettingsProfiles returns every settings profile stored in the database.
+func (s *Server) GetSettingsProfiles(c *gin.Context) {
+	profiles, err := s.readSettingsProfilesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profiles could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, profiles)
+}
+
+// GetSettingsProfile returns a single settings profile.
+func (s *Server) GetSettingsProfile(c *gin.Context) {
+	profile, err := s.readSettingsProfileFromDB(c.Param("id"))
+	if err == errSettingsProfileNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
+// CreateSettingsProfile saves a new settings profile.
+func (s *Server) CreateSettingsProfile(c *gin.Context) {
+	var profile api.SettingsProfile
+	err := c.BindJSON(&profile)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = dripperSettings(profile.Settings).Validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, settingsErrorBody(err))
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "an ID could not be generated for the settings profile"})
+		return
+	}
+
+	now := time.Now()
+	profile.ID = id
+	profile.CreatedAt = now
+	profile.UpdatedAt = now
+
+	err = s.writeSettingsProfileToDB(profile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be written to the database"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, profile)
+}
+
+// UpdateSettingsProfile replaces an existing settings profile. Drippers using
+// the profile keep their settings until it is activated again.
+func (s *Server) UpdateSettingsProfile(c *gin.Context) {
+	existing, err := s.readSettingsProfileFromDB(c.Param("id"))
+	if err == errSettingsProfileNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be read from the database"})
+		return
+	}
+
+	var profile api.SettingsProfile
+	err = c.BindJSON(&profile)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = dripperSettings(profile.Settings).Validate()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, settingsErrorBody(err))
+		return
+	}
+
+	profile.ID = existing.ID
+	profile.CreatedAt = existing.CreatedAt
+	profile.UpdatedAt = time.Now()
+
+	err = s.writeSettingsProfileToDB(profile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be written to the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
+// DeleteSettingsProfile removes a settings profile from the database unless a
+// recipe still uses it.
+func (s *Server) DeleteSettingsProfile(c *gin.Context) {
+	profile, err := s.readSettingsProfileFromDB(c.Param("id"))
+	if err == errSettingsProfileNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be read from the database"})
+		return
+	}
+
+	recipes, err := s.readRecipesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the recipes could not be read from the database"})
+		return
+	}
+
+	for _, recipe := range recipes {
+		if recipe.SettingsProfileID == profile.ID {
+			c.JSON(http.StatusConflict, gin.H{"error": errSettingsProfileInUse.Error()})
+			return
+		}
+	}
+
+	err = s.DB.Delete(settingsProfilesCollection, profile.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the settings profile could not be deleted from the database"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ActivateSettingsProfile switches the dripper to the settings of a profile
+// and saves them as a new version. It takes the same apply query parameter as
+// SetDripperSettings.
+func (s *Server) ActivateSettingsProfile(c *gin.Context) {
+	apply, ok := applyMode(c)
+	if !ok {
+		return
+	}
+
+	version, err := s.activateSettingsProfile(c.Param("id"), apply, requester(c))
+	if err == errSettingsProfileNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(s.settingsStatusCode(), version)
+}
+
+// activateSettingsProfile switches the dripper to the settings of the profile
+// with the supplied ID, attributed to createdBy.
+func (s *Server) activateSettingsProfile(id string, apply string, createdBy string) (api.SettingsVersion, error) {
+	profile, err := s.readSettingsProfileFromDB(id)
+	if err == errSettingsProfileNotFound {
+		return api.SettingsVersion{}, err
+	}
+	if err != nil {
+		return api.SettingsVersion{}, errors.New("the settings profile could not be read from the database")
+	}
+
+	return s.applySettings(dripperSettings(profile.Settings), apply, api.SettingsVersion{
+		CreatedBy: createdBy,
+		ProfileID: profile.ID,
+	})
+}
+
+// readSettingsProfileFromDB reads a single settings profile from the database.
+func (s *Server) readSettingsProfileFromDB(id string) (api.SettingsProfile, error) {
+	profile := api.SettingsProfile{}
+	if !isValidID(id) {
+		return profile, errSettingsProfileNotFound
+	}
+
+	err := s.DB.Read(settingsProfilesCollection, id, &profile)
+	if isNotFound(err) {
+		return profile, errSettingsProfileNotFound
+	}
+	if err != nil {
+		return profile, err
+	}
+
+	return profile, nil
+}
+
+// readSettingsProfilesFromDB reads every settings profile from the database
+// sorted by name.
+func (s *Server) readSettingsProfilesFromDB() ([]api.SettingsProfile, error) {
+	profiles := []api.SettingsProfile{}
+	records, err := s.DB.ReadAll(settingsProfilesCollection)
+	if isNotFound(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		profile := api.SettingsProfile{}
+		err = json.Unmarshal([]byte(record), &profile)
+		if err != nil {
+			return nil, err
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	return profiles, nil
+}
+
+// writeSettingsProfileToDB writes the supplied settings profile to the
+// database.
+func (s *Server) writeSettingsProfileToDB(profile api.SettingsProfile) error {
+	return s.DB.Write(settingsProfilesCollection, profile.ID, profile)
+}
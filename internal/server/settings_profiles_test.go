@@ -0,0 +1,186 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+)
+
+func TestActivateSettingsProfile(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/settings/profiles", s.CreateSettingsProfile)
+	r.POST("/dripper/settings/profiles/:id/activate", s.ActivateSettingsProfile)
+	r.GET("/dripper/settings/history", s.GetDripperSettingsHistory)
+
+	w := withTestRequest(r, http.MethodPost, "/settings/profiles", `{"name": "ice water", "settings": {"dripDuration": 220, "dripSpeed": 130, "runSpeed": 255}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatal("could not create settings profile:", w.Body.String())
+	}
+
+	var profile api.SettingsProfile
+	err = json.Unmarshal(w.Body.Bytes(), &profile)
+	if err != nil {
+		t.Fatal("could not decode settings profile:", err)
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/settings/profiles/"+profile.ID+"/activate", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not activate settings profile:", w.Body.String())
+	}
+
+	settings := s.Dripper.GetSettings()
+	if settings.DripDuration != 220 || settings.DripSpeed != 130 {
+		t.Error("settings of the profile were not applied:", settings)
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/dripper/settings/history", "")
+	var versions []api.SettingsVersion
+	err = json.Unmarshal(w.Body.Bytes(), &versions)
+	if err != nil {
+		t.Fatal("could not decode settings history:", err)
+	}
+
+	if len(versions) != 1 || versions[0].ProfileID != profile.ID {
+		t.Error("activating the profile was not recorded in the history:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/settings/profiles/foo/activate", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("missing settings profile did not return not found:", w.Code)
+	}
+}
+
+func TestCreateSettingsProfileWhenSettingsAreInvalid(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestRouter()
+	r.POST("/settings/profiles", s.CreateSettingsProfile)
+
+	w := withTestRequest(r, http.MethodPost, "/settings/profiles", `{"name": "broken", "settings": {"dripDuration": 900, "dripSpeed": 130, "runSpeed": 255}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Error("invalid settings profile did not return bad request:", w.Code)
+	}
+}
+
+func TestRecipeSwitchesToSettingsProfile(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.offDripper()
+
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	profile := api.SettingsProfile{
+		ID:       id,
+		Name:     "new tubing",
+		Settings: api.Settings{DripDuration: 180, DripSpeed: 90, RunSpeed: 240},
+	}
+	err = s.writeSettingsProfileToDB(profile)
+	if err != nil {
+		t.Fatal("could not write settings profile to db:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/recipes", s.CreateRecipe)
+	r.DELETE("/settings/profiles/:id", s.DeleteSettingsProfile)
+
+	w := withTestRequest(r, http.MethodPost, "/recipes", `{"name": "kyoto", "steps": [{"action": "drip", "dripsPerMinute": 40, "seconds": 60}], "settingsProfileId": "0000000000000000"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Error("recipe with an unknown settings profile did not return bad request:", w.Code)
+	}
+
+	recipe := withTestRecipe(t)
+	recipe.SettingsProfileID = profile.ID
+	err = s.writeRecipeToDB(recipe)
+	if err != nil {
+		t.Fatal("could not write recipe to db:", err)
+	}
+
+	err = s.startBrew(recipe, "barista")
+	if err != nil {
+		t.Fatal("could not start brew:", err)
+	}
+
+	if s.Dripper.GetSettings() != dripperSettings(profile.Settings) {
+		t.Error("recipe did not switch to its settings profile")
+	}
+
+	w = withTestRequest(r, http.MethodDelete, "/settings/profiles/"+profile.ID, "")
+	if w.Code != http.StatusConflict {
+		t.Error("deleting a settings profile used by a recipe did not return conflict:", w.Code)
+	}
+}
+
+func TestRecipeRestoresSettingsWhenItCanNotStart(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	profile := api.SettingsProfile{
+		ID:       id,
+		Name:     "new tubing",
+		Settings: api.Settings{DripDuration: 180, DripSpeed: 90, RunSpeed: 240},
+	}
+	err = s.writeSettingsProfileToDB(profile)
+	if err != nil {
+		t.Fatal("could not write settings profile to db:", err)
+	}
+
+	previous := s.Dripper.GetSettings()
+	recipe := withTestRecipe(t)
+	recipe.SettingsProfileID = profile.ID
+	recipe.Steps[0] = brew.Step{Action: brew.ActionRun, Volume: 500}
+
+	err = s.startBrew(recipe, "barista")
+	if err == nil {
+		s.offDripper()
+		t.Fatal("recipe started without a calibrated dripper")
+	}
+
+	if s.Dripper.GetSettings() != previous || s.readSettingsOrDefault() != previous {
+		t.Error("settings of the recipe that could not start were kept")
+	}
+}
@@ -4,10 +4,15 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/betterengineering/cold-brew/api"
 	"github.com/betterengineering/cold-brew/pkg/dripper"
 )
 
@@ -62,6 +67,213 @@ func TestReadDripperSettingsOrDefaultWhenSettingsDoNotExist(t *testing.T) {
 	}
 }
 
+func TestSetDripperSettingsWhileDripping(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	d := s.Dripper
+	err = d.Drip(1)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+	defer d.Off()
+
+	r := withTestRouter()
+	r.POST("/dripper/settings", s.SetDripperSettings)
+
+	w := withTestRequest(r, http.MethodPost, "/dripper/settings", `{"dripDuration": 200, "dripSpeed": 150, "runSpeed": 255}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not set settings while dripping:", w.Body.String())
+	}
+
+	if s.Dripper != d || d.GetState() != dripper.DRIP || d.GetSettings().DripSpeed != 150 {
+		t.Error("settings were not applied to the dripping dripper")
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/settings?apply=nextDrip", `{"dripDuration": 200, "dripSpeed": 180, "runSpeed": 255}`)
+	if w.Code != http.StatusAccepted {
+		t.Error("settings held back until the next drip were not accepted:", w.Code)
+	}
+
+	pending := d.GetPendingSettings()
+	if pending == nil || pending.DripSpeed != 180 {
+		t.Error("settings were not held back until the next drip")
+	}
+
+	saved := s.readSettingsOrDefault()
+	if saved.DripSpeed != 180 {
+		t.Error("settings held back until the next drip were not saved")
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/settings?apply=later", `{"dripDuration": 200, "dripSpeed": 180, "runSpeed": 255}`)
+	if w.Code != http.StatusBadRequest {
+		t.Error("invalid apply did not return bad request:", w.Code)
+	}
+}
+
+func TestSetDripperSettingsWhenSettingsAreInvalid(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/dripper/settings", s.SetDripperSettings)
+
+	w := withTestRequest(r, http.MethodPost, "/dripper/settings", `{"dripDuration": -5, "dripSpeed": 300, "runSpeed": 255}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("invalid settings did not return bad request:", w.Code)
+	}
+
+	var body struct {
+		Error  string               `json:"error"`
+		Fields []dripper.FieldError `json:"fields"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal("could not decode error body:", err)
+	}
+
+	if body.Error == "" || len(body.Fields) != 3 || body.Fields[0].Field != "dripDuration" || body.Fields[1].Field != "dripSpeed" {
+		t.Error("field errors were not returned:", w.Body.String())
+	}
+
+	_, err = s.readDripperSettingsFromDB()
+	if err == nil {
+		t.Error("invalid settings were written to the database")
+	}
+}
+
+func TestReadDripperSettingsOrDefaultWhenSettingsAreInvalid(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = s.writeDripperSettingsToDB(dripper.Settings{DripDuration: 1000, DripSpeed: 100, RunSpeed: 255})
+	if err != nil {
+		t.Fatal("could not write dripper settings to db")
+	}
+
+	if s.readSettingsOrDefault() != dripper.DefaultSettings() {
+		t.Error("invalid settings were not replaced by the defaults")
+	}
+}
+
+func TestRollbackDripperSettings(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	r := withTestRouter()
+	r.POST("/dripper/settings", s.SetDripperSettings)
+	r.GET("/dripper/settings/history", s.GetDripperSettingsHistory)
+	r.POST("/dripper/settings/rollback/:version", s.RollbackDripperSettings)
+
+	for _, speed := range []string{"120", "140"} {
+		req := httptest.NewRequest(http.MethodPost, "/dripper/settings", strings.NewReader(`{"dripDuration": 200, "dripSpeed": `+speed+`, "runSpeed": 255}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(userHeader, "barista")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatal("could not set settings:", w.Body.String())
+		}
+	}
+
+	w := withTestRequest(r, http.MethodPost, "/dripper/settings/rollback/1", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not roll back settings:", w.Body.String())
+	}
+
+	if s.Dripper.GetSettings().DripSpeed != 120 || s.readSettingsOrDefault().DripSpeed != 120 {
+		t.Error("rolled back settings were not restored")
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/dripper/settings/history", "")
+	var versions []api.SettingsVersion
+	err = json.Unmarshal(w.Body.Bytes(), &versions)
+	if err != nil {
+		t.Fatal("could not decode settings history:", err)
+	}
+
+	if len(versions) != 3 {
+		t.Fatal("incorrect number of settings versions:", len(versions))
+	}
+
+	if versions[0].Version != 3 || versions[0].RolledBackFrom != 1 || versions[0].Settings.DripSpeed != 120 {
+		t.Error("rollback was not saved as the latest version:", versions[0])
+	}
+
+	if versions[1].Version != 2 || versions[1].CreatedBy != "barista" || versions[1].CreatedAt.IsZero() {
+		t.Error("settings version was not attributed:", versions[1])
+	}
+
+	w = withTestRequest(r, http.MethodPost, "/dripper/settings/rollback/9", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("missing settings version did not return not found:", w.Code)
+	}
+}
+
+func TestSetDripperSettingsKeepsExistingSettingsAsFirstVersion(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	existing := dripper.Settings{DripDuration: 200, DripSpeed: 110, RunSpeed: 255}
+	err = s.writeDripperSettingsToDB(existing)
+	if err != nil {
+		t.Fatal("could not write dripper settings to db:", err)
+	}
+
+	_, err = s.applySettings(dripper.DefaultSettings(), dripper.ApplyNow, api.SettingsVersion{})
+	if err != nil {
+		t.Fatal("could not apply settings:", err)
+	}
+
+	versions, err := s.readSettingsVersionsFromDB()
+	if err != nil {
+		t.Fatal("could not read settings versions from db:", err)
+	}
+
+	if len(versions) != 2 || versions[0].Version != 2 {
+		t.Fatal("existing settings were not saved as the first version:", versions)
+	}
+
+	if versions[1].Version != 1 || !reflect.DeepEqual(dripperSettings(versions[1].Settings), existing) {
+		t.Error("first version does not hold the existing settings:", versions[1])
+	}
+}
+
 func ensureSettingsCanBeWritten(s *Server) error {
 	settings := dripper.DefaultSettings()
 	err := s.writeDripperSettingsToDB(settings)
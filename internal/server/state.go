@@ -0,0 +1,188 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateResource = "state"
+
+	// stateSaveInterval is how often the state is saved while brewing, which
+	// bounds how precisely the length of an outage is known.
+	stateSaveInterval = time.Minute
+)
+
+// dripperState is what the dripper was doing, saved to the database on every
+// transition so a brew can be continued after the server restarts.
+type dripperState struct {
+	State          string           `json:"state"`
+	DripsPerMinute float64          `json:"dripsPerMinute"`
+	Profile        *dripper.Profile `json:"profile,omitempty"`
+	ProfileElapsed float64          `json:"profileElapsed,omitempty"`
+	Recipe         *brew.Recipe     `json:"recipe,omitempty"`
+	BrewState      string           `json:"brewState,omitempty"`
+	Step           int              `json:"step"`
+	StepElapsed    float64          `json:"stepElapsed"`
+	StepDispensed  float64          `json:"stepDispensed,omitempty"`
+	SessionID      string           `json:"sessionId,omitempty"`
+	UpdatedAt      time.Time        `json:"updatedAt"`
+}
+
+// saveState queues a copy of what the dripper and executor are doing to be
+// written to the database by the state writer, so it never waits for the
+// database. A copy still waiting to be written is replaced by the new one.
+func (s *Server) saveState() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	s.stateOnce.Do(func() {
+		s.stateQueue = make(chan dripperState, 1)
+		go s.writeQueuedStates(s.stateQueue)
+	})
+
+	state := s.currentState()
+	select {
+	case <-s.stateQueue:
+	default:
+	}
+
+	// Only this function sends to the queue, so there is room once any
+	// waiting copy has been dropped.
+	s.stateQueue <- state
+}
+
+// currentState returns what the dripper and executor are doing.
+func (s *Server) currentState() dripperState {
+	state := dripperState{
+		State:          s.Dripper.GetState(),
+		DripsPerMinute: s.Dripper.GetDripsPerMinute(),
+		UpdatedAt:      time.Now(),
+	}
+
+	profile, elapsed := s.Dripper.GetProfile()
+	if profile != nil {
+		state.Profile = profile
+		state.ProfileElapsed = elapsed.Seconds()
+	}
+
+	status := s.Executor.Status()
+	if status.State == brew.StatusRunning || status.State == brew.StatusPaused {
+		state.Recipe = status.Recipe
+		state.BrewState = status.State
+		state.Step = status.Step
+		state.StepElapsed = status.StepElapsed
+		state.StepDispensed = status.StepDispensed
+	}
+
+	s.sessionMutex.Lock()
+	if s.session != nil {
+		state.SessionID = s.session.ID
+	}
+	s.sessionMutex.Unlock()
+
+	return state
+}
+
+// writeQueuedStates writes each queued copy of the state to the database in
+// turn. It never returns.
+func (s *Server) writeQueuedStates(queue <-chan dripperState) {
+	for state := range queue {
+		err := s.DB.Write(s.collection(settingsCollection), stateResource, state)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("could not write dripper state to the database")
+		}
+	}
+}
+
+// recordStateEvent saves the state whenever the dripper changes state or rate.
+func (s *Server) recordStateEvent(event dripper.Event) {
+	if event.Type == dripper.EventDrip {
+		return
+	}
+
+	s.saveState()
+}
+
+// recordStateBrewStatus saves the state whenever the recipe moves on.
+func (s *Server) recordStateBrewStatus(status brew.Status) {
+	s.saveState()
+}
+
+// saveStatePeriodically keeps the saved state fresh while brewing so the
+// length of an outage can be measured. It never returns.
+func (s *Server) saveStatePeriodically() {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.Dripper != nil && (s.Dripper.GetState() != dripper.OFF || s.Executor.Active()) {
+			s.saveState()
+		}
+	}
+}
+
+// readStateFromDB reads the last saved state from the database. A missing
+// state means the dripper was off.
+func (s *Server) readStateFromDB() (dripperState, error) {
+	state := dripperState{State: dripper.OFF}
+	err := s.DB.Read(s.collection(settingsCollection), stateResource, &state)
+	if isNotFound(err) {
+		return state, nil
+	}
+
+	return state, err
+}
+
+// resumeState continues the brew described by the supplied state if the
+// resume policy allows it. A recipe which was paused is not continued, as its
+// pump was already off.
+func (s *Server) resumeState(state dripperState) {
+	brewing := state.Recipe != nil && state.BrewState == brew.StatusRunning
+	if !brewing && state.State != dripper.RUN && state.State != dripper.DRIP {
+		return
+	}
+
+	outage := time.Since(state.UpdatedAt)
+	fields := logrus.Fields{
+		"state":  state.State,
+		"outage": outage,
+	}
+
+	if !s.Config.ShouldResume(outage) {
+		logrus.WithFields(fields).Warn("not resuming interrupted brew")
+		s.saveState()
+		return
+	}
+
+	var err error
+	switch {
+	case brewing:
+		elapsed := time.Duration(state.StepElapsed * float64(time.Second))
+		err = s.Executor.StartAt(*state.Recipe, state.Step, elapsed, state.StepDispensed)
+	case state.State == dripper.RUN:
+		err = s.Dripper.Run()
+	case state.State == dripper.DRIP && state.Profile != nil:
+		elapsed := time.Duration(state.ProfileElapsed * float64(time.Second))
+		err = s.Dripper.DripProfile(*state.Profile, elapsed)
+	case state.State == dripper.DRIP:
+		err = s.Dripper.Drip(state.DripsPerMinute)
+	}
+
+	if err != nil {
+		fields["error"] = err
+		logrus.WithFields(fields).Error("could not resume interrupted brew")
+		return
+	}
+
+	logrus.WithFields(fields).Info("resumed interrupted brew")
+	s.resumeSession(state.SessionID)
+}
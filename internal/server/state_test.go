@@ -0,0 +1,205 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+// waitForSavedState waits for the state writer to save the supplied state of
+// the dripper and returns the saved state.
+func waitForSavedState(t *testing.T, s *Server, want string) dripperState {
+	var state dripperState
+	for i := 0; i < 100; i++ {
+		var err error
+		state, err = s.readStateFromDB()
+		if err != nil {
+			t.Fatal("could not read state from db:", err)
+		}
+
+		if state.State == want && !state.UpdatedAt.IsZero() {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return state
+}
+
+func TestStateIsSavedOnTransition(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	err = s.dripDripper(90)
+	if err != nil {
+		t.Fatal("could not drip dripper:", err)
+	}
+
+	state := waitForSavedState(t, s, dripper.DRIP)
+	if state.State != dripper.DRIP || state.DripsPerMinute != 90 {
+		t.Error("state was not saved when the dripper started dripping:", state)
+	}
+
+	err = s.offDripper()
+	if err != nil {
+		t.Fatal("could not turn the dripper off:", err)
+	}
+
+	state = waitForSavedState(t, s, dripper.OFF)
+	if state.State != dripper.OFF {
+		t.Error("state was not saved when the dripper turned off:", state)
+	}
+}
+
+func TestResumeStateContinuesDripping(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	s.resumeState(dripperState{
+		State:          dripper.DRIP,
+		DripsPerMinute: 90,
+		UpdatedAt:      time.Now().Add(-time.Minute),
+	})
+	defer s.Dripper.Off()
+
+	if s.Dripper.GetState() != dripper.DRIP || s.Dripper.GetDripsPerMinute() != 90 {
+		t.Error("dripper did not resume dripping after a short outage")
+	}
+}
+
+func TestResumeStateAfterLongOutage(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	s.resumeState(dripperState{
+		State:          dripper.RUN,
+		DripsPerMinute: 90,
+		UpdatedAt:      time.Now().Add(-time.Hour),
+	})
+
+	if s.Dripper.GetState() != dripper.OFF {
+		t.Error("dripper resumed after an outage longer than the resume window")
+	}
+
+	state := waitForSavedState(t, s, dripper.OFF)
+	if state.State != dripper.OFF {
+		t.Error("state was not reset after the brew was not resumed")
+	}
+}
+
+func TestResumeStateContinuesRecipe(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	id, err := newID()
+	if err != nil {
+		t.Fatal("could not generate id:", err)
+	}
+
+	recipe := withTestRecipe(t)
+	err = s.writeSessionToDB(api.BrewSession{ID: id, RecipeID: recipe.ID, TotalDrips: 100, Outcome: api.SessionInterrupted})
+	if err != nil {
+		t.Fatal("could not write session to db:", err)
+	}
+
+	s.resumeState(dripperState{
+		State:         dripper.DRIP,
+		Recipe:        &recipe,
+		BrewState:     brew.StatusRunning,
+		Step:          1,
+		StepElapsed:   60,
+		StepDispensed: 250,
+		SessionID:     id,
+		UpdatedAt:     time.Now(),
+	})
+	defer s.offDripper()
+
+	status := s.Executor.Status()
+	if status.State != brew.StatusRunning || status.Step != 1 || status.StepElapsed < 60 {
+		t.Error("recipe did not resume at the step it was interrupted in:", status)
+	}
+
+	if status.StepDispensed < 250 {
+		t.Error("volume dispensed before the restart was not counted:", status.StepDispensed)
+	}
+
+	session, err := s.readSessionFromDB(id)
+	if err != nil {
+		t.Fatal("could not read session from db:", err)
+	}
+
+	if session.Outcome != api.SessionBrewing || session.TotalDrips < 100 {
+		t.Error("interrupted session was not resumed:", session.Outcome)
+	}
+}
+
+func TestResumeStateContinuesProfile(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+
+	s.resumeState(dripperState{
+		State:          dripper.DRIP,
+		DripsPerMinute: 80,
+		Profile: &dripper.Profile{
+			Type:                dripper.ProfileLinear,
+			StartDripsPerMinute: 120,
+			EndDripsPerMinute:   40,
+			Seconds:             3600,
+		},
+		ProfileElapsed: 1800,
+		UpdatedAt:      time.Now().Add(-time.Minute),
+	})
+	defer s.Dripper.Off()
+
+	profile, elapsed := s.Dripper.GetProfile()
+	if profile == nil || elapsed < 30*time.Minute {
+		t.Error("dripper did not resume the profile where it was interrupted:", profile, elapsed)
+	}
+}
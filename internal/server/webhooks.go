@@ -0,0 +1,524 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	webhooksCollection = "webhooks"
+
+	// webhookAttempts is the number of times a delivery is attempted before
+	// it is given up on.
+	webhookAttempts = 5
+
+	// webhookTimeout is how long a receiver has to answer a delivery.
+	webhookTimeout = 10 * time.Second
+
+	// webhookQueueSize is the number of events which may wait to be
+	// delivered before new events are dropped.
+	webhookQueueSize = 100
+
+	// webhookEventHeader, webhookDeliveryHeader and webhookSignatureHeader
+	// are the headers which carry the type of the event, the ID of the
+	// delivery and the signature of the body.
+	webhookEventHeader     = "X-Cold-Brew-Event"
+	webhookDeliveryHeader  = "X-Cold-Brew-Delivery"
+	webhookSignatureHeader = "X-Cold-Brew-Signature"
+)
+
+var (
+	// webhookBackoff is how long the first retry of a delivery waits. Every
+	// retry after it waits twice as long as the one before.
+	webhookBackoff = time.Second
+
+	// webhookClient sends every webhook delivery.
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+
+	// webhookEvents are the events a webhook can subscribe to.
+	webhookEvents = map[string]bool{
+		api.WebhookBrewStarted:  true,
+		api.WebhookStepChanged:  true,
+		api.WebhookBrewFinished: true,
+		api.WebhookStateChanged: true,
+		api.WebhookRateChanged:  true,
+		api.WebhookSafetyTrip:   true,
+		api.WebhookMotorError:   true,
+	}
+
+	// errWebhookNotFound is returned when a webhook does not exist in the
+	// database.
+	errWebhookNotFound = errors.New("the webhook could not be found")
+)
+
+// GetWebhooks returns every webhook stored in the database.
+func (s *Server) GetWebhooks(c *gin.Context) {
+	webhooks, err := s.readWebhooksFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhooks could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// GetWebhook returns a single webhook.
+func (s *Server) GetWebhook(c *gin.Context) {
+	webhook, err := s.readWebhookFromDB(c.Param("id"))
+	if err == errWebhookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be read from the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+// CreateWebhook saves a new webhook.
+func (s *Server) CreateWebhook(c *gin.Context) {
+	var webhook api.Webhook
+	err := c.BindJSON(&webhook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = validateWebhook(webhook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+
+	id, err := newID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "an ID could not be generated for the webhook"})
+		return
+	}
+
+	if webhook.Secret == "" {
+		webhook.Secret, err = newID()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "a secret could not be generated for the webhook"})
+			return
+		}
+	}
+
+	now := time.Now()
+	webhook.ID = id
+	webhook.CreatedAt = now
+	webhook.UpdatedAt = now
+
+	err = s.writeWebhookToDB(webhook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be written to the database"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// UpdateWebhook replaces an existing webhook. The secret is kept unless a new
+// one is supplied.
+func (s *Server) UpdateWebhook(c *gin.Context) {
+	existing, err := s.readWebhookFromDB(c.Param("id"))
+	if err == errWebhookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be read from the database"})
+		return
+	}
+
+	var webhook api.Webhook
+	err = c.BindJSON(&webhook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the request submitted either was not JSON or did not contain the proper fields"})
+		return
+	}
+
+	err = validateWebhook(webhook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+
+	if webhook.Secret == "" {
+		webhook.Secret = existing.Secret
+	}
+	webhook.ID = existing.ID
+	webhook.CreatedAt = existing.CreatedAt
+	webhook.UpdatedAt = time.Now()
+
+	err = s.writeWebhookToDB(webhook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be written to the database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhook removes a webhook from the database.
+func (s *Server) DeleteWebhook(c *gin.Context) {
+	webhook, err := s.readWebhookFromDB(c.Param("id"))
+	if err == errWebhookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be read from the database"})
+		return
+	}
+
+	err = s.DB.Delete(webhooksCollection, webhook.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be deleted from the database"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// TestWebhook sends a ping event to a webhook and reports how the receiver
+// answered. The ping is not retried.
+func (s *Server) TestWebhook(c *gin.Context) {
+	webhook, err := s.readWebhookFromDB(c.Param("id"))
+	if err == errWebhookNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "the webhook could not be read from the database"})
+		return
+	}
+
+	event, err := s.newWebhookEvent(api.WebhookPing, gin.H{"webhookId": webhook.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "an ID could not be generated for the delivery"})
+		return
+	}
+
+	_, err = deliverWebhook(webhook, event)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+// validateWebhook ensures a webhook posts to an HTTP URL and only subscribes
+// to known events.
+func validateWebhook(webhook api.Webhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	for _, event := range webhook.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("event %q is not valid", event)
+		}
+	}
+
+	return nil
+}
+
+// sendDripperWebhooks is a dripper listener which sends changes to the state
+// and drip rate of the dripper and safety trips to the webhooks.
+func (s *Server) sendDripperWebhooks(e dripper.Event) {
+	var eventType string
+	switch e.Type {
+	case dripper.EventState:
+		eventType = api.WebhookStateChanged
+	case dripper.EventRate:
+		eventType = api.WebhookRateChanged
+	case dripper.EventTrip:
+		eventType = api.WebhookSafetyTrip
+	default:
+		return
+	}
+
+	s.sendWebhooks(eventType, api.DripperEndpoint{
+		State:                  e.State,
+		DripsPerMinute:         e.DripsPerMinute,
+		MeasuredDripsPerMinute: e.MeasuredDripsPerMinute,
+		DispensedVolume:        e.DispensedVolume,
+		Trip:                   tripStatus(e.Trip),
+	})
+}
+
+// sendBrewWebhooks is an executor listener which sends the start, steps and
+// end of every recipe to the webhooks. Pausing and resuming a recipe is not
+// sent.
+func (s *Server) sendBrewWebhooks(status brew.Status) {
+	s.webhookMutex.Lock()
+	last := s.lastBrewStatus
+	s.lastBrewStatus = status
+	s.webhookMutex.Unlock()
+
+	var eventType string
+	switch status.State {
+	case brew.StatusRunning:
+		if last.State != brew.StatusRunning && last.State != brew.StatusPaused {
+			eventType = api.WebhookBrewStarted
+		} else if status.Step != last.Step {
+			eventType = api.WebhookStepChanged
+		}
+	case brew.StatusFinished, brew.StatusAborted, brew.StatusFailed:
+		eventType = api.WebhookBrewFinished
+	}
+
+	if eventType != "" {
+		s.sendWebhooks(eventType, status)
+	}
+}
+
+// recordMotorResult sends an error returned by the motor controller to the
+// webhooks. A motor which keeps failing is only sent once, until one of its
+// commands succeeds again.
+func (s *Server) recordMotorResult(command string, err error) {
+	s.webhookMutex.Lock()
+	starting := err != nil && !s.motorFailing
+	s.motorFailing = err != nil
+	s.webhookMutex.Unlock()
+
+	if starting {
+		s.sendWebhooks(api.WebhookMotorError, api.MotorError{
+			Command: command,
+			Error:   err.Error(),
+		})
+	}
+}
+
+// sendWebhooks queues an event for delivery to every webhook which subscribes
+// to it. Events are delivered one at a time in the order they were sent, so it
+// never waits for a delivery. An event is dropped if too many are waiting.
+func (s *Server) sendWebhooks(eventType string, data interface{}) {
+	event, err := s.newWebhookEvent(eventType, data)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not generate an ID for a webhook delivery")
+		return
+	}
+
+	s.webhookOnce.Do(func() {
+		s.webhookQueue = make(chan api.WebhookEvent, webhookQueueSize)
+		go s.deliverWebhooks(s.webhookQueue)
+	})
+
+	select {
+	case s.webhookQueue <- event:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"event":    event.Type,
+			"delivery": event.ID,
+		}).Error("too many webhook deliveries are waiting, dropping event")
+	}
+}
+
+// deliverWebhooks delivers each queued event to every webhook which
+// subscribes to it, retrying each delivery until it succeeds or is given up
+// on before moving on to the next. It never returns.
+func (s *Server) deliverWebhooks(queue <-chan api.WebhookEvent) {
+	for event := range queue {
+		webhooks, err := s.readWebhooksFromDB()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("could not read webhooks from the database")
+			continue
+		}
+
+		for _, webhook := range webhooks {
+			if subscribes(webhook, event.Type) {
+				deliverWebhookWithRetries(webhook, event)
+			}
+		}
+	}
+}
+
+// newWebhookEvent creates an event about the dripper to deliver to webhooks.
+func (s *Server) newWebhookEvent(eventType string, data interface{}) (api.WebhookEvent, error) {
+	id, err := newID()
+	if err != nil {
+		return api.WebhookEvent{}, err
+	}
+
+	return api.WebhookEvent{
+		ID:      id,
+		Type:    eventType,
+		Time:    time.Now(),
+		Dripper: s.Name,
+		Data:    data,
+	}, nil
+}
+
+// subscribes reports whether a webhook receives events of the supplied type.
+func subscribes(webhook api.Webhook, eventType string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+
+	for _, event := range webhook.Events {
+		if event == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliverWebhookWithRetries delivers an event to a webhook, waiting twice as
+// long after each failed attempt. Receivers which reject the event outright
+// are not retried.
+func deliverWebhookWithRetries(webhook api.Webhook, event api.WebhookEvent) {
+	fields := logrus.Fields{
+		"webhook":  webhook.ID,
+		"event":    event.Type,
+		"delivery": event.ID,
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := deliverWebhook(webhook, event)
+		if err == nil {
+			return
+		}
+
+		fields["attempt"] = attempt
+		fields["error"] = err
+		if !retry || attempt == webhookAttempts {
+			logrus.WithFields(fields).Error("gave up delivering webhook")
+			return
+		}
+
+		logrus.WithFields(fields).Warn("could not deliver webhook, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// deliverWebhook posts an event to a webhook once. It reports whether a
+// failed delivery is worth retrying.
+func deliverWebhook(webhook api.Webhook, event api.WebhookEvent) (bool, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Type)
+	req.Header.Set(webhookDeliveryHeader, event.ID)
+	req.Header.Set(webhookSignatureHeader, signWebhook(webhook.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("the webhook answered with status %d", resp.StatusCode)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, err
+}
+
+// signWebhook returns the signature of a delivery body, which is the hex HMAC
+// SHA-256 of the body keyed with the secret of the webhook.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// readWebhookFromDB reads a single webhook from the database.
+func (s *Server) readWebhookFromDB(id string) (api.Webhook, error) {
+	webhook := api.Webhook{}
+	if !isValidID(id) {
+		return webhook, errWebhookNotFound
+	}
+
+	err := s.DB.Read(webhooksCollection, id, &webhook)
+	if isNotFound(err) {
+		return webhook, errWebhookNotFound
+	}
+	if err != nil {
+		return webhook, err
+	}
+
+	return webhook, nil
+}
+
+// readWebhooksFromDB reads every webhook from the database in the order they
+// were created.
+func (s *Server) readWebhooksFromDB() ([]api.Webhook, error) {
+	webhooks := []api.Webhook{}
+	records, err := s.DB.ReadAll(webhooksCollection)
+	if isNotFound(err) {
+		return webhooks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		webhook := api.Webhook{}
+		err = json.Unmarshal([]byte(record), &webhook)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+
+	return webhooks, nil
+}
+
+// writeWebhookToDB writes the supplied webhook to the database.
+func (s *Server) writeWebhookToDB(webhook api.Webhook) error {
+	return s.DB.Write(webhooksCollection, webhook.ID, webhook)
+}
@@ -0,0 +1,395 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/brew"
+)
+
+// webhookDelivery is a delivery received by a test webhook receiver.
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+	event  api.WebhookEvent
+}
+
+// withTestWebhookReceiver starts a receiver which answers each delivery with
+// the next of the supplied status codes, then with 200 once they run out.
+func withTestWebhookReceiver(statuses ...int) (*httptest.Server, chan webhookDelivery) {
+	deliveries := make(chan webhookDelivery, 10)
+	answers := make(chan int, len(statuses))
+	for _, status := range statuses {
+		answers <- status
+	}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		delivery := webhookDelivery{header: r.Header, body: body}
+		json.Unmarshal(body, &delivery.event)
+		deliveries <- delivery
+
+		select {
+		case status := <-answers:
+			w.WriteHeader(status)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+
+	return receiver, deliveries
+}
+
+// withTestWebhook registers a webhook with the server.
+func withTestWebhook(s *Server, url string, events ...string) api.Webhook {
+	id, _ := newID()
+	webhook := api.Webhook{
+		ID:        id,
+		URL:       url,
+		Secret:    "secret",
+		Events:    events,
+		CreatedAt: time.Now(),
+	}
+	s.writeWebhookToDB(webhook)
+	return webhook
+}
+
+// nextDelivery waits for the next delivery to a receiver.
+func nextDelivery(t *testing.T, deliveries chan webhookDelivery) webhookDelivery {
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	return webhookDelivery{}
+}
+
+// noDelivery ensures a receiver gets nothing more.
+func noDelivery(t *testing.T, deliveries chan webhookDelivery) {
+	select {
+	case delivery := <-deliveries:
+		t.Error("unexpected webhook delivered:", string(delivery.body))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhooksCRUD(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestRouter()
+	r.GET("/webhooks", s.GetWebhooks)
+	r.POST("/webhooks", s.CreateWebhook)
+	r.GET("/webhooks/:id", s.GetWebhook)
+	r.PUT("/webhooks/:id", s.UpdateWebhook)
+	r.DELETE("/webhooks/:id", s.DeleteWebhook)
+
+	w := withTestRequest(r, http.MethodPost, "/webhooks", `{"url": "https://example.com/hook", "events": ["brew.started"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatal("could not create webhook:", w.Body.String())
+	}
+
+	var webhook api.Webhook
+	err = json.Unmarshal(w.Body.Bytes(), &webhook)
+	if err != nil {
+		t.Fatal("could not decode webhook:", err)
+	}
+
+	if webhook.ID == "" || webhook.Secret == "" {
+		t.Error("webhook was not given an ID and a secret:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodPut, "/webhooks/"+webhook.ID, `{"url": "https://example.com/other"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("could not update webhook:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/webhooks/"+webhook.ID, "")
+	var updated api.Webhook
+	err = json.Unmarshal(w.Body.Bytes(), &updated)
+	if err != nil {
+		t.Fatal("could not decode webhook:", err)
+	}
+
+	if updated.URL != "https://example.com/other" || len(updated.Events) != 0 || updated.Secret != webhook.Secret {
+		t.Error("webhook was not updated or lost its secret:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/webhooks", "")
+	var webhooks []api.Webhook
+	err = json.Unmarshal(w.Body.Bytes(), &webhooks)
+	if err != nil {
+		t.Fatal("could not decode webhooks:", err)
+	}
+
+	if len(webhooks) != 1 {
+		t.Error("webhooks were not listed:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodDelete, "/webhooks/"+webhook.ID, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatal("could not delete webhook:", w.Body.String())
+	}
+
+	w = withTestRequest(r, http.MethodGet, "/webhooks/"+webhook.ID, "")
+	if w.Code != http.StatusNotFound {
+		t.Error("deleted webhook did not return not found:", w.Code)
+	}
+}
+
+func TestCreateWebhookWhenInvalid(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	r := withTestRouter()
+	r.POST("/webhooks", s.CreateWebhook)
+
+	for _, body := range []string{
+		`{}`,
+		`{"url": "example.com/hook"}`,
+		`{"url": "ftp://example.com/hook"}`,
+		`{"url": "https://example.com/hook", "events": ["brew.exploded"]}`,
+	} {
+		w := withTestRequest(r, http.MethodPost, "/webhooks", body)
+		if w.Code != http.StatusBadRequest {
+			t.Error("invalid webhook did not return bad request:", body, w.Code)
+		}
+	}
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver()
+	defer receiver.Close()
+	webhook := withTestWebhook(s, receiver.URL)
+
+	r := withTestRouter()
+	r.POST("/webhooks/:id/test", s.TestWebhook)
+
+	w := withTestRequest(r, http.MethodPost, "/webhooks/"+webhook.ID+"/test", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("could not test webhook:", w.Body.String())
+	}
+
+	delivery := nextDelivery(t, deliveries)
+	if delivery.header.Get(webhookEventHeader) != api.WebhookPing || delivery.event.Type != api.WebhookPing {
+		t.Error("ping was not delivered:", string(delivery.body))
+	}
+
+	if delivery.header.Get(webhookDeliveryHeader) != delivery.event.ID {
+		t.Error("delivery header did not match the event:", delivery.header.Get(webhookDeliveryHeader))
+	}
+
+	if delivery.header.Get(webhookSignatureHeader) != signWebhook("secret", delivery.body) {
+		t.Error("signature did not match the body:", delivery.header.Get(webhookSignatureHeader))
+	}
+
+	if delivery.header.Get(webhookSignatureHeader) == signWebhook("other", delivery.body) {
+		t.Error("signature did not depend on the secret")
+	}
+}
+
+func TestTestWebhookWhenReceiverFails(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver(http.StatusInternalServerError)
+	defer receiver.Close()
+	webhook := withTestWebhook(s, receiver.URL)
+
+	r := withTestRouter()
+	r.POST("/webhooks/:id/test", s.TestWebhook)
+
+	w := withTestRequest(r, http.MethodPost, "/webhooks/"+webhook.ID+"/test", "")
+	if w.Code != http.StatusBadGateway {
+		t.Error("failed ping did not return bad gateway:", w.Code)
+	}
+
+	nextDelivery(t, deliveries)
+	noDelivery(t, deliveries)
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer receiver.Close()
+	withTestWebhook(s, receiver.URL)
+
+	s.sendWebhooks(api.WebhookStateChanged, nil)
+
+	first := nextDelivery(t, deliveries)
+	nextDelivery(t, deliveries)
+	last := nextDelivery(t, deliveries)
+	if first.event.ID != last.event.ID {
+		t.Error("retry was not the same delivery")
+	}
+
+	noDelivery(t, deliveries)
+}
+
+func TestWebhookDeliveryWhenRejected(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver(http.StatusBadRequest)
+	defer receiver.Close()
+	withTestWebhook(s, receiver.URL)
+
+	s.sendWebhooks(api.WebhookStateChanged, nil)
+
+	nextDelivery(t, deliveries)
+	noDelivery(t, deliveries)
+}
+
+func TestWebhookDeliveryIsInOrder(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver(http.StatusServiceUnavailable)
+	defer receiver.Close()
+	withTestWebhook(s, receiver.URL)
+
+	events := []string{api.WebhookBrewStarted, api.WebhookStepChanged, api.WebhookBrewFinished}
+	for _, event := range events {
+		s.sendWebhooks(event, nil)
+	}
+
+	retried := nextDelivery(t, deliveries)
+	for _, event := range events {
+		delivery := nextDelivery(t, deliveries)
+		if delivery.event.Type != event {
+			t.Fatal("webhook was delivered out of order:", delivery.event.Type)
+		}
+		if event == api.WebhookBrewStarted && delivery.event.ID != retried.event.ID {
+			t.Error("retry was not delivered before the next event")
+		}
+	}
+}
+
+func TestWebhookEventsFilter(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver()
+	defer receiver.Close()
+	withTestWebhook(s, receiver.URL, api.WebhookBrewFinished)
+
+	s.sendWebhooks(api.WebhookStateChanged, nil)
+	noDelivery(t, deliveries)
+
+	s.sendWebhooks(api.WebhookBrewFinished, nil)
+	delivery := nextDelivery(t, deliveries)
+	if delivery.event.Type != api.WebhookBrewFinished || delivery.event.Dripper != s.Name {
+		t.Error("subscribed event was not delivered:", string(delivery.body))
+	}
+}
+
+func TestSendBrewWebhooks(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver()
+	defer receiver.Close()
+	withTestWebhook(s, receiver.URL)
+
+	expected := []struct {
+		status brew.Status
+		event  string
+	}{
+		{brew.Status{State: brew.StatusRunning, Step: 0}, api.WebhookBrewStarted},
+		{brew.Status{State: brew.StatusRunning, Step: 0}, ""},
+		{brew.Status{State: brew.StatusRunning, Step: 1}, api.WebhookStepChanged},
+		{brew.Status{State: brew.StatusPaused, Step: 1}, ""},
+		{brew.Status{State: brew.StatusRunning, Step: 1}, ""},
+		{brew.Status{State: brew.StatusFinished, Step: 1}, api.WebhookBrewFinished},
+	}
+
+	for _, e := range expected {
+		s.sendBrewWebhooks(e.status)
+		if e.event == "" {
+			noDelivery(t, deliveries)
+			continue
+		}
+
+		delivery := nextDelivery(t, deliveries)
+		if delivery.event.Type != e.event {
+			t.Error("wrong event delivered for", e.status.State, delivery.event.Type)
+		}
+	}
+}
+
+func TestRecordMotorResult(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	receiver, deliveries := withTestWebhookReceiver()
+	defer receiver.Close()
+	withTestWebhook(s, receiver.URL)
+
+	s.recordMotorResult("on", errors.New("i2c bus error"))
+	delivery := nextDelivery(t, deliveries)
+	if delivery.event.Type != api.WebhookMotorError {
+		t.Error("motor error was not delivered:", string(delivery.body))
+	}
+
+	s.recordMotorResult("speed", errors.New("i2c bus error"))
+	noDelivery(t, deliveries)
+
+	s.recordMotorResult("speed", nil)
+	s.recordMotorResult("off", errors.New("i2c bus error"))
+	nextDelivery(t, deliveries)
+}
@@ -0,0 +1,178 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventSnapshot is sent to WebSocket clients when they connect so they
+	// start out in sync with the dripper.
+	eventSnapshot = "snapshot"
+
+	// pongWait is how long a WebSocket client has to answer a ping before it
+	// is disconnected.
+	pongWait = 2 * heartbeatInterval
+
+	// writeWait is how long a single write to a WebSocket client may take.
+	writeWait = 10 * time.Second
+)
+
+// upgrader upgrades HTTP requests to WebSocket connections.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// GetWebSocket upgrades the request to a WebSocket control channel. Clients
+// send commands mirroring the REST dripper API and receive acknowledgements
+// along with every dripper event. Commands are refused unless the request was
+// sent with the operator role.
+func (s *Server) GetWebSocket(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not upgrade websocket")
+		return
+	}
+	defer conn.Close()
+
+	startedBy := requester(c)
+	operator := s.hasRole(c, api.RoleOperator)
+	_, sub := s.Events.Subscribe(0)
+	defer s.Events.Unsubscribe(sub)
+
+	acks := make(chan api.Message, subscriptionBuffer)
+	quit := make(chan struct{})
+
+	var writerWG sync.WaitGroup
+	writerWG.Add(1)
+	go s.writeWebSocket(conn, sub, acks, quit, &writerWG)
+	defer writerWG.Wait()
+	defer close(quit)
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var cmd api.Command
+		err := conn.ReadJSON(&cmd)
+		if err != nil {
+			return
+		}
+
+		var ack api.CommandAck
+		if operator {
+			ack = s.handleCommand(cmd, startedBy)
+		} else {
+			ack = api.CommandAck{
+				ID:      cmd.ID,
+				Command: cmd.Command,
+				Error:   "the operator role is required",
+				Dripper: s.dripperStatus(),
+			}
+		}
+
+		select {
+		case acks <- api.Message{Type: api.MessageAck, Ack: &ack}:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// writeWebSocket is the only goroutine writing to a WebSocket connection. It
+// sends the initial snapshot, events, acknowledgements and keepalive pings.
+func (s *Server) writeWebSocket(conn *websocket.Conn, sub *Subscription, acks chan api.Message, quit chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	// Closing the connection unblocks the reader if writing fails.
+	defer conn.Close()
+
+	ping := time.NewTicker(heartbeatInterval)
+	defer ping.Stop()
+
+	snapshot := api.Event{
+		Type: eventSnapshot,
+		Time: time.Now(),
+		Data: s.dripperStatus(),
+	}
+	err := writeMessage(conn, api.Message{Type: api.MessageEvent, Event: &snapshot})
+	if err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-quit:
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			err = writeMessage(conn, api.Message{Type: api.MessageEvent, Event: &event})
+		case msg := <-acks:
+			err = writeMessage(conn, msg)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeMessage writes a single message to a WebSocket connection.
+func writeMessage(conn *websocket.Conn, msg api.Message) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(msg)
+}
+
+// handleCommand applies a command received over the control channel to the
+// dripper and returns its acknowledgement. Brew sessions started by the
+// command are attributed to startedBy.
+func (s *Server) handleCommand(cmd api.Command, startedBy string) api.CommandAck {
+	var err error
+	switch cmd.Command {
+	case api.CommandRun:
+		err = s.runDripper()
+		if err == nil {
+			s.beginSession(startedBy, nil)
+		}
+	case api.CommandDrip:
+		err = s.dripDripper(cmd.DripsPerMinute)
+		if err == nil {
+			s.beginSession(startedBy, nil)
+		}
+	case api.CommandOff:
+		err = s.offDripper()
+	case api.CommandSetRate:
+		err = s.setDripperRate(cmd.DripsPerMinute)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd.Command)
+	}
+
+	ack := api.CommandAck{
+		ID:      cmd.ID,
+		Command: cmd.Command,
+		OK:      err == nil,
+		Dripper: s.dripperStatus(),
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	return ack
+}
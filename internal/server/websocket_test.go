@@ -0,0 +1,118 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/betterengineering/cold-brew/api"
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketCommandsAreAcknowledged(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.Dripper.Off()
+
+	r := withTestRouter()
+	r.GET("/ws", s.GetWebSocket)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal("could not connect to websocket:", err)
+	}
+	defer conn.Close()
+
+	msg := api.Message{}
+	err = conn.ReadJSON(&msg)
+	if err != nil || msg.Type != api.MessageEvent || msg.Event.Type != eventSnapshot {
+		t.Fatal("snapshot was not sent on connect")
+	}
+
+	err = conn.WriteJSON(api.Command{ID: "1", Command: api.CommandRun})
+	if err != nil {
+		t.Fatal("could not send command:", err)
+	}
+
+	ack := withNextAck(t, conn)
+	if ack.ID != "1" || !ack.OK || ack.Dripper.State != dripper.RUN {
+		t.Error("run command was not acknowledged:", ack)
+	}
+
+	err = conn.WriteJSON(api.Command{ID: "2", Command: api.CommandDrip, DripsPerMinute: 500})
+	if err != nil {
+		t.Fatal("could not send command:", err)
+	}
+
+	ack = withNextAck(t, conn)
+	if ack.ID != "2" || ack.OK || ack.Error == "" {
+		t.Error("invalid drip command was acknowledged as ok:", ack)
+	}
+}
+
+func TestWebSocketCommandsNeedOperator(t *testing.T) {
+	s, dir, err := withTestServerStruct()
+	if err != nil {
+		t.Fatal("could not create test server struct:", err)
+	}
+	defer cleanUpTempDatabase(dir)
+
+	err = withTestDripper(s)
+	if err != nil {
+		t.Fatal("could not create test dripper:", err)
+	}
+	defer s.Dripper.Off()
+
+	s.Config.Auth = withTestAuthConfig()
+	r := withTestRouter()
+	r.Use(s.Authenticate)
+	r.GET("/ws", s.GetWebSocket)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal("could not connect to websocket with public reads:", err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(api.Command{ID: "1", Command: api.CommandRun})
+	if err != nil {
+		t.Fatal("could not send command:", err)
+	}
+
+	ack := withNextAck(t, conn)
+	if ack.OK || ack.Error == "" || s.Dripper.GetState() != dripper.OFF {
+		t.Error("command was run without the operator role:", ack)
+	}
+}
+
+// withNextAck reads messages from the connection, skipping events, until an
+// acknowledgement is received.
+func withNextAck(t *testing.T, conn *websocket.Conn) api.CommandAck {
+	for {
+		msg := api.Message{}
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatal("could not read message:", err)
+		}
+
+		if msg.Type == api.MessageAck {
+			return *msg.Ack
+		}
+	}
+}
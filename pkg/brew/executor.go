@@ -0,0 +1,660 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package brew
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// StatusIdle means the executor has never brewed a recipe.
+	StatusIdle = "idle"
+
+	// StatusRunning means the executor is walking the steps of a recipe.
+	StatusRunning = "running"
+
+	// StatusPaused means the executor has stopped the pump and is waiting to
+	// be resumed.
+	StatusPaused = "paused"
+
+	// StatusFinished means every step of the last recipe was completed.
+	StatusFinished = "finished"
+
+	// StatusAborted means the last recipe was aborted before it finished.
+	StatusAborted = "aborted"
+
+	// StatusFailed means the last recipe stopped because the dripper returned
+	// an error.
+	StatusFailed = "failed"
+)
+
+var (
+	// ErrBusy is returned when a recipe is started while another one is still
+	// running or paused.
+	ErrBusy = errors.New("a recipe is already being brewed")
+
+	// ErrNotRunning is returned when a command is sent to the executor while
+	// no recipe is being brewed.
+	ErrNotRunning = errors.New("no recipe is being brewed")
+
+	// ErrNotPaused is returned when resuming an executor which is not paused.
+	ErrNotPaused = errors.New("the recipe is not paused")
+
+	// ErrNotCalibrated is returned when a recipe contains a step which ends
+	// on a volume the dripper can not measure.
+	ErrNotCalibrated = errors.New("the dripper is not calibrated to measure the volume of this step")
+)
+
+// volumePollInterval is how often the dispensed volume is checked for steps
+// which end on a volume.
+const volumePollInterval = 100 * time.Millisecond
+
+// command is an instruction sent to the executor goroutine.
+type command int
+
+const (
+	pauseCommand command = iota
+	resumeCommand
+	skipCommand
+	abortCommand
+)
+
+// request is a command along with a channel which is closed once the executor
+// goroutine has handled it.
+type request struct {
+	cmd command
+	ack chan struct{}
+}
+
+// stepResult is the way a step ended.
+type stepResult int
+
+const (
+	stepCompleted stepResult = iota
+	stepSkipped
+	stepAborted
+	stepFailed
+)
+
+// Controller is the subset of the dripper used by the executor. It allows the
+// dripper to be replaced in tests.
+type Controller interface {
+	Run() error
+	Drip(dripsPerMin float64) error
+	Off() error
+	GetDispensedVolume() float64
+	IsCalibratedFor(state string) bool
+}
+
+// Status is a snapshot of the progress of the executor.
+type Status struct {
+	// State is the state of the executor.
+	State string `json:"state"`
+
+	// Recipe is the recipe being brewed or the last one brewed.
+	Recipe *Recipe `json:"recipe,omitempty"`
+
+	// Step is the zero based index of the current step.
+	Step int `json:"step"`
+
+	// Elapsed is the number of seconds the recipe has been brewing, not
+	// counting time spent paused.
+	Elapsed float64 `json:"elapsed"`
+
+	// StepElapsed is the number of seconds the current step has been running.
+	StepElapsed float64 `json:"stepElapsed"`
+
+	// StepRemaining is the number of seconds left in the current step.
+	StepRemaining float64 `json:"stepRemaining"`
+
+	// StepDispensed is the number of millilitres dispensed during the current
+	// step.
+	StepDispensed float64 `json:"stepDispensed"`
+
+	// Remaining is the number of seconds left in the recipe.
+	Remaining float64 `json:"remaining"`
+
+	// Error is the reason the last recipe failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Listener is a callback which receives the status of the executor whenever a
+// step begins, the recipe is paused or resumed, or the recipe ends. Listeners
+// are called synchronously from the executor goroutine, so they must not block
+// or send commands to the executor.
+type Listener func(Status)
+
+// Executor brews a recipe by walking its steps on its own goroutine. Only one
+// recipe can be brewed at a time.
+type Executor struct {
+	// controller is the dripper the recipe steps are applied to.
+	controller Controller
+
+	// A wait group used to ensure the executor goroutine has been stopped
+	// successfully.
+	executorWG sync.WaitGroup
+
+	// A channel used to send commands to the executor goroutine.
+	commands chan request
+
+	// A channel which is closed when the executor goroutine returns.
+	done chan struct{}
+
+	// mutex is used to access the fields below across multiple goroutines.
+	mutex sync.Mutex
+
+	// state is the state of the executor.
+	state string
+
+	// recipe is the recipe being brewed.
+	recipe *Recipe
+
+	// step is the index of the current step.
+	step int
+
+	// startedAt is when the recipe was started.
+	startedAt time.Time
+
+	// finishedAt is when the recipe finished, was aborted or failed.
+	finishedAt time.Time
+
+	// pausedAt is when the executor was last paused.
+	pausedAt time.Time
+
+	// pausedFor is the total time the recipe spent paused.
+	pausedFor time.Duration
+
+	// stepStartedAt is when the current step last started running.
+	stepStartedAt time.Time
+
+	// stepElapsed is the time the current step ran before it was last paused.
+	stepElapsed time.Duration
+
+	// stepVolumeStart is the dispensed volume of the dripper when the current
+	// step began.
+	stepVolumeStart float64
+
+	// err is the reason the last recipe failed.
+	err error
+
+	// listenersMutex is used to access the listeners across multiple
+	// goroutines.
+	listenersMutex sync.Mutex
+
+	// listeners receive the status of the executor as the recipe progresses.
+	listeners []Listener
+}
+
+// NewExecutor creates a new executor which controls the supplied dripper.
+func NewExecutor(controller Controller) *Executor {
+	return &Executor{
+		controller: controller,
+		commands:   make(chan request),
+		state:      StatusIdle,
+	}
+}
+
+// Start brews the supplied recipe. It returns ErrBusy if a recipe is already
+// being brewed.
+func (e *Executor) Start(recipe Recipe) error {
+	return e.StartAt(recipe, 0, 0, 0)
+}
+
+// StartAt brews the supplied recipe from the middle of one of its steps, as if
+// the step had already been running for the supplied duration and had already
+// dispensed the supplied number of millilitres, which count towards a step
+// ending on a volume. It returns ErrBusy if a recipe is already being brewed.
+func (e *Executor) StartAt(recipe Recipe, step int, elapsed time.Duration, dispensed float64) error {
+	err := recipe.Validate()
+	if err != nil {
+		return err
+	}
+
+	if step < 0 || step >= len(recipe.Steps) || elapsed < 0 || dispensed < 0 {
+		return fmt.Errorf("the recipe can not be started at step %d", step+1)
+	}
+
+	for i, step := range recipe.Steps {
+		if step.Volume > 0 && !e.controller.IsCalibratedFor(step.Action) {
+			return fmt.Errorf("step %d: %v", i+1, ErrNotCalibrated)
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.isActive() {
+		return ErrBusy
+	}
+
+	// The recipe is treated as having run every step before the first one.
+	offset := elapsed
+	for _, previous := range recipe.Steps[:step] {
+		offset += time.Duration(previous.Seconds * float64(time.Second))
+	}
+
+	now := time.Now()
+	e.state = StatusRunning
+	e.recipe = &recipe
+	e.step = step
+	e.startedAt = now.Add(-offset)
+	e.finishedAt = time.Time{}
+	e.pausedFor = 0
+	e.stepStartedAt = now
+	e.stepElapsed = elapsed
+	e.stepVolumeStart = e.controller.GetDispensedVolume() - dispensed
+	e.err = nil
+	e.done = make(chan struct{})
+
+	e.executorWG.Add(1)
+	go e.run(recipe, step, elapsed, dispensed, e.done)
+
+	return nil
+}
+
+// Pause stops the pump and holds the current step until it is resumed.
+func (e *Executor) Pause() error {
+	return e.send(pauseCommand)
+}
+
+// Resume continues a paused recipe where it left off.
+func (e *Executor) Resume() error {
+	e.mutex.Lock()
+	paused := e.state == StatusPaused
+	e.mutex.Unlock()
+
+	if !paused {
+		return ErrNotPaused
+	}
+
+	return e.send(resumeCommand)
+}
+
+// Skip ends the current step and moves on to the next one.
+func (e *Executor) Skip() error {
+	return e.send(skipCommand)
+}
+
+// Abort stops the pump and ends the recipe.
+func (e *Executor) Abort() error {
+	return e.send(abortCommand)
+}
+
+// Wait blocks until the executor goroutine has returned.
+func (e *Executor) Wait() {
+	e.executorWG.Wait()
+}
+
+// Active reports whether a recipe is running or paused. While the executor is
+// active it owns the dripper.
+func (e *Executor) Active() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.isActive()
+}
+
+// Status returns a snapshot of the progress of the executor.
+func (e *Executor) Status() Status {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	status := Status{
+		State:  e.state,
+		Recipe: e.recipe,
+		Step:   e.step,
+	}
+
+	if e.err != nil {
+		status.Error = e.err.Error()
+	}
+
+	if e.recipe == nil {
+		return status
+	}
+
+	now := time.Now()
+	if !e.isActive() {
+		now = e.finishedAt
+	}
+
+	paused := e.pausedFor
+	if e.state == StatusPaused {
+		paused += now.Sub(e.pausedAt)
+	}
+	status.Elapsed = now.Sub(e.startedAt).Seconds() - paused.Seconds()
+
+	stepElapsed := e.stepElapsed
+	if e.state == StatusRunning {
+		stepElapsed += now.Sub(e.stepStartedAt)
+	}
+	status.StepElapsed = stepElapsed.Seconds()
+
+	if !e.isActive() {
+		return status
+	}
+
+	status.StepDispensed = e.controller.GetDispensedVolume() - e.stepVolumeStart
+
+	step := e.recipe.Steps[e.step]
+	if step.Seconds > status.StepElapsed {
+		status.StepRemaining = step.Seconds - status.StepElapsed
+	}
+
+	status.Remaining = status.StepRemaining
+	for _, next := range e.recipe.Steps[e.step+1:] {
+		status.Remaining += next.Seconds
+	}
+
+	return status
+}
+
+// AddListener registers a listener which receives the status of the executor
+// as every recipe progresses.
+func (e *Executor) AddListener(l Listener) {
+	e.listenersMutex.Lock()
+	e.listeners = append(e.listeners, l)
+	e.listenersMutex.Unlock()
+}
+
+// notify sends the current status to every listener.
+func (e *Executor) notify() {
+	e.listenersMutex.Lock()
+	listeners := e.listeners
+	e.listenersMutex.Unlock()
+
+	if len(listeners) == 0 {
+		return
+	}
+
+	status := e.Status()
+	for _, l := range listeners {
+		l(status)
+	}
+}
+
+// isActive reports whether a recipe is running or paused. The caller must hold
+// the mutex.
+func (e *Executor) isActive() bool {
+	return e.state == StatusRunning || e.state == StatusPaused
+}
+
+// send delivers a command to the executor goroutine and waits for it to be
+// handled.
+func (e *Executor) send(cmd command) error {
+	e.mutex.Lock()
+	active := e.isActive()
+	done := e.done
+	e.mutex.Unlock()
+
+	if !active {
+		return ErrNotRunning
+	}
+
+	req := request{
+		cmd: cmd,
+		ack: make(chan struct{}),
+	}
+
+	select {
+	case e.commands <- req:
+	case <-done:
+		return ErrNotRunning
+	}
+
+	select {
+	case <-req.ack:
+	case <-done:
+	}
+
+	return nil
+}
+
+// run is the executor goroutine which walks the steps of the recipe from the
+// first one, which has already been running for the supplied duration and
+// dispensed the supplied volume.
+func (e *Executor) run(recipe Recipe, first int, elapsed time.Duration, dispensed float64, done chan struct{}) {
+	defer e.executorWG.Done()
+	defer close(done)
+
+	// ack is a skip request which is acknowledged once the next step begins.
+	var ack chan struct{}
+	for i := first; i < len(recipe.Steps); i++ {
+		if i > first {
+			elapsed = 0
+			dispensed = 0
+		}
+
+		e.beginStep(i, elapsed, dispensed)
+		e.notify()
+		if ack != nil {
+			close(ack)
+		}
+
+		result, req, err := e.runStep(recipe.Steps[i], elapsed)
+		ack = req.ack
+
+		switch result {
+		case stepAborted:
+			e.finish(StatusAborted, e.controller.Off())
+			e.notify()
+			if ack != nil {
+				close(ack)
+			}
+			return
+		case stepFailed:
+			e.controller.Off()
+			e.finish(StatusFailed, err)
+			e.notify()
+			if ack != nil {
+				close(ack)
+			}
+			return
+		}
+	}
+
+	e.finish(StatusFinished, e.controller.Off())
+	e.notify()
+	if ack != nil {
+		close(ack)
+	}
+}
+
+// runStep applies a step to the dripper and waits for it to end while handling
+// commands. The step ends early by the time it has already been running. A
+// skip or abort request which ended the step is returned without being
+// acknowledged.
+func (e *Executor) runStep(step Step, elapsed time.Duration) (stepResult, request, error) {
+	err := e.apply(step)
+	if err != nil {
+		return stepFailed, request{}, err
+	}
+
+	// Steps ending only on a volume have no timer. Off steps without any
+	// duration end immediately.
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if step.Seconds > 0 || step.Volume == 0 {
+		timer = time.NewTimer(time.Duration(step.Seconds*float64(time.Second)) - elapsed)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var poll <-chan time.Time
+	if step.Volume > 0 {
+		ticker := time.NewTicker(volumePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-timeout:
+			return stepCompleted, request{}, nil
+		case <-poll:
+			if e.stepDispensed() >= step.Volume {
+				return stepCompleted, request{}, nil
+			}
+		case req := <-e.commands:
+			switch req.cmd {
+			case skipCommand:
+				return stepSkipped, req, nil
+			case abortCommand:
+				return stepAborted, req, nil
+			case resumeCommand:
+				close(req.ack)
+			case pauseCommand:
+				if timer != nil && !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				elapsed = e.pause()
+
+				err = e.controller.Off()
+				e.notify()
+				close(req.ack)
+				if err != nil {
+					return stepFailed, request{}, err
+				}
+
+				result, req := e.waitForResume()
+				if result != stepCompleted {
+					return result, req, nil
+				}
+
+				err = e.apply(step)
+				e.notify()
+				close(req.ack)
+				if err != nil {
+					return stepFailed, request{}, err
+				}
+
+				if timer != nil {
+					timer.Reset(time.Duration(step.Seconds*float64(time.Second)) - elapsed)
+				}
+			}
+		}
+	}
+}
+
+// waitForResume blocks a paused step until it is resumed, skipped or aborted.
+// It returns stepCompleted along with the resume request if the step was
+// resumed.
+func (e *Executor) waitForResume() (stepResult, request) {
+	for req := range e.commands {
+		switch req.cmd {
+		case resumeCommand:
+			e.resume()
+			return stepCompleted, req
+		case skipCommand:
+			e.resume()
+			return stepSkipped, req
+		case abortCommand:
+			return stepAborted, req
+		default:
+			close(req.ack)
+		}
+	}
+
+	return stepAborted, request{}
+}
+
+// apply sets the dripper to the action of the step.
+func (e *Executor) apply(step Step) error {
+	logrus.WithFields(logrus.Fields{
+		"action":         step.Action,
+		"dripsPerMinute": step.DripsPerMinute,
+		"seconds":        step.Seconds,
+	}).Info("applying recipe step")
+
+	switch step.Action {
+	case ActionRun:
+		return e.controller.Run()
+	case ActionDrip:
+		return e.controller.Drip(step.DripsPerMinute)
+	default:
+		return e.controller.Off()
+	}
+}
+
+// beginStep records the start of a step which has already been running for
+// the supplied duration and dispensed the supplied volume.
+func (e *Executor) beginStep(i int, elapsed time.Duration, dispensed float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.step = i
+	e.stepStartedAt = time.Now()
+	e.stepElapsed = elapsed
+	e.stepVolumeStart = e.controller.GetDispensedVolume() - dispensed
+}
+
+// stepDispensed returns the number of millilitres dispensed during the current
+// step.
+func (e *Executor) stepDispensed() float64 {
+	e.mutex.Lock()
+	start := e.stepVolumeStart
+	e.mutex.Unlock()
+
+	return e.controller.GetDispensedVolume() - start
+}
+
+// pause records that the current step was paused and returns how long the step
+// had been running.
+func (e *Executor) pause() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	e.state = StatusPaused
+	e.pausedAt = now
+	e.stepElapsed += now.Sub(e.stepStartedAt)
+
+	return e.stepElapsed
+}
+
+// resume records that the current step is running again.
+func (e *Executor) resume() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	e.state = StatusRunning
+	e.pausedFor += now.Sub(e.pausedAt)
+	e.stepStartedAt = now
+}
+
+// finish records the end of the recipe.
+func (e *Executor) finish(state string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if err != nil && state != StatusFailed {
+		state = StatusFailed
+	}
+
+	now := time.Now()
+	if e.state == StatusPaused {
+		e.pausedFor += now.Sub(e.pausedAt)
+	} else {
+		e.stepElapsed += now.Sub(e.stepStartedAt)
+	}
+
+	e.state = state
+	e.finishedAt = now
+	e.err = err
+
+	logrus.WithFields(logrus.Fields{
+		"recipe": e.recipe.Name,
+		"state":  state,
+		"error":  err,
+	}).Info("recipe ended")
+}
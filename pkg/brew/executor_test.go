@@ -0,0 +1,301 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package brew
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeController struct {
+	calls  []string
+	volume float64
+	mutex  sync.Mutex
+}
+
+func (f *fakeController) Run() error {
+	f.record("run")
+	return nil
+}
+
+func (f *fakeController) Drip(dripsPerMin float64) error {
+	f.record("drip")
+	return nil
+}
+
+func (f *fakeController) Off() error {
+	f.record("off")
+	return nil
+}
+
+func (f *fakeController) GetDispensedVolume() float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Every call dispenses a little more water so volume steps end.
+	f.volume += 10
+	return f.volume
+}
+
+func (f *fakeController) IsCalibratedFor(state string) bool {
+	return state != ActionRun
+}
+
+func (f *fakeController) record(call string) {
+	f.mutex.Lock()
+	f.calls = append(f.calls, call)
+	f.mutex.Unlock()
+}
+
+func (f *fakeController) Calls() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string{}, f.calls...)
+}
+
+func TestExecutorRunsEveryStep(t *testing.T) {
+	controller := &fakeController{}
+	e := NewExecutor(controller)
+
+	err := e.Start(withTestRecipe(0.01))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	e.Wait()
+
+	expected := []string{"run", "drip", "off", "off"}
+	if !reflect.DeepEqual(controller.Calls(), expected) {
+		t.Error("steps were not applied in order:", controller.Calls())
+	}
+
+	if e.Status().State != StatusFinished {
+		t.Error("executor did not finish")
+	}
+}
+
+func TestExecutorStartAt(t *testing.T) {
+	controller := &fakeController{}
+	e := NewExecutor(controller)
+
+	err := e.StartAt(withTestRecipe(10), 1, 10*time.Second, 0)
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	e.Wait()
+
+	expected := []string{"drip", "off", "off"}
+	if !reflect.DeepEqual(controller.Calls(), expected) {
+		t.Error("recipe did not start at the requested step:", controller.Calls())
+	}
+
+	if e.Status().Elapsed < 20 {
+		t.Error("elapsed time did not include the steps before the first one")
+	}
+
+	err = e.StartAt(withTestRecipe(10), 3, 0, 0)
+	if err == nil {
+		t.Error("starting past the last step did not return an error")
+	}
+}
+
+func TestExecutorStartWhenBusy(t *testing.T) {
+	e := NewExecutor(&fakeController{})
+
+	err := e.Start(withTestRecipe(10))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	defer e.Wait()
+	defer e.Abort()
+
+	err = e.Start(withTestRecipe(10))
+	if err != ErrBusy {
+		t.Error("starting a second recipe did not return busy")
+	}
+}
+
+func TestExecutorPauseAndResume(t *testing.T) {
+	controller := &fakeController{}
+	e := NewExecutor(controller)
+
+	err := e.Start(withTestRecipe(10))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	defer e.Wait()
+	defer e.Abort()
+
+	err = e.Pause()
+	if err != nil {
+		t.Fatal("could not pause recipe:", err)
+	}
+
+	status := e.Status()
+	if status.State != StatusPaused {
+		t.Error("executor was not paused")
+	}
+
+	if status.StepRemaining <= 0 || status.Remaining <= status.StepRemaining {
+		t.Error("remaining time was not reported while paused")
+	}
+
+	err = e.Resume()
+	if err != nil {
+		t.Fatal("could not resume recipe:", err)
+	}
+
+	expected := []string{"run", "off", "run"}
+	if !reflect.DeepEqual(controller.Calls(), expected) {
+		t.Error("pausing did not stop and reapply the step:", controller.Calls())
+	}
+}
+
+func TestExecutorSkip(t *testing.T) {
+	e := NewExecutor(&fakeController{})
+
+	err := e.Start(withTestRecipe(10))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	defer e.Wait()
+	defer e.Abort()
+
+	err = e.Skip()
+	if err != nil {
+		t.Fatal("could not skip step:", err)
+	}
+
+	if e.Status().Step != 1 {
+		t.Error("executor did not move on to the next step")
+	}
+}
+
+func TestExecutorAbort(t *testing.T) {
+	controller := &fakeController{}
+	e := NewExecutor(controller)
+
+	err := e.Start(withTestRecipe(10))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+
+	err = e.Abort()
+	if err != nil {
+		t.Fatal("could not abort recipe:", err)
+	}
+	e.Wait()
+
+	if e.Status().State != StatusAborted {
+		t.Error("executor was not aborted")
+	}
+
+	calls := controller.Calls()
+	if calls[len(calls)-1] != "off" {
+		t.Error("aborting did not turn the dripper off")
+	}
+
+	if e.Abort() != ErrNotRunning {
+		t.Error("aborting an inactive executor did not return not running")
+	}
+}
+
+func TestExecutorEndsVolumeSteps(t *testing.T) {
+	controller := &fakeController{}
+	e := NewExecutor(controller)
+
+	recipe := Recipe{
+		Name: "volume",
+		Steps: []Step{
+			{Action: ActionDrip, DripsPerMinute: 60, Volume: 20},
+		},
+	}
+
+	err := e.Start(recipe)
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	e.Wait()
+
+	if e.Status().State != StatusFinished {
+		t.Error("volume step did not end")
+	}
+}
+
+func TestExecutorStartAtCountsDispensedVolume(t *testing.T) {
+	controller := &fakeController{}
+	e := NewExecutor(controller)
+
+	recipe := Recipe{
+		Name: "volume",
+		Steps: []Step{
+			{Action: ActionDrip, DripsPerMinute: 60, Volume: 1000},
+		},
+	}
+
+	err := e.StartAt(recipe, 0, 0, 995)
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	e.Wait()
+
+	if e.Status().State != StatusFinished || controller.volume > 100 {
+		t.Error("volume dispensed before the step was started again was not counted:", controller.volume)
+	}
+}
+
+func TestExecutorStartWhenNotCalibrated(t *testing.T) {
+	e := NewExecutor(&fakeController{})
+
+	recipe := Recipe{
+		Name: "volume",
+		Steps: []Step{
+			{Action: ActionRun, Volume: 20},
+		},
+	}
+
+	err := e.Start(recipe)
+	if err == nil {
+		t.Error("volume step without calibration did not return an error")
+	}
+}
+
+func TestExecutorNotifiesListeners(t *testing.T) {
+	e := NewExecutor(&fakeController{})
+
+	var states []string
+	var mutex sync.Mutex
+	e.AddListener(func(status Status) {
+		mutex.Lock()
+		states = append(states, status.State)
+		mutex.Unlock()
+	})
+
+	err := e.Start(withTestRecipe(0.01))
+	if err != nil {
+		t.Fatal("could not start recipe:", err)
+	}
+	e.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	expected := []string{StatusRunning, StatusRunning, StatusRunning, StatusFinished}
+	if !reflect.DeepEqual(states, expected) {
+		t.Error("listeners were not notified of every step:", states)
+	}
+}
+
+func withTestRecipe(seconds float64) Recipe {
+	return Recipe{
+		Name: "test",
+		Steps: []Step{
+			{Action: ActionRun, Seconds: seconds},
+			{Action: ActionDrip, DripsPerMinute: 60, Seconds: seconds},
+			{Action: ActionOff},
+		},
+	}
+}
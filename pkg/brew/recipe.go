@@ -0,0 +1,120 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+// Package brew provides repeatable, multi-step brew programs for the cold brew
+// dripper.
+package brew
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+)
+
+const (
+	// ActionRun turns the pump fully on for the duration of the step.
+	ActionRun = "run"
+
+	// ActionDrip drips at the step drip rate for the duration of the step.
+	ActionDrip = "drip"
+
+	// ActionOff stops the pump for the duration of the step.
+	ActionOff = "off"
+)
+
+// Step is a single instruction of a recipe.
+type Step struct {
+	// Action is what the dripper does during the step. It is one of run, drip
+	// or off.
+	Action string `json:"action" binding:"required"`
+
+	// DripsPerMinute is the drip rate used by drip steps.
+	DripsPerMinute float64 `json:"dripsPerMinute,omitempty"`
+
+	// Seconds is how long the step lasts.
+	Seconds float64 `json:"seconds,omitempty"`
+
+	// Volume is the amount of water in millilitres after which the step ends.
+	Volume float64 `json:"volume,omitempty"`
+}
+
+// Recipe is a named, ordered list of steps which make up a brew.
+type Recipe struct {
+	// ID uniquely identifies the recipe in the database.
+	ID string `json:"id"`
+
+	// Name is a human readable name for the recipe.
+	Name string `json:"name" binding:"required"`
+
+	// Description is an optional free form description of the recipe.
+	Description string `json:"description,omitempty"`
+
+	// Steps are the steps of the recipe in the order they are run.
+	Steps []Step `json:"steps" binding:"required"`
+
+	// SettingsProfileID names the settings profile the dripper switches to
+	// before the recipe is brewed. The settings are left alone if it is empty.
+	SettingsProfileID string `json:"settingsProfileId,omitempty"`
+
+	// CreatedAt is when the recipe was first saved.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// UpdatedAt is when the recipe was last saved.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Validate ensures the recipe can be brewed.
+func (r Recipe) Validate() error {
+	if r.Name == "" {
+		return errors.New("name must not be empty")
+	}
+
+	if len(r.Steps) == 0 {
+		return errors.New("recipe must have at least one step")
+	}
+
+	for i, step := range r.Steps {
+		err := step.Validate()
+		if err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate ensures the step is well formed and will eventually end.
+func (s Step) Validate() error {
+	if s.Seconds < 0 {
+		return errors.New("seconds must not be negative")
+	}
+
+	if s.Volume < 0 {
+		return errors.New("volume must not be negative")
+	}
+
+	switch s.Action {
+	case ActionRun:
+		if s.Seconds == 0 && s.Volume == 0 {
+			return errors.New("run steps must set seconds or volume")
+		}
+	case ActionDrip:
+		if s.DripsPerMinute <= 0 || s.DripsPerMinute > dripper.MaxDripsPerMinute {
+			return fmt.Errorf("dripsPerMinute must be greater than 0 and must not exceed %v", dripper.MaxDripsPerMinute)
+		}
+
+		if s.Seconds == 0 && s.Volume == 0 {
+			return errors.New("drip steps must set seconds or volume")
+		}
+	case ActionOff:
+		if s.Volume != 0 {
+			return errors.New("off steps must not set volume")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package brew
+
+import (
+	"testing"
+)
+
+func TestRecipeValidateWhenRecipeIsValid(t *testing.T) {
+	recipe := Recipe{
+		Name: "kyoto",
+		Steps: []Step{
+			{Action: ActionRun, Seconds: 20},
+			{Action: ActionDrip, DripsPerMinute: 40, Seconds: 10800},
+			{Action: ActionDrip, DripsPerMinute: 60, Volume: 1200},
+			{Action: ActionOff},
+		},
+	}
+
+	err := recipe.Validate()
+	if err != nil {
+		t.Error("valid recipe returned an error:", err)
+	}
+}
+
+func TestRecipeValidateWhenRecipeHasNoSteps(t *testing.T) {
+	recipe := Recipe{Name: "empty"}
+
+	err := recipe.Validate()
+	if err == nil {
+		t.Error("recipe without steps did not return an error")
+	}
+}
+
+func TestStepValidateWhenStepIsInvalid(t *testing.T) {
+	steps := []Step{
+		{Action: "foo", Seconds: 10},
+		{Action: ActionRun},
+		{Action: ActionDrip, DripsPerMinute: 40},
+		{Action: ActionDrip, DripsPerMinute: 300, Seconds: 10},
+		{Action: ActionDrip, DripsPerMinute: 40, Seconds: -1},
+		{Action: ActionOff, Volume: 100},
+	}
+
+	for _, step := range steps {
+		if step.Validate() == nil {
+			t.Errorf("invalid step %+v did not return an error", step)
+		}
+	}
+}
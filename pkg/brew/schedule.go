@@ -0,0 +1,138 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package brew
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper"
+	"github.com/robfig/cron"
+)
+
+// Schedule starts a recipe, or drips at a fixed rate, either once at a future
+// time or repeatedly on a cron schedule.
+type Schedule struct {
+	// ID uniquely identifies the schedule in the database.
+	ID string `json:"id"`
+
+	// Name is a human readable name for the schedule.
+	Name string `json:"name" binding:"required"`
+
+	// At is when a one-off schedule runs.
+	At *time.Time `json:"at,omitempty"`
+
+	// Cron is a standard five field cron expression, such as "0 5 * * *",
+	// evaluated in the local time of the server.
+	Cron string `json:"cron,omitempty"`
+
+	// RecipeID is the recipe started by the schedule.
+	RecipeID string `json:"recipeId,omitempty"`
+
+	// DripsPerMinute is the drip rate started by the schedule when it does not
+	// start a recipe.
+	DripsPerMinute float64 `json:"dripsPerMinute,omitempty"`
+
+	// TargetVolume turns the dripper off once it has dispensed this many
+	// millilitres. It only applies to schedules which drip at a fixed rate.
+	TargetVolume float64 `json:"targetVolume,omitempty"`
+
+	// Disabled schedules are kept but never run.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// LastRunAt is when the schedule last ran.
+	LastRunAt *time.Time `json:"lastRunAt,omitempty"`
+
+	// LastError is why the last run of the schedule failed.
+	LastError string `json:"lastError,omitempty"`
+
+	// NextRunAt is when the schedule runs next. It is filled in whenever the
+	// schedule is returned by the server.
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+
+	// CreatedAt is when the schedule was first saved.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// UpdatedAt is when the schedule was last saved.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Validate ensures the schedule can run.
+func (s Schedule) Validate() error {
+	if s.Name == "" {
+		return errors.New("name must not be empty")
+	}
+
+	if (s.At == nil) == (s.Cron == "") {
+		return errors.New("exactly one of at or cron must be set")
+	}
+
+	if s.Cron != "" {
+		_, err := cron.ParseStandard(s.Cron)
+		if err != nil {
+			return fmt.Errorf("cron is not valid: %v", err)
+		}
+	}
+
+	if (s.RecipeID == "") == (s.DripsPerMinute == 0) {
+		return errors.New("exactly one of recipeId or dripsPerMinute must be set")
+	}
+
+	if s.RecipeID == "" && (s.DripsPerMinute < 0 || s.DripsPerMinute > dripper.MaxDripsPerMinute) {
+		return fmt.Errorf("dripsPerMinute must be greater than 0 and must not exceed %v", dripper.MaxDripsPerMinute)
+	}
+
+	if s.TargetVolume < 0 || (s.TargetVolume > 0 && s.RecipeID != "") {
+		return errors.New("targetVolume must not be negative and can only be set with dripsPerMinute")
+	}
+
+	return nil
+}
+
+// Next returns the first time after the supplied time the schedule runs. It
+// returns false if the schedule will never run again. A schedule never runs
+// again at or before the time it last ran.
+func (s Schedule) Next(after time.Time) (time.Time, bool) {
+	if s.Disabled {
+		return time.Time{}, false
+	}
+
+	if s.At != nil {
+		if s.LastRunAt != nil || !s.At.After(after) {
+			return time.Time{}, false
+		}
+
+		return *s.At, true
+	}
+
+	schedule, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if s.LastRunAt != nil && s.LastRunAt.After(after) {
+		after = *s.LastRunAt
+	}
+
+	next := schedule.Next(after)
+	return next, !next.IsZero()
+}
+
+// Preview returns up to the supplied number of upcoming runs of the schedule
+// after the supplied time.
+func (s Schedule) Preview(after time.Time, count int) []time.Time {
+	runs := []time.Time{}
+	for len(runs) < count {
+		next, ok := s.Next(after)
+		if !ok {
+			break
+		}
+
+		runs = append(runs, next)
+		after = next
+	}
+
+	return runs
+}
@@ -0,0 +1,88 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package brew
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleValidateWhenScheduleIsValid(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+	schedules := []Schedule{
+		{Name: "tomorrow", At: &at, RecipeID: "0123456789abcdef"},
+		{Name: "weekdays", Cron: "0 5 * * 1-5", DripsPerMinute: 40},
+	}
+
+	for _, schedule := range schedules {
+		err := schedule.Validate()
+		if err != nil {
+			t.Errorf("valid schedule %q returned an error: %v", schedule.Name, err)
+		}
+	}
+}
+
+func TestScheduleValidateWhenScheduleIsInvalid(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+	schedules := []Schedule{
+		{At: &at, DripsPerMinute: 40},
+		{Name: "neither", DripsPerMinute: 40},
+		{Name: "both", At: &at, Cron: "0 5 * * *", DripsPerMinute: 40},
+		{Name: "bad cron", Cron: "every morning", DripsPerMinute: 40},
+		{Name: "nothing to start", Cron: "0 5 * * *"},
+		{Name: "too fast", Cron: "0 5 * * *", DripsPerMinute: 500},
+		{Name: "recipe volume", Cron: "0 5 * * *", RecipeID: "0123456789abcdef", TargetVolume: 1000},
+	}
+
+	for _, schedule := range schedules {
+		err := schedule.Validate()
+		if err == nil {
+			t.Errorf("invalid schedule %q did not return an error", schedule.Name)
+		}
+	}
+}
+
+func TestScheduleNextWhenScheduleIsOneOff(t *testing.T) {
+	now := time.Now()
+	at := now.Add(time.Hour)
+	schedule := Schedule{At: &at}
+
+	next, ok := schedule.Next(now)
+	if !ok || !next.Equal(at) {
+		t.Error("one-off schedule did not run at its time")
+	}
+
+	schedule.LastRunAt = &at
+	_, ok = schedule.Next(now)
+	if ok {
+		t.Error("one-off schedule ran more than once")
+	}
+}
+
+func TestScheduleNextWhenScheduleIsCron(t *testing.T) {
+	after := time.Date(2019, time.May, 1, 12, 0, 0, 0, time.Local)
+	schedule := Schedule{Cron: "0 5 * * *"}
+
+	runs := schedule.Preview(after, 3)
+	if len(runs) != 3 {
+		t.Fatal("expected three runs, got", len(runs))
+	}
+
+	expected := time.Date(2019, time.May, 2, 5, 0, 0, 0, time.Local)
+	if !runs[0].Equal(expected) || !runs[2].Equal(expected.AddDate(0, 0, 2)) {
+		t.Error("cron schedule did not run every morning:", runs)
+	}
+
+	lastRun := expected.Add(time.Second)
+	schedule.LastRunAt = &lastRun
+	next, ok := schedule.Next(expected.Add(-10 * time.Minute))
+	if !ok || !next.Equal(expected.AddDate(0, 0, 1)) {
+		t.Error("cron schedule ran again after it already ran:", next)
+	}
+
+	schedule.Disabled = true
+	if len(schedule.Preview(after, 3)) != 0 {
+		t.Error("disabled schedule would still run")
+	}
+}
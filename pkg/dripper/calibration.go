@@ -0,0 +1,310 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotCalibrated is returned when a volume is requested from a dripper
+	// which has no calibration matching its current settings.
+	ErrNotCalibrated = errors.New("the dripper is not calibrated for its current settings")
+
+	// ErrOff is returned when a target is set while the dripper is off.
+	ErrOff = errors.New("the dripper is off")
+)
+
+// Calibration links the raw motor settings to the amount of water the pump
+// actually dispenses. A calibration is only valid for the settings it was
+// measured at.
+type Calibration struct {
+	// MillilitresPerDrip is the measured volume of a single drip pulse.
+	MillilitresPerDrip float64 `json:"millilitresPerDrip"`
+
+	// MillilitresPerSecond is the measured flow of the pump in the run state.
+	MillilitresPerSecond float64 `json:"millilitresPerSecond"`
+
+	// DripSpeed is the drip speed MillilitresPerDrip was measured at.
+	DripSpeed int32 `json:"dripSpeed"`
+
+	// DripDuration is the drip duration MillilitresPerDrip was measured at.
+	DripDuration int64 `json:"dripDuration"`
+
+	// RunSpeed is the run speed MillilitresPerSecond was measured at.
+	RunSpeed int32 `json:"runSpeed"`
+
+	// CalibratedAt is when the calibration was last measured.
+	CalibratedAt time.Time `json:"calibratedAt"`
+}
+
+// MillilitresPerDripAt returns the volume of a single drip pulse for the
+// supplied settings, or zero if the calibration does not apply to them.
+func (c Calibration) MillilitresPerDripAt(settings Settings) float64 {
+	if c.DripSpeed != settings.DripSpeed || c.DripDuration != settings.DripDuration {
+		return 0
+	}
+
+	return c.MillilitresPerDrip
+}
+
+// MillilitresPerSecondAt returns the flow of the pump in the run state for the
+// supplied settings, or zero if the calibration does not apply to them.
+func (c Calibration) MillilitresPerSecondAt(settings Settings) float64 {
+	if c.RunSpeed != settings.RunSpeed {
+		return 0
+	}
+
+	return c.MillilitresPerSecond
+}
+
+// DripsPerMinute converts a flow in millilitres per hour to a drip rate for
+// the supplied settings.
+func (c Calibration) DripsPerMinute(millilitresPerHour float64, settings Settings) (float64, error) {
+	mlPerDrip := c.MillilitresPerDripAt(settings)
+	if mlPerDrip <= 0 {
+		return 0, ErrNotCalibrated
+	}
+
+	return millilitresPerHour / mlPerDrip / secondsPerMin, nil
+}
+
+// MillilitresPerHour converts a drip rate to a flow in millilitres per hour for
+// the supplied settings. It returns zero when the calibration does not apply.
+func (c Calibration) MillilitresPerHour(dripsPerMin float64, settings Settings) float64 {
+	return dripsPerMin * secondsPerMin * c.MillilitresPerDripAt(settings)
+}
+
+// SetCalibration updates the volume calibration of the dripper. It only
+// affects volume dispensed from now on.
+func (d *Dripper) SetCalibration(c Calibration) {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	d.accumulateRun()
+	d.calibration = c
+}
+
+// GetCalibration returns the volume calibration of the dripper.
+func (d *Dripper) GetCalibration() Calibration {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	return d.calibration
+}
+
+// IsCalibratedFor reports whether the dripper can measure the volume it
+// dispenses in the supplied state with its current settings.
+func (d *Dripper) IsCalibratedFor(state string) bool {
+	c := d.GetCalibration()
+
+	switch state {
+	case DRIP:
+		return c.MillilitresPerDripAt(d.GetSettings()) > 0
+	case RUN:
+		return c.MillilitresPerSecondAt(d.GetSettings()) > 0
+	default:
+		return true
+	}
+}
+
+// GetDispensedVolume returns the estimated number of millilitres dispensed by
+// the dripper since it was created. Only water dispensed while calibrated is
+// counted.
+func (d *Dripper) GetDispensedVolume() float64 {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	volume := d.dispensed
+	if !d.runStartedAt.IsZero() {
+		volume += time.Since(d.runStartedAt).Seconds() * d.calibration.MillilitresPerSecondAt(d.GetSettings())
+	}
+
+	return volume
+}
+
+// GetDrips returns the number of drip pulses since the dripper was created.
+func (d *Dripper) GetDrips() uint64 {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	return d.drips
+}
+
+// GetRunTime returns the total time the dripper has spent in the run state
+// since it was created.
+func (d *Dripper) GetRunTime() time.Duration {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	runTime := d.runTime
+	if !d.runStartedAt.IsZero() {
+		runTime += time.Since(d.runStartedAt)
+	}
+
+	return runTime
+}
+
+// SetTargetVolume turns the dripper off once the supplied number of
+// millilitres has been dispensed from now on. The target is cleared whenever
+// the dripper is told to run, drip or turn off.
+func (d *Dripper) SetTargetVolume(millilitres float64) error {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	state := d.GetState()
+	if state == OFF {
+		return ErrOff
+	}
+
+	if !d.IsCalibratedFor(state) {
+		return ErrNotCalibrated
+	}
+
+	d.clearTarget()
+	current := d.GetDispensedVolume()
+	d.volumeMutex.Lock()
+	d.target = current + millilitres
+	d.volumeMutex.Unlock()
+
+	if state == RUN {
+		flow := d.GetCalibration().MillilitresPerSecondAt(d.GetSettings())
+		d.haltAfter(time.Duration(millilitres / flow * float64(time.Second)))
+	}
+
+	return nil
+}
+
+// SetTargetDrips turns the dripper off once the supplied number of drip
+// pulses have been dispensed from now on. The target is cleared whenever the
+// dripper is told to run, drip or turn off.
+func (d *Dripper) SetTargetDrips(drips uint64) error {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	if d.GetState() != DRIP {
+		return errors.New("the dripper is not dripping")
+	}
+
+	d.clearTarget()
+	d.volumeMutex.Lock()
+	d.targetDrips = d.drips + drips
+	d.volumeMutex.Unlock()
+
+	return nil
+}
+
+// SetTargetDuration turns the dripper off after the supplied duration. The
+// target is cleared whenever the dripper is told to run, drip or turn off.
+func (d *Dripper) SetTargetDuration(duration time.Duration) error {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	if d.GetState() == OFF {
+		return ErrOff
+	}
+
+	d.clearTarget()
+	d.haltAfter(duration)
+
+	return nil
+}
+
+// haltAfter turns the dripper off after the supplied duration unless it has
+// been given a newer command by then. The caller must hold the controlMutex.
+func (d *Dripper) haltAfter(duration time.Duration) {
+	generation := d.generation
+	d.runTimer = time.AfterFunc(duration, func() {
+		d.halt(generation)
+	})
+}
+
+// GetTargetVolume returns the number of millilitres left to dispense before
+// the dripper turns itself off, or zero if no target is set.
+func (d *Dripper) GetTargetVolume() float64 {
+	d.volumeMutex.Lock()
+	target := d.target
+	d.volumeMutex.Unlock()
+
+	if target == 0 {
+		return 0
+	}
+
+	remaining := target - d.GetDispensedVolume()
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// targetReached reports whether the target volume or number of drips has
+// been dispensed.
+func (d *Dripper) targetReached() bool {
+	d.volumeMutex.Lock()
+	target := d.target
+	dripsReached := d.targetDrips > 0 && d.drips >= d.targetDrips
+	d.volumeMutex.Unlock()
+
+	return dripsReached || (target > 0 && d.GetDispensedVolume() >= target)
+}
+
+// clearTarget removes any target volume, number of drips or duration. The
+// caller must hold the controlMutex.
+func (d *Dripper) clearTarget() {
+	if d.runTimer != nil {
+		d.runTimer.Stop()
+		d.runTimer = nil
+	}
+
+	d.volumeMutex.Lock()
+	d.target = 0
+	d.targetDrips = 0
+	d.volumeMutex.Unlock()
+}
+
+// recordDrip counts a completed drip pulse towards the dispensed volume.
+func (d *Dripper) recordDrip() {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	d.drips++
+	d.dispensed += d.calibration.MillilitresPerDripAt(d.GetSettings())
+}
+
+// startRunClock starts measuring the time the pump spends in the run state.
+func (d *Dripper) startRunClock() {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	if d.runStartedAt.IsZero() {
+		d.runStartedAt = time.Now()
+	}
+}
+
+// stopRunClock counts the time spent in the run state towards the dispensed
+// volume.
+func (d *Dripper) stopRunClock() {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	d.accumulateRun()
+	d.runStartedAt = time.Time{}
+}
+
+// accumulateRun adds the volume dispensed in the run state so far to the
+// dispensed volume and restarts the run clock if it is running. The caller
+// must hold the volumeMutex.
+func (d *Dripper) accumulateRun() {
+	if d.runStartedAt.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(d.runStartedAt)
+	d.runTime += elapsed
+	d.dispensed += elapsed.Seconds() * d.calibration.MillilitresPerSecondAt(d.GetSettings())
+	d.runStartedAt = now
+}
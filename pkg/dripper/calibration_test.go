@@ -0,0 +1,177 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalibrationOnlyAppliesToMatchingSettings(t *testing.T) {
+	settings := DefaultSettings()
+	c := withTestCalibration(settings)
+
+	if c.MillilitresPerDripAt(settings) != 0.5 {
+		t.Error("calibration did not apply to the settings it was measured at")
+	}
+
+	settings.DripSpeed++
+	if c.MillilitresPerDripAt(settings) != 0 {
+		t.Error("calibration applied to a different drip speed")
+	}
+
+	if c.MillilitresPerSecondAt(settings) != 100 {
+		t.Error("run calibration did not apply to an unchanged run speed")
+	}
+}
+
+func TestCalibrationConvertsBetweenRates(t *testing.T) {
+	settings := DefaultSettings()
+	c := withTestCalibration(settings)
+
+	dpm, err := c.DripsPerMinute(1800, settings)
+	if err != nil {
+		t.Fatal("could not convert rate:", err)
+	}
+
+	if dpm != 60 {
+		t.Errorf("expected 60 drips per minute, got %v", dpm)
+	}
+
+	if c.MillilitresPerHour(dpm, settings) != 1800 {
+		t.Error("drip rate was not converted back to millilitres per hour")
+	}
+
+	_, err = Calibration{}.DripsPerMinute(1800, settings)
+	if err != ErrNotCalibrated {
+		t.Error("converting without a calibration did not return an error")
+	}
+}
+
+func TestDripsAreCountedTowardsDispensedVolume(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+
+	d.drip()
+	d.drip()
+
+	if d.GetDrips() != 2 {
+		t.Error("drips were not counted")
+	}
+
+	if d.GetDispensedVolume() != 2*d.GetCalibration().MillilitresPerDrip {
+		t.Error("drips were not counted towards the dispensed volume")
+	}
+}
+
+func TestTargetVolumeTurnsRunOff(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+
+	err := d.SetTargetVolume(5)
+	if err != ErrOff {
+		t.Error("setting a target while off did not return an error")
+	}
+
+	err = d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	err = d.SetTargetVolume(5)
+	if err != nil {
+		t.Fatal("could not set target volume:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if d.GetState() != OFF {
+		t.Error("dripper was not turned off after reaching the target volume")
+	}
+
+	if d.GetDispensedVolume() < 5 {
+		t.Error("run time was not counted towards the dispensed volume")
+	}
+}
+
+func TestTargetVolumeTurnsDripOff(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+
+	err := d.Drip(MaxDripsPerMinute)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+
+	err = d.SetTargetVolume(0.5)
+	if err != nil {
+		t.Fatal("could not set target volume:", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if d.GetState() != OFF {
+		t.Error("dripper was not turned off after reaching the target volume")
+	}
+}
+
+func withTestCalibration(settings Settings) Calibration {
+	return Calibration{
+		MillilitresPerDrip:   0.5,
+		MillilitresPerSecond: 100,
+		DripSpeed:            settings.DripSpeed,
+		DripDuration:         settings.DripDuration,
+		RunSpeed:             settings.RunSpeed,
+	}
+}
+
+func withTestCalibratedDripper(t *testing.T) *Dripper {
+	settings := DefaultSettings()
+	settings.DripDuration = 1
+
+	d, err := New(settings, NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.SetCalibration(withTestCalibration(settings))
+
+	return d
+}
+
+func TestTargetDripsTurnsDripOff(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+
+	err := d.Drip(MaxDripsPerMinute)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+
+	err = d.SetTargetDrips(1)
+	if err != nil {
+		t.Fatal("could not set target drips:", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if d.GetState() != OFF {
+		t.Error("dripper was not turned off after reaching the target drips")
+	}
+}
+
+func TestTargetDurationTurnsRunOff(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+
+	err := d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	err = d.SetTargetDuration(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal("could not set target duration:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if d.GetState() != OFF {
+		t.Error("dripper was not turned off after the target duration")
+	}
+
+	if d.GetRunTime() < 50*time.Millisecond {
+		t.Error("run time was not tracked")
+	}
+}
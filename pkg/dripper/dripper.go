@@ -6,13 +6,12 @@
 package dripper
 
 import (
-  "github.com/sirupsen/logrus"
-  "log"
+	"log"
 	"sync"
 	"time"
 
-	"gobot.io/x/gobot/drivers/i2c"
-	"gobot.io/x/gobot/platforms/raspi"
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -35,6 +34,17 @@ const (
 	// OFF is used for internal state tracking to represent the pump fully
 	// stopped.
 	OFF = "off"
+
+	// MaxDripsPerMinute is the fastest drip rate the dripper supports.
+	MaxDripsPerMinute = 240
+
+	// measuredDrips is the number of recent drips the measured drip rate is
+	// averaged over.
+	measuredDrips = 10
+
+	// idleInterval is how often the drip goroutine checks the drip rate again
+	// while the rate is zero.
+	idleInterval = time.Second
 )
 
 // Dripper is the base object used to implement methods to control the cold brew
@@ -43,9 +53,6 @@ type Dripper struct {
 	// The motor driver for the peristaltic pump.
 	pump MotorController
 
-	// The motor number on the Adafruit Motor HAT indexed on zero.
-	motorNum int
-
 	// A wait group used to ensure the dipper goroutine has been stopped
 	// successfully.
 	dripperWG sync.WaitGroup
@@ -56,10 +63,28 @@ type Dripper struct {
 	// The drips per minute to set the dripper to.
 	dripsPerMin float64
 
-	// dripsPerMinMutex is used to update the dripsPerMinute across multiple
-	// goroutines.
+	// reportedDripsPerMin is the drip rate listeners were last told about.
+	reportedDripsPerMin float64
+
+	// profile is the rate profile the drip rate follows, or nil if the drip
+	// rate is fixed.
+	profile *Profile
+
+	// profileStartedAt is when the dripper started following the profile.
+	profileStartedAt time.Time
+
+	// dripsPerMinMutex is used to update the dripsPerMinute and profile
+	// across multiple goroutines.
 	dripsPerMinMutex sync.Mutex
 
+	// dripTimes are when the most recent drips started, oldest first. They
+	// are used to measure the actual drip rate.
+	dripTimes []time.Time
+
+	// dripTimesMutex is used to measure the drip rate across multiple
+	// goroutines.
+	dripTimesMutex sync.Mutex
+
 	// State is used internally to track the state of the dripper hardware.
 	state string
 
@@ -67,47 +92,124 @@ type Dripper struct {
 	// goroutines.
 	stateMutex sync.Mutex
 
-	// Settings is a dripper configuration object used to set values for the
+	// controlMutex serializes Run, Drip and Off so that callers on different
+	// goroutines can never interleave the drip goroutine handshake.
+	controlMutex sync.Mutex
+
+	// generation is incremented every time the dripper is told to run, start
+	// dripping or turn off. It lets timers and the drip goroutine turn the
+	// dripper off without racing a newer command.
+	generation uint64
+
+	// runTimer turns the dripper off once a target volume or duration has
+	// been reached.
+	runTimer *time.Timer
+
+	// calibration links drips and run time to the volume dispensed.
+	calibration Calibration
+
+	// drips is the number of drip pulses since the dripper was created.
+	drips uint64
+
+	// dispensed is the estimated number of millilitres dispensed, not counting
+	// the current run period.
+	dispensed float64
+
+	// runTime is the time spent in the run state, not counting the current
+	// run period.
+	runTime time.Duration
+
+	// runStartedAt is when the current run period started, or zero if the
+	// dripper is not in the run state.
+	runStartedAt time.Time
+
+	// target is the dispensed volume at which the dripper turns itself off,
+	// or zero if there is no target.
+	target float64
+
+	// targetDrips is the number of drips at which the dripper turns itself
+	// off, or zero if there is no target.
+	targetDrips uint64
+
+	// volumeMutex is used to track the dispensed volume across multiple
+	// goroutines.
+	volumeMutex sync.Mutex
+
+	// sessionStart is the dispensed volume when the current session began.
+	sessionStart float64
+
+	// sessionOpen is true while a session started with BeginSession is in
+	// progress.
+	sessionOpen bool
+
+	// watchdogTimer turns the dripper off once the run state has lasted too
+	// long or the session would dispense too much water.
+	watchdogTimer *time.Timer
+
+	// limits are the safety limits enforced by the watchdog.
+	limits Limits
+
+	// trip is why the watchdog last turned the dripper off.
+	trip *Trip
+
+	// tripped is true from the moment the watchdog turns the dripper off
+	// until the dripper is explicitly turned off, and keeps it from being
+	// started again in between.
+	tripped bool
+
+	// runSince is when the dripper last entered the run state, which the
+	// maximum run duration is counted from. It is guarded by the
+	// controlMutex.
+	runSince time.Time
+
+	// watchdogMutex is used to access the limits and trip across multiple
+	// goroutines.
+	watchdogMutex sync.Mutex
+
+	// listeners receive every event emitted by the dripper.
+	listeners []Listener
+
+	// listenersMutex is used to register listeners across multiple
+	// goroutines.
+	listenersMutex sync.Mutex
+
+	// settings is a dripper configuration object used to set values for the
 	// dripper.
-	Settings Settings
+	settings Settings
+
+	// pendingSettings are the settings the dripper switches to at the next
+	// drip or command, or nil if there are none.
+	pendingSettings *Settings
+
+	// settingsMutex is used to access the settings across multiple
+	// goroutines. Settings are only replaced while holding the volumeMutex
+	// too, so the volume dispensed is always counted at the right settings.
+	settingsMutex sync.Mutex
 }
 
-// MotorController is an interface to allow the pump to be mocked out in tests.
+// MotorController is an interface to allow the pump to be mocked out in tests
+// and driven by any of the registered motor drivers.
 type MotorController interface {
 	Start() error
-	RunDCMotor(int, i2c.AdafruitDirection) error
-	SetDCMotorSpeed(int, int32) error
+	RunMotor(motor.Direction) error
+	SetMotorSpeed(int32) error
 }
 
-// New creates a new dripper instance and initializes the motor HAT driver.
-func New(config Settings) (*Dripper, error) {
-	r := raspi.NewAdaptor()
-  driver := i2c.NewAdafruitMotorHatDriver(r)
-
-  // This is a bit janky. The gobot driver for this hat attempts to initialize both the motor hat and servo hat. We only
-  // are using the motor hat. This sets the server hat address to the same address as the motor hat such that we can
-  // initialize the driver without needing to update the driver code or have a servo connected.
-  err := driver.SetServoHatAddress(0x60)
-  if err != nil {
-    logrus.WithFields(logrus.Fields{
-      "error": err,
-    }).Error("could not start pump")
-    return nil, err
-  }
-
+// New creates a new dripper instance driven by the supplied motor controller
+// and starts the controller.
+func New(config Settings, pump MotorController) (*Dripper, error) {
 	d := Dripper{
-		motorNum:    2,
-		pump:        driver,
+		pump:        pump,
 		state:       OFF,
 		stopDripper: make(chan bool),
-		Settings:    config,
+		settings:    config,
 	}
 
-	err = d.pump.Start()
+	err := d.pump.Start()
 	if err != nil {
-	  logrus.WithFields(logrus.Fields{
-	    "error": err,
-    }).Error("could not start pump")
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not start pump")
 		return &d, err
 	}
 
@@ -116,25 +218,50 @@ func New(config Settings) (*Dripper, error) {
 
 // Drip starts the dripper at the desired drip rate.
 func (d *Dripper) Drip(dripsPerMin float64) error {
-	err := d.setSpeed(d.Settings.DripSpeed)
+	return d.startDripping(dripsPerMin, nil, 0)
+}
+
+// startDripping starts the dripper at the supplied drip rate, following the
+// supplied profile if it is not nil.
+func (d *Dripper) startDripping(dripsPerMin float64, profile *Profile, elapsed time.Duration) error {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	if d.isTripped() {
+		return ErrTripped
+	}
+
+	d.applyPendingSettings()
+	err := d.setSpeed(d.GetSettings().DripSpeed)
 	if err != nil {
 		return err
 	}
 
 	// We are setting dripsPerMin before the sanity check in order to update
 	// regardless.
-	d.SetDripsPerMinute(dripsPerMin)
+	d.setProfile(profile, elapsed)
+	d.setDripsPerMinute(dripsPerMin)
+	d.clearTarget()
 
 	// This is a sanity check to ensure the dripper is not already in the drip
 	// state.
-	if d.GetState() == DRIP {
+	state := d.GetState()
+	if state == DRIP {
 		return nil
 	}
 
+	if state == OFF {
+		d.startSession()
+	}
+
+	d.disarmWatchdog()
+	d.stopRunClock()
+	d.resetMeasuredRate()
+	d.generation++
 	d.setState(DRIP)
 
 	d.dripperWG.Add(1)
-	go d.runDrip()
+	go d.runDrip(d.generation)
 
 	return nil
 }
@@ -142,22 +269,49 @@ func (d *Dripper) Drip(dripsPerMin float64) error {
 // setState is used as a setter to set the dripper state concurrently.
 func (d *Dripper) setState(state string) {
 	d.stateMutex.Lock()
+	changed := d.state != state
 	d.state = state
 	d.stateMutex.Unlock()
+
+	if changed {
+		d.emit(EventState)
+	}
 }
 
 // Run turns on the dripper at the maximum pump speed. This is useful for
 // blooming the batch of coffee, priming the pump with water, and draining the
 // pump when finished brewing.
 func (d *Dripper) Run() error {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	if d.isTripped() {
+		return ErrTripped
+	}
+
 	// This is a sanity check to ensure the drip goroutine is stopped before
 	// trying to control the pump. This prevents the weird state where the pump
 	// is on the maximum speed, but is still pulsing from the drip goroutine.
-	if d.GetState() == DRIP {
-		d.Off()
+	state := d.GetState()
+	if state == DRIP {
+		d.off()
+	}
+
+	if state == OFF {
+		d.startSession()
+	}
+
+	// Running again while already running keeps counting the maximum run
+	// duration from when the run began.
+	if state != RUN {
+		d.runSince = time.Now()
 	}
 
-	err := d.setSpeed(d.Settings.RunSpeed)
+	d.clearTarget()
+	d.applyPendingSettings()
+	d.generation++
+
+	err := d.setSpeed(d.GetSettings().RunSpeed)
 	if err != nil {
 		return err
 	}
@@ -169,26 +323,80 @@ func (d *Dripper) Run() error {
 		return err
 	}
 
+	d.startRunClock()
+	d.armWatchdog()
+
 	return nil
 }
 
-// Off ensures the dripper is completely stopped.
+// Off ensures the dripper is completely stopped. It also allows a dripper the
+// watchdog turned off to be started again.
 func (d *Dripper) Off() error {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	d.watchdogMutex.Lock()
+	d.tripped = false
+	d.watchdogMutex.Unlock()
+
+	return d.off()
+}
+
+// off stops the drip goroutine if it is running and stops the motor. The
+// caller must hold the controlMutex.
+func (d *Dripper) off() error {
 	if d.GetState() == DRIP {
 		d.stopDripper <- true
 		d.dripperWG.Wait()
 	}
 
+	d.clearTarget()
+	d.setProfile(nil, 0)
+	d.resetMeasuredRate()
+	d.disarmWatchdog()
+	d.stopRunClock()
+	d.applyPendingSettings()
+	d.generation++
 	d.setState(OFF)
 
 	return d.stop()
 }
 
-// SetDripsPerMinute will update the dripper with the desired drip rate.
+// halt turns the dripper off from inside the dripper, for example once a
+// target volume has been reached. It does nothing if the dripper has been
+// given a newer command since the supplied generation.
+func (d *Dripper) halt(generation uint64) {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	if d.generation != generation {
+		return
+	}
+
+	err := d.off()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// SetDripsPerMinute will update the dripper with the desired drip rate. The
+// dripper stops following any rate profile.
 func (d *Dripper) SetDripsPerMinute(dripsPerMin float64) {
+	d.setProfile(nil, 0)
+	d.setDripsPerMinute(dripsPerMin)
+}
+
+// setDripsPerMinute updates the drip rate without changing the profile.
+func (d *Dripper) setDripsPerMinute(dripsPerMin float64) {
 	d.dripsPerMinMutex.Lock()
+	changed := d.dripsPerMin != dripsPerMin
 	d.dripsPerMin = dripsPerMin
+	d.reportedDripsPerMin = dripsPerMin
 	d.dripsPerMinMutex.Unlock()
+
+	if changed {
+		d.emit(EventRate)
+	}
 }
 
 // GetState returns the internal state of the dripper. This is useful for
@@ -210,64 +418,175 @@ func (d *Dripper) GetDripsPerMinute() float64 {
 	return dpm
 }
 
+// GetMeasuredDripsPerMinute returns the drip rate the dripper has actually
+// achieved over its most recent drips, or zero until it has dripped twice.
+func (d *Dripper) GetMeasuredDripsPerMinute() float64 {
+	d.dripTimesMutex.Lock()
+	defer d.dripTimesMutex.Unlock()
+
+	if len(d.dripTimes) < 2 {
+		return 0
+	}
+
+	elapsed := d.dripTimes[len(d.dripTimes)-1].Sub(d.dripTimes[0])
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(len(d.dripTimes)-1) / elapsed.Minutes()
+}
+
 // runDrip runs a goroutine to pulse the dripper at the desired drip rate. This
 // is mainly to account for the fact that the cheap peristaltic pump used in
 // this design as the motor cannot rotate much lower then the drip speed
 // constant. In order to get just a small amount of water out of the pump, it is
 // simply turned on at the lowest speed for some amount of time before being
 // stopped to simulate a single drip.
-func (d *Dripper) runDrip() {
+//
+// Drips are scheduled against deadlines rather than by sleeping between them,
+// so the time spent pulsing the pump and any scheduling delays do not slow the
+// drip rate down. Each drip finishes before the next one starts, so pulses
+// never overlap even when the pump can not keep up with the drip rate.
+func (d *Dripper) runDrip(generation uint64) {
 	defer d.dripperWG.Done()
 
+	// The timer is stopped straight away so that it can be reset after the
+	// first drip.
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	deadline := time.Now()
 	for {
 		select {
 		case <-d.stopDripper:
 			return
 		default:
-			go d.drip()
-			dpm := d.GetDripsPerMinute()
-			dripDuration := d.Settings.DripDuration
-			stopDuration := calcStopDuration(dpm, dripDuration)
-			time.Sleep(time.Duration((stopDuration * 1000)) * time.Millisecond)
+		}
+
+		if d.targetReached() {
+			// Turning the dripper off waits for this goroutine, so it has
+			// to happen elsewhere while we wait for the stop signal.
+			go d.halt(generation)
+			<-d.stopDripper
+			return
+		}
+
+		if d.sessionLimitReached() {
+			go d.tripWatchdog(generation, TripSessionVolume)
+			<-d.stopDripper
+			return
+		}
+
+		dpm := d.followProfile()
+		interval := idleInterval
+		if dpm > 0 {
+			if d.applyPendingSettings() {
+				err := d.setSpeed(d.GetSettings().DripSpeed)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+
+			d.drip()
+			interval = calcDripInterval(dpm)
+		}
+
+		deadline = nextDripDeadline(deadline, interval, time.Now())
+		timer.Reset(time.Until(deadline))
+
+		select {
+		case <-d.stopDripper:
+			return
+		case <-timer.C:
 		}
 	}
 }
 
 // drip is a low level method to produce one drip from the dripper.
 func (d *Dripper) drip() {
+	d.recordDripTime(time.Now())
+
 	err := d.on()
 	if err != nil {
 		log.Println(err)
 	}
 
-	time.Sleep(time.Duration(d.Settings.DripDuration) * time.Millisecond)
+	time.Sleep(time.Duration(d.GetSettings().DripDuration) * time.Millisecond)
 
 	err = d.stop()
 	if err != nil {
 		log.Println(err)
 	}
+
+	d.recordDrip()
+	d.emit(EventDrip)
 }
 
 // on is a low level mehtod to start the rotation of the motor.
 func (d *Dripper) on() error {
-	return d.pump.RunDCMotor(d.motorNum, i2c.AdafruitForward)
+	return d.pump.RunMotor(motor.Forward)
 }
 
 // setSpeed is a low level method to set the motor speed.
 func (d *Dripper) setSpeed(speed int32) error {
-	return d.pump.SetDCMotorSpeed(d.motorNum, speed)
+	return d.pump.SetMotorSpeed(speed)
 }
 
 // stop is a low level method to stop the rotation of the motor.
 func (d *Dripper) stop() error {
-	return d.pump.RunDCMotor(d.motorNum, i2c.AdafruitRelease)
+	return d.pump.RunMotor(motor.Release)
+}
+
+// recordDripTime remembers when a drip started so the drip rate can be
+// measured.
+func (d *Dripper) recordDripTime(t time.Time) {
+	d.dripTimesMutex.Lock()
+	defer d.dripTimesMutex.Unlock()
+
+	d.dripTimes = append(d.dripTimes, t)
+	if len(d.dripTimes) > measuredDrips {
+		d.dripTimes = d.dripTimes[len(d.dripTimes)-measuredDrips:]
+	}
+}
+
+// resetMeasuredRate forgets the recent drips so the measured drip rate starts
+// afresh.
+func (d *Dripper) resetMeasuredRate() {
+	d.dripTimesMutex.Lock()
+	d.dripTimes = nil
+	d.dripTimesMutex.Unlock()
+}
+
+// nextDripDeadline returns when the drip after the one due at the supplied
+// deadline should start. Deadlines advance by whole intervals so that small
+// delays are made up on the next drip, but a dripper which has fallen more
+// than an interval behind starts again from now instead of bursting to catch
+// up.
+func nextDripDeadline(deadline time.Time, interval time.Duration, now time.Time) time.Time {
+	next := deadline.Add(interval)
+	if now.Sub(next) > interval {
+		return now
+	}
+
+	return next
+}
+
+// calcDripInterval calculates the time between the start of one drip and the
+// start of the next to achieve the desired drip rate.
+func calcDripInterval(dripsPerMin float64) time.Duration {
+	if dripsPerMin > MaxDripsPerMinute {
+		dripsPerMin = MaxDripsPerMinute
+	}
+
+	return time.Duration(float64(time.Minute) / dripsPerMin)
 }
 
 // calcStopDuration calculates the amount of time between drips is necessary
 // to achieve the desired drip rate.
 func calcStopDuration(dripsPerMin float64, dripDuration int64) float64 {
-	if dripsPerMin > 240 {
-		dripsPerMin = 240
+	if dripsPerMin > MaxDripsPerMinute {
+		dripsPerMin = MaxDripsPerMinute
 	}
 
 	secondsPerDrip := secondsPerMin / dripsPerMin
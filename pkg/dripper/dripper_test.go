@@ -4,7 +4,9 @@
 package dripper
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/betterengineering/cold-brew/pkg/dripper/mock_dripper"
 	"github.com/golang/mock/gomock"
@@ -23,11 +25,10 @@ func setup(t *testing.T) testDripper {
 
 	config := DefaultSettings()
 	d := Dripper{
-		motorNum:    2,
 		pump:        mockMotorController,
 		state:       OFF,
 		stopDripper: make(chan bool, 1),
-		Settings:    config,
+		settings:    config,
 	}
 
 	return testDripper{
@@ -66,6 +67,57 @@ func TestDripWhenStateIsDrip(t *testing.T) {
 	// TODO: ensure drip go routine was not started.
 }
 
+func TestDripPulsesDoNotOverlap(t *testing.T) {
+	simulator := NewSimulator()
+	d, err := New(DefaultSettings(), simulator)
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.settings.DripDuration = 200
+
+	err = d.Drip(MaxDripsPerMinute)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+	measured := d.GetMeasuredDripsPerMinute()
+	d.Off()
+
+	running := false
+	for _, transition := range simulator.Transitions() {
+		if transition.Running && running {
+			t.Fatal("a drip started before the previous one stopped")
+		}
+
+		running = transition.Running
+	}
+
+	if math.Abs(measured-MaxDripsPerMinute) > MaxDripsPerMinute*0.1 {
+		t.Errorf("expected to measure about %v drips per minute, got %v", MaxDripsPerMinute, measured)
+	}
+
+	if d.GetMeasuredDripsPerMinute() != 0 {
+		t.Error("measured drip rate was not reset when the dripper turned off")
+	}
+}
+
+func TestNextDripDeadline(t *testing.T) {
+	deadline := time.Date(2019, time.May, 1, 5, 0, 0, 0, time.UTC)
+	interval := time.Second
+
+	next := nextDripDeadline(deadline, interval, deadline.Add(1100*time.Millisecond))
+	if !next.Equal(deadline.Add(interval)) {
+		t.Error("a late drip was not made up on the next deadline:", next)
+	}
+
+	now := deadline.Add(5 * time.Second)
+	next = nextDripDeadline(deadline, interval, now)
+	if !next.Equal(now) {
+		t.Error("a dripper far behind tried to catch up on every missed drip:", next)
+	}
+}
+
 func (d *testDripper) teardown() {
 	d.dripper.stopDripper <- true
 	d.dripper.dripperWG.Wait()
@@ -77,7 +129,7 @@ func (d *testDripper) givenStateIsDrip() {
 }
 
 func (d *testDripper) givenMotorIsSetToDrip() {
-	d.mockMotorController.EXPECT().SetDCMotorSpeed(d.dripper.motorNum, d.dripper.Settings.DripSpeed)
+	d.mockMotorController.EXPECT().SetMotorSpeed(d.dripper.settings.DripSpeed)
 }
 
 func (d *testDripper) whenDrip(dripsPerMinute float64) {
@@ -0,0 +1,281 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+	"github.com/sirupsen/logrus"
+	"gobot.io/x/gobot/drivers/i2c"
+	"gobot.io/x/gobot/platforms/raspi"
+)
+
+const (
+	// DriverAdafruitHat selects the Adafruit Motor HAT attached to a Raspberry
+	// Pi as the motor controller for the pump.
+	DriverAdafruitHat = "adafruit-hat"
+
+	// DriverSimulator selects a simulated motor controller which does not
+	// require any hardware.
+	DriverSimulator = "simulator"
+
+	// DriverGPIOPWM selects a pump switched by a transistor on a single PWM
+	// capable GPIO pin of a Raspberry Pi.
+	DriverGPIOPWM = "gpio-pwm"
+
+	// DriverL298N selects a pump driven by one channel of an L298N H-bridge
+	// attached to the GPIO pins of a Raspberry Pi.
+	DriverL298N = "l298n"
+
+	// DriverStepper selects a peristaltic pump turned by a four wire stepper
+	// motor attached to the GPIO pins of a Raspberry Pi.
+	DriverStepper = "stepper"
+
+	// DefaultMotor is the motor on the Adafruit Motor HAT the pump is
+	// connected to unless configured otherwise, indexed on zero.
+	DefaultMotor = 2
+
+	// DefaultStepMicroseconds is the shortest time a stepper motor is given
+	// between steps unless configured otherwise.
+	DefaultStepMicroseconds = 1500
+
+	// maxMotors is the number of motors the Adafruit Motor HAT can drive.
+	maxMotors = 4
+)
+
+// DriverOptions parameterise the motor driver. Each driver only reads the
+// options it needs.
+type DriverOptions struct {
+	// Motor is the motor on the Adafruit Motor HAT the pump is connected to,
+	// indexed on zero.
+	Motor int `mapstructure:"motor" json:"motor"`
+
+	// PWMPin is the pin which switches the pump for the gpio-pwm driver and
+	// the enable pin of the H-bridge channel for the l298n driver.
+	PWMPin string `mapstructure:"pwmPin" json:"pwmPin,omitempty"`
+
+	// ForwardPin and BackwardPin are the input pins of the H-bridge channel
+	// for the l298n driver.
+	ForwardPin  string `mapstructure:"forwardPin" json:"forwardPin,omitempty"`
+	BackwardPin string `mapstructure:"backwardPin" json:"backwardPin,omitempty"`
+
+	// StepPins are the four coil pins of the stepper motor for the stepper
+	// driver.
+	StepPins []string `mapstructure:"stepPins" json:"stepPins,omitempty"`
+
+	// StepMicroseconds is the shortest time the stepper motor needs between
+	// steps, which is how often it steps at full speed.
+	StepMicroseconds int `mapstructure:"stepMicroseconds" json:"stepMicroseconds,omitempty"`
+}
+
+// DefaultDriverOptions returns driver options with sane defaults.
+func DefaultDriverOptions() DriverOptions {
+	return DriverOptions{
+		Motor:            DefaultMotor,
+		StepMicroseconds: DefaultStepMicroseconds,
+	}
+}
+
+// DriverFactory creates a motor controller from the driver options.
+type DriverFactory func(DriverOptions) (MotorController, error)
+
+// driver is a motor driver known to the registry.
+type driver struct {
+	validate func(DriverOptions) error
+	create   DriverFactory
+}
+
+var (
+	// drivers is the registry of motor drivers by name.
+	drivers = map[string]driver{
+		DriverAdafruitHat: {validateAdafruitHat, newAdafruitMotorHat},
+		DriverSimulator:   {validateNothing, newSimulatorController},
+		DriverGPIOPWM:     {validateGPIOPWM, newRaspiGPIOPWM},
+		DriverL298N:       {validateL298N, newRaspiL298N},
+		DriverStepper:     {validateStepper, newRaspiStepper},
+	}
+
+	// driversMutex is used to access the registry across multiple
+	// goroutines.
+	driversMutex sync.Mutex
+)
+
+// RegisterDriver adds a motor driver to the registry, replacing any driver
+// with the same name. The validate function checks the options before any
+// hardware is touched.
+func RegisterDriver(name string, validate func(DriverOptions) error, create DriverFactory) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	drivers[name] = driver{validate, create}
+}
+
+// Drivers returns the names of every registered motor driver in order.
+func Drivers() []string {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewMotorController creates the motor controller for the named driver.
+func NewMotorController(name string, options DriverOptions) (MotorController, error) {
+	d, err := lookupDriver(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.create(options)
+}
+
+// ValidateDriver ensures the named driver exists and can be created with the
+// supplied options.
+func ValidateDriver(name string, options DriverOptions) error {
+	_, err := lookupDriver(name, options)
+	return err
+}
+
+// IsValidDriver validates that a driver is one that the dripper supports.
+func IsValidDriver(name string) bool {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	_, ok := drivers[name]
+	return ok
+}
+
+// lookupDriver finds the named driver and validates the options for it.
+func lookupDriver(name string, options DriverOptions) (driver, error) {
+	driversMutex.Lock()
+	d, ok := drivers[name]
+	driversMutex.Unlock()
+
+	if !ok {
+		return d, fmt.Errorf("unknown motor driver %q", name)
+	}
+
+	err := d.validate(options)
+	if err != nil {
+		return d, fmt.Errorf("motor driver %q: %v", name, err)
+	}
+
+	return d, nil
+}
+
+// validateNothing accepts any options for drivers which do not read them.
+func validateNothing(DriverOptions) error {
+	return nil
+}
+
+// newSimulatorController creates a simulated motor controller.
+func newSimulatorController(DriverOptions) (MotorController, error) {
+	return NewSimulator(), nil
+}
+
+// motorHat is the Adafruit Motor HAT shared by every motor controller driving
+// one of its motors. Starting the HAT stops all of its motors, so it is only
+// started once.
+type motorHat struct {
+	driver *i2c.AdafruitMotorHatDriver
+	start  sync.Once
+	err    error
+
+	// mutex is used to send commands to the HAT from the motor controllers
+	// of several drippers.
+	mutex sync.Mutex
+}
+
+var (
+	// sharedMotorHat is the Adafruit Motor HAT attached to the Raspberry Pi,
+	// or nil until a motor controller for it is created.
+	sharedMotorHat *motorHat
+
+	// motorHatMutex is used to create the shared Adafruit Motor HAT across
+	// multiple goroutines.
+	motorHatMutex sync.Mutex
+)
+
+// adafruitMotorHat drives the pump with one motor of the Adafruit Motor HAT.
+type adafruitMotorHat struct {
+	hat   *motorHat
+	motor int
+}
+
+// validateAdafruitHat ensures the motor is one the Adafruit Motor HAT has.
+func validateAdafruitHat(options DriverOptions) error {
+	if options.Motor < 0 || options.Motor >= maxMotors {
+		return fmt.Errorf("motor must be between 0 and %d", maxMotors-1)
+	}
+
+	return nil
+}
+
+// newAdafruitMotorHat creates a motor controller for the Adafruit Motor HAT
+// attached to the Raspberry Pi.
+func newAdafruitMotorHat(options DriverOptions) (MotorController, error) {
+	motorHatMutex.Lock()
+	defer motorHatMutex.Unlock()
+
+	if sharedMotorHat == nil {
+		r := raspi.NewAdaptor()
+		driver := i2c.NewAdafruitMotorHatDriver(r)
+
+		// This is a bit janky. The gobot driver for this hat attempts to initialize both the motor hat and servo hat. We only
+		// are using the motor hat. This sets the server hat address to the same address as the motor hat such that we can
+		// initialize the driver without needing to update the driver code or have a servo connected.
+		err := driver.SetServoHatAddress(0x60)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("could not start pump")
+			return nil, err
+		}
+
+		sharedMotorHat = &motorHat{driver: driver}
+	}
+
+	return &adafruitMotorHat{hat: sharedMotorHat, motor: options.Motor}, nil
+}
+
+// Start initializes the Adafruit Motor HAT unless the motor controller of
+// another of its motors already has.
+func (a *adafruitMotorHat) Start() error {
+	a.hat.start.Do(func() {
+		a.hat.err = a.hat.driver.Start()
+	})
+
+	return a.hat.err
+}
+
+// RunMotor starts or releases the motor.
+func (a *adafruitMotorHat) RunMotor(dir motor.Direction) error {
+	a.hat.mutex.Lock()
+	defer a.hat.mutex.Unlock()
+
+	switch dir {
+	case motor.Forward:
+		return a.hat.driver.RunDCMotor(a.motor, i2c.AdafruitForward)
+	case motor.Backward:
+		return a.hat.driver.RunDCMotor(a.motor, i2c.AdafruitBackward)
+	default:
+		return a.hat.driver.RunDCMotor(a.motor, i2c.AdafruitRelease)
+	}
+}
+
+// SetMotorSpeed sets the speed of the motor.
+func (a *adafruitMotorHat) SetMotorSpeed(speed int32) error {
+	a.hat.mutex.Lock()
+	defer a.hat.mutex.Unlock()
+
+	return a.hat.driver.SetDCMotorSpeed(a.motor, speed)
+}
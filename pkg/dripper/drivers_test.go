@@ -0,0 +1,64 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"testing"
+)
+
+func TestValidateDriver(t *testing.T) {
+	valid := map[string]DriverOptions{
+		DriverAdafruitHat: DefaultDriverOptions(),
+		DriverSimulator:   DefaultDriverOptions(),
+		DriverGPIOPWM:     {PWMPin: "12"},
+		DriverL298N:       {PWMPin: "32", ForwardPin: "16", BackwardPin: "18"},
+		DriverStepper:     {StepPins: []string{"11", "13", "15", "16"}, StepMicroseconds: DefaultStepMicroseconds},
+	}
+
+	for name, options := range valid {
+		err := ValidateDriver(name, options)
+		if err != nil {
+			t.Errorf("valid %s driver returned an error: %v", name, err)
+		}
+	}
+
+	invalid := map[string]DriverOptions{
+		DriverAdafruitHat: {Motor: maxMotors},
+		DriverGPIOPWM:     {},
+		DriverL298N:       {PWMPin: "32"},
+		DriverStepper:     {StepPins: []string{"11", "13"}, StepMicroseconds: DefaultStepMicroseconds},
+		"foo":             DefaultDriverOptions(),
+	}
+
+	for name, options := range invalid {
+		err := ValidateDriver(name, options)
+		if err == nil {
+			t.Errorf("invalid %s driver did not return an error", name)
+		}
+	}
+}
+
+func TestRegisterDriver(t *testing.T) {
+	sim := NewSimulator()
+	RegisterDriver("test", validateNothing, func(DriverOptions) (MotorController, error) {
+		return sim, nil
+	})
+
+	found := false
+	for _, name := range Drivers() {
+		found = found || name == "test"
+	}
+	if !found {
+		t.Error("registered driver was not listed")
+	}
+
+	pump, err := NewMotorController("test", DriverOptions{})
+	if err != nil {
+		t.Fatal("could not create registered driver:", err)
+	}
+
+	if pump != sim {
+		t.Error("registered driver did not create the motor controller")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"time"
+)
+
+const (
+	// EventState is emitted when the dripper changes state.
+	EventState = "state"
+
+	// EventRate is emitted when the drip rate of the dripper changes.
+	EventRate = "rate"
+
+	// EventDrip is emitted after every drip pulse.
+	EventDrip = "drip"
+
+	// EventTrip is emitted when the watchdog turns the dripper off, just
+	// before it turns off.
+	EventTrip = "trip"
+
+	// EventSettings is emitted when new settings take effect.
+	EventSettings = "settings"
+)
+
+// Event describes something that happened to the dripper.
+type Event struct {
+	// Type is the kind of event.
+	Type string `json:"type"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+
+	// State is the state of the dripper when the event happened.
+	State string `json:"state"`
+
+	// DripsPerMinute is the drip rate of the dripper when the event happened.
+	DripsPerMinute float64 `json:"dripsPerMinute"`
+
+	// MeasuredDripsPerMinute is the drip rate the dripper had actually
+	// achieved when the event happened.
+	MeasuredDripsPerMinute float64 `json:"measuredDripsPerMinute"`
+
+	// DispensedVolume is the estimated number of millilitres dispensed when
+	// the event happened.
+	DispensedVolume float64 `json:"dispensedVolume"`
+
+	// Trip is why the watchdog turned the dripper off. It is only set for
+	// trip events.
+	Trip *Trip `json:"trip,omitempty"`
+}
+
+// Listener is a callback which receives dripper events. Listeners are called
+// synchronously from the goroutine controlling the pump, so they must not
+// block.
+type Listener func(Event)
+
+// AddListener registers a listener which receives every event emitted by the
+// dripper.
+func (d *Dripper) AddListener(l Listener) {
+	d.listenersMutex.Lock()
+	d.listeners = append(d.listeners, l)
+	d.listenersMutex.Unlock()
+}
+
+// emit sends an event of the supplied type to every listener.
+func (d *Dripper) emit(eventType string) {
+	event := Event{
+		Type:                   eventType,
+		Time:                   time.Now(),
+		State:                  d.GetState(),
+		DripsPerMinute:         d.GetDripsPerMinute(),
+		MeasuredDripsPerMinute: d.GetMeasuredDripsPerMinute(),
+		DispensedVolume:        d.GetDispensedVolume(),
+	}
+
+	if eventType == EventTrip {
+		event.Trip = d.GetTrip()
+	}
+
+	d.listenersMutex.Lock()
+	listeners := d.listeners
+	d.listenersMutex.Unlock()
+
+	for _, l := range listeners {
+		l(event)
+	}
+}
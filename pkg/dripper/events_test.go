@@ -0,0 +1,70 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestListenersReceiveStateAndRateEvents(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	var events []Event
+	var mutex sync.Mutex
+	d.AddListener(func(e Event) {
+		mutex.Lock()
+		events = append(events, e)
+		mutex.Unlock()
+	})
+
+	d.SetDripsPerMinute(30)
+	d.SetDripsPerMinute(30)
+	d.Run()
+	d.Run()
+	d.Off()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+
+	if events[0].Type != EventRate || events[0].DripsPerMinute != 30 {
+		t.Error("rate change was not emitted")
+	}
+
+	if events[1].Type != EventState || events[1].State != RUN {
+		t.Error("run state was not emitted")
+	}
+
+	if events[2].Type != EventState || events[2].State != OFF {
+		t.Error("off state was not emitted")
+	}
+}
+
+func TestDripEmitsDripEvent(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.settings.DripDuration = 1
+
+	drips := 0
+	d.AddListener(func(e Event) {
+		if e.Type == EventDrip {
+			drips++
+		}
+	})
+
+	d.drip()
+
+	if drips != 1 {
+		t.Error("drip event was not emitted")
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+	"github.com/sirupsen/logrus"
+	"gobot.io/x/gobot/drivers/gpio"
+	"gobot.io/x/gobot/platforms/raspi"
+)
+
+// stepperPins is the number of coil pins a stepper motor has.
+const stepperPins = 4
+
+// errBackwardUnsupported is returned when a driver which can only turn the
+// pump one way is asked to turn it backward.
+var errBackwardUnsupported = errors.New("the motor driver can not run the motor backward")
+
+// pinWriter is a GPIO adaptor which can write both digital and PWM levels.
+type pinWriter interface {
+	gpio.DigitalWriter
+	gpio.PwmWriter
+}
+
+// connector is implemented by GPIO adaptors which have to connect to the
+// hardware before they are used.
+type connector interface {
+	Connect() error
+}
+
+// connect connects the adaptor to the hardware if it needs to.
+func connect(adaptor interface{}) error {
+	if c, ok := adaptor.(connector); ok {
+		return c.Connect()
+	}
+
+	return nil
+}
+
+// pwmLevel converts a motor speed to a PWM duty cycle.
+func pwmLevel(speed int32) byte {
+	if speed < 0 {
+		return 0
+	}
+	if speed > MaxSpeed {
+		return MaxSpeed
+	}
+
+	return byte(speed)
+}
+
+// gpioPWM drives the pump by switching it with PWM on a single GPIO pin.
+type gpioPWM struct {
+	writer  gpio.PwmWriter
+	pin     string
+	speed   int32
+	running bool
+	mutex   sync.Mutex
+}
+
+// validateGPIOPWM ensures the PWM pin is configured.
+func validateGPIOPWM(options DriverOptions) error {
+	if options.PWMPin == "" {
+		return errors.New("pwmPin must be set")
+	}
+
+	return nil
+}
+
+// newRaspiGPIOPWM creates a gpio-pwm motor controller on the GPIO pins of
+// the Raspberry Pi.
+func newRaspiGPIOPWM(options DriverOptions) (MotorController, error) {
+	return newGPIOPWM(raspi.NewAdaptor(), options), nil
+}
+
+// newGPIOPWM creates a gpio-pwm motor controller which writes to the supplied
+// adaptor.
+func newGPIOPWM(writer gpio.PwmWriter, options DriverOptions) *gpioPWM {
+	return &gpioPWM{writer: writer, pin: options.PWMPin}
+}
+
+// Start connects to the GPIO pins and makes sure the pump is off.
+func (g *gpioPWM) Start() error {
+	err := connect(g.writer)
+	if err != nil {
+		return err
+	}
+
+	return g.writer.PwmWrite(g.pin, 0)
+}
+
+// RunMotor starts or releases the pump. The pump can only run forward.
+func (g *gpioPWM) RunMotor(dir motor.Direction) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	switch dir {
+	case motor.Forward:
+		g.running = true
+		return g.writer.PwmWrite(g.pin, pwmLevel(g.speed))
+	case motor.Backward:
+		return errBackwardUnsupported
+	default:
+		g.running = false
+		return g.writer.PwmWrite(g.pin, 0)
+	}
+}
+
+// SetMotorSpeed sets the duty cycle the pump runs at.
+func (g *gpioPWM) SetMotorSpeed(speed int32) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.speed = speed
+	if !g.running {
+		return nil
+	}
+
+	return g.writer.PwmWrite(g.pin, pwmLevel(speed))
+}
+
+// l298n drives the pump with one channel of an L298N H-bridge. The input pins
+// set the direction and PWM on the enable pin sets the speed.
+type l298n struct {
+	writer      pinWriter
+	enablePin   string
+	forwardPin  string
+	backwardPin string
+	speed       int32
+	running     bool
+	mutex       sync.Mutex
+}
+
+// validateL298N ensures the enable and input pins are configured.
+func validateL298N(options DriverOptions) error {
+	if options.PWMPin == "" || options.ForwardPin == "" || options.BackwardPin == "" {
+		return errors.New("pwmPin, forwardPin and backwardPin must be set")
+	}
+
+	return nil
+}
+
+// newRaspiL298N creates an l298n motor controller on the GPIO pins of the
+// Raspberry Pi.
+func newRaspiL298N(options DriverOptions) (MotorController, error) {
+	return newL298N(raspi.NewAdaptor(), options), nil
+}
+
+// newL298N creates an l298n motor controller which writes to the supplied
+// adaptor.
+func newL298N(writer pinWriter, options DriverOptions) *l298n {
+	return &l298n{
+		writer:      writer,
+		enablePin:   options.PWMPin,
+		forwardPin:  options.ForwardPin,
+		backwardPin: options.BackwardPin,
+	}
+}
+
+// Start connects to the GPIO pins and makes sure the pump is off.
+func (l *l298n) Start() error {
+	err := connect(l.writer)
+	if err != nil {
+		return err
+	}
+
+	return l.release()
+}
+
+// RunMotor starts the pump in the supplied direction or releases it.
+func (l *l298n) RunMotor(dir motor.Direction) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var forward, backward byte
+	switch dir {
+	case motor.Forward:
+		forward = 1
+	case motor.Backward:
+		backward = 1
+	default:
+		l.running = false
+		return l.release()
+	}
+
+	err := l.writer.DigitalWrite(l.forwardPin, forward)
+	if err != nil {
+		return err
+	}
+
+	err = l.writer.DigitalWrite(l.backwardPin, backward)
+	if err != nil {
+		return err
+	}
+
+	l.running = true
+	return l.writer.PwmWrite(l.enablePin, pwmLevel(l.speed))
+}
+
+// SetMotorSpeed sets the duty cycle of the enable pin.
+func (l *l298n) SetMotorSpeed(speed int32) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.speed = speed
+	if !l.running {
+		return nil
+	}
+
+	return l.writer.PwmWrite(l.enablePin, pwmLevel(speed))
+}
+
+// release lets the motor coast by disabling the channel and clearing both
+// inputs.
+func (l *l298n) release() error {
+	err := l.writer.PwmWrite(l.enablePin, 0)
+	if err != nil {
+		return err
+	}
+
+	err = l.writer.DigitalWrite(l.forwardPin, 0)
+	if err != nil {
+		return err
+	}
+
+	return l.writer.DigitalWrite(l.backwardPin, 0)
+}
+
+// stepper drives a peristaltic pump turned by a four wire stepper motor. The
+// coils are stepped from a goroutine at a rate set by the motor speed, from
+// stopped at a speed of zero to the fastest the motor can step at MaxSpeed.
+type stepper struct {
+	writer       gpio.DigitalWriter
+	pins         []string
+	stepInterval time.Duration
+	speed        int32
+	phase        int
+	stop         chan struct{}
+	done         chan struct{}
+	mutex        sync.Mutex
+}
+
+// validateStepper ensures the coil pins and step interval are configured.
+func validateStepper(options DriverOptions) error {
+	if len(options.StepPins) != stepperPins {
+		return fmt.Errorf("stepPins must list %d pins", stepperPins)
+	}
+
+	if options.StepMicroseconds <= 0 {
+		return errors.New("stepMicroseconds must be greater than 0")
+	}
+
+	return nil
+}
+
+// newRaspiStepper creates a stepper motor controller on the GPIO pins of the
+// Raspberry Pi.
+func newRaspiStepper(options DriverOptions) (MotorController, error) {
+	return newStepper(raspi.NewAdaptor(), options), nil
+}
+
+// newStepper creates a stepper motor controller which writes to the supplied
+// adaptor.
+func newStepper(writer gpio.DigitalWriter, options DriverOptions) *stepper {
+	return &stepper{
+		writer:       writer,
+		pins:         options.StepPins,
+		stepInterval: time.Duration(options.StepMicroseconds) * time.Microsecond,
+	}
+}
+
+// Start connects to the GPIO pins and makes sure the coils are off.
+func (s *stepper) Start() error {
+	err := connect(s.writer)
+	if err != nil {
+		return err
+	}
+
+	return s.deenergize()
+}
+
+// RunMotor starts stepping the motor in the supplied direction or stops it
+// and turns the coils off.
+func (s *stepper) RunMotor(dir motor.Direction) error {
+	s.halt()
+
+	if dir != motor.Forward && dir != motor.Backward {
+		return s.deenergize()
+	}
+
+	s.mutex.Lock()
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.turn(dir, s.stop, s.done)
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// SetMotorSpeed sets how fast the motor steps. It takes effect from the next
+// step.
+func (s *stepper) SetMotorSpeed(speed int32) error {
+	s.mutex.Lock()
+	s.speed = speed
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// halt stops the stepping goroutine if it is running and waits for it.
+func (s *stepper) halt() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// turn steps the motor until it is told to stop.
+func (s *stepper) turn(dir motor.Direction, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		timer := time.NewTimer(s.nextStep())
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.mutex.Lock()
+		moving := s.speed > 0
+		s.mutex.Unlock()
+
+		if moving {
+			s.step(dir)
+		}
+	}
+}
+
+// nextStep returns how long to wait before the next step at the current
+// speed. A stopped motor checks its speed again after the longest interval.
+func (s *stepper) nextStep() time.Duration {
+	s.mutex.Lock()
+	level := pwmLevel(s.speed)
+	s.mutex.Unlock()
+
+	if level == 0 {
+		level = 1
+	}
+
+	return s.stepInterval * MaxSpeed / time.Duration(level)
+}
+
+// step moves the motor a single step in the supplied direction.
+func (s *stepper) step(dir motor.Direction) {
+	phases := gpio.StepperModes.DualPhaseStepping
+	if dir == motor.Forward {
+		s.phase = (s.phase + 1) % len(phases)
+	} else {
+		s.phase = (s.phase + len(phases) - 1) % len(phases)
+	}
+
+	for i, level := range phases[s.phase] {
+		err := s.writer.DigitalWrite(s.pins[i], level)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"pin":   s.pins[i],
+				"error": err,
+			}).Error("could not step motor")
+			return
+		}
+	}
+}
+
+// deenergize turns every coil off so the motor does not hold its position.
+func (s *stepper) deenergize() error {
+	for _, pin := range s.pins {
+		err := s.writer.DigitalWrite(pin, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+)
+
+// testPins records every level written to a GPIO pin.
+type testPins struct {
+	writes []string
+	levels map[string]byte
+	mutex  sync.Mutex
+}
+
+func newTestPins() *testPins {
+	return &testPins{levels: make(map[string]byte)}
+}
+
+func (p *testPins) DigitalWrite(pin string, level byte) error {
+	return p.write("digital", pin, level)
+}
+
+func (p *testPins) PwmWrite(pin string, level byte) error {
+	return p.write("pwm", pin, level)
+}
+
+func (p *testPins) write(kind string, pin string, level byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.writes = append(p.writes, fmt.Sprintf("%s %s %d", kind, pin, level))
+	p.levels[pin] = level
+	return nil
+}
+
+func (p *testPins) level(pin string) byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.levels[pin]
+}
+
+func (p *testPins) count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.writes)
+}
+
+func TestGPIOPWM(t *testing.T) {
+	pins := newTestPins()
+	pump := newGPIOPWM(pins, DriverOptions{PWMPin: "12"})
+
+	pump.SetMotorSpeed(DefaultDripSpeed)
+	if pins.count() != 0 {
+		t.Error("setting the speed of a stopped pump turned it on")
+	}
+
+	pump.RunMotor(motor.Forward)
+	if pins.level("12") != DefaultDripSpeed {
+		t.Error("pump did not run at its speed:", pins.level("12"))
+	}
+
+	pump.RunMotor(motor.Release)
+	if pins.level("12") != 0 {
+		t.Error("pump was not released")
+	}
+
+	err := pump.RunMotor(motor.Backward)
+	if err == nil {
+		t.Error("running a single pin pump backward did not return an error")
+	}
+}
+
+func TestL298N(t *testing.T) {
+	pins := newTestPins()
+	pump := newL298N(pins, DriverOptions{PWMPin: "32", ForwardPin: "16", BackwardPin: "18"})
+
+	pump.SetMotorSpeed(DefaultRunSpeed)
+	pump.RunMotor(motor.Backward)
+	if pins.level("16") != 0 || pins.level("18") != 1 || pins.level("32") != DefaultRunSpeed {
+		t.Error("H-bridge was not driven backward:", pins.writes)
+	}
+
+	pump.RunMotor(motor.Release)
+	if pins.level("16") != 0 || pins.level("18") != 0 || pins.level("32") != 0 {
+		t.Error("H-bridge was not released:", pins.writes)
+	}
+}
+
+func TestStepper(t *testing.T) {
+	pins := newTestPins()
+	pump := newStepper(pins, DriverOptions{StepPins: []string{"11", "13", "15", "16"}, StepMicroseconds: 100})
+
+	pump.SetMotorSpeed(255)
+	pump.RunMotor(motor.Forward)
+	time.Sleep(20 * time.Millisecond)
+	pump.RunMotor(motor.Release)
+
+	stepped := pins.count()
+	if stepped < 4*10 {
+		t.Error("stepper did not step while running:", stepped)
+	}
+
+	for _, pin := range []string{"11", "13", "15", "16"} {
+		if pins.level(pin) != 0 {
+			t.Error("coil was left energized:", pin)
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if pins.count() != stepped {
+		t.Error("stepper kept stepping after it was released")
+	}
+}
@@ -5,8 +5,8 @@
 package mock_dripper
 
 import (
+	motor "github.com/betterengineering/cold-brew/pkg/dripper/motor"
 	gomock "github.com/golang/mock/gomock"
-	i2c "gobot.io/x/gobot/drivers/i2c"
 	reflect "reflect"
 )
 
@@ -47,30 +47,30 @@ func (mr *MockMotorControllerMockRecorder) Start() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockMotorController)(nil).Start))
 }
 
-// RunDCMotor mocks base method
-func (m *MockMotorController) RunDCMotor(arg0 int, arg1 i2c.AdafruitDirection) error {
+// RunMotor mocks base method
+func (m *MockMotorController) RunMotor(arg0 motor.Direction) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "RunDCMotor", arg0, arg1)
+	ret := m.ctrl.Call(m, "RunMotor", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// RunDCMotor indicates an expected call of RunDCMotor
-func (mr *MockMotorControllerMockRecorder) RunDCMotor(arg0, arg1 interface{}) *gomock.Call {
+// RunMotor indicates an expected call of RunMotor
+func (mr *MockMotorControllerMockRecorder) RunMotor(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunDCMotor", reflect.TypeOf((*MockMotorController)(nil).RunDCMotor), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunMotor", reflect.TypeOf((*MockMotorController)(nil).RunMotor), arg0)
 }
 
-// SetDCMotorSpeed mocks base method
-func (m *MockMotorController) SetDCMotorSpeed(arg0 int, arg1 int32) error {
+// SetMotorSpeed mocks base method
+func (m *MockMotorController) SetMotorSpeed(arg0 int32) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SetDCMotorSpeed", arg0, arg1)
+	ret := m.ctrl.Call(m, "SetMotorSpeed", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// SetDCMotorSpeed indicates an expected call of SetDCMotorSpeed
-func (mr *MockMotorControllerMockRecorder) SetDCMotorSpeed(arg0, arg1 interface{}) *gomock.Call {
+// SetMotorSpeed indicates an expected call of SetMotorSpeed
+func (mr *MockMotorControllerMockRecorder) SetMotorSpeed(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDCMotorSpeed", reflect.TypeOf((*MockMotorController)(nil).SetDCMotorSpeed), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMotorSpeed", reflect.TypeOf((*MockMotorController)(nil).SetMotorSpeed), arg0)
 }
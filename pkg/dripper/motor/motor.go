@@ -0,0 +1,20 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+// Package motor describes how the motor turning the pump moves, independent of
+// the driver controlling it.
+package motor
+
+// Direction is the way the motor turning the pump rotates.
+type Direction int
+
+const (
+	// Forward turns the pump so that it pumps water into the coffee.
+	Forward Direction = iota
+
+	// Backward turns the pump the other way.
+	Backward
+
+	// Release stops the motor.
+	Release
+)
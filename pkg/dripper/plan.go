@@ -0,0 +1,107 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrPlanTooFast is returned when a plan would need the dripper to drip faster
+// than it can.
+var ErrPlanTooFast = fmt.Errorf("the volume can not be dispensed in time without exceeding %v drips per minute", MaxDripsPerMinute)
+
+// Plan is a drip rate which dispenses a volume between a start and finish
+// time.
+type Plan struct {
+	// StartAt is when the dripper has to start dripping.
+	StartAt time.Time `json:"startAt"`
+
+	// FinishAt is when the volume will have been dispensed.
+	FinishAt time.Time `json:"finishAt"`
+
+	// DripsPerMinute is the drip rate which dispenses the volume in time.
+	DripsPerMinute float64 `json:"dripsPerMinute"`
+
+	// Drips is the number of drips needed to dispense the volume.
+	Drips uint64 `json:"drips"`
+
+	// Volume is the number of millilitres to dispense.
+	Volume float64 `json:"volume"`
+}
+
+// PlanBetween works out the drip rate which dispenses the supplied volume
+// between the start and finish times with the supplied settings.
+func (c Calibration) PlanBetween(settings Settings, volume float64, startAt time.Time, finishAt time.Time) (Plan, error) {
+	drips, err := c.dripsFor(settings, volume)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	minutes := finishAt.Sub(startAt).Minutes()
+	if minutes <= 0 {
+		return Plan{}, errors.New("the finish time must be after the start time")
+	}
+
+	plan := Plan{
+		StartAt:        startAt,
+		FinishAt:       finishAt,
+		DripsPerMinute: float64(drips) / minutes,
+		Drips:          drips,
+		Volume:         volume,
+	}
+
+	return plan, plan.check(settings)
+}
+
+// PlanAtRate works out when the dripper has to start dripping at the supplied
+// rate to dispense the supplied volume by the finish time with the supplied
+// settings.
+func (c Calibration) PlanAtRate(settings Settings, volume float64, dripsPerMin float64, finishAt time.Time) (Plan, error) {
+	drips, err := c.dripsFor(settings, volume)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	if dripsPerMin <= 0 {
+		return Plan{}, errors.New("the drip rate must be greater than 0")
+	}
+
+	minutes := float64(drips) / dripsPerMin
+	plan := Plan{
+		StartAt:        finishAt.Add(-time.Duration(minutes * float64(time.Minute))),
+		FinishAt:       finishAt,
+		DripsPerMinute: dripsPerMin,
+		Drips:          drips,
+		Volume:         volume,
+	}
+
+	return plan, plan.check(settings)
+}
+
+// dripsFor returns the number of drips needed to dispense the supplied volume.
+func (c Calibration) dripsFor(settings Settings, volume float64) (uint64, error) {
+	mlPerDrip := c.MillilitresPerDripAt(settings)
+	if mlPerDrip <= 0 {
+		return 0, ErrNotCalibrated
+	}
+
+	if volume <= 0 {
+		return 0, errors.New("the volume must be greater than 0")
+	}
+
+	return uint64(math.Ceil(volume / mlPerDrip)), nil
+}
+
+// check ensures the dripper can keep up with the drip rate of the plan. Each
+// drip has to leave some time for the pump to stop before the next one.
+func (p Plan) check(settings Settings) error {
+	if p.DripsPerMinute > MaxDripsPerMinute || calcStopDuration(p.DripsPerMinute, settings.DripDuration) < 0 {
+		return ErrPlanTooFast
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanBetween(t *testing.T) {
+	settings := DefaultSettings()
+	c := withTestCalibration(settings)
+
+	start := time.Date(2019, time.May, 1, 5, 0, 0, 0, time.UTC)
+	plan, err := c.PlanBetween(settings, 1200, start, start.Add(10*time.Hour))
+	if err != nil {
+		t.Fatal("could not plan brew:", err)
+	}
+
+	if plan.Drips != 2400 {
+		t.Errorf("expected 2400 drips, got %v", plan.Drips)
+	}
+
+	if plan.DripsPerMinute != 4 {
+		t.Errorf("expected 4 drips per minute, got %v", plan.DripsPerMinute)
+	}
+}
+
+func TestPlanBetweenWhenPlanIsTooFast(t *testing.T) {
+	settings := DefaultSettings()
+	c := withTestCalibration(settings)
+
+	start := time.Date(2019, time.May, 1, 5, 0, 0, 0, time.UTC)
+	_, err := c.PlanBetween(settings, 1200, start, start.Add(time.Minute))
+	if err != ErrPlanTooFast {
+		t.Error("plan above the maximum drip rate did not return an error")
+	}
+
+	_, err = c.PlanBetween(settings, 1200, start, start)
+	if err == nil {
+		t.Error("plan without any time to drip did not return an error")
+	}
+
+	_, err = Calibration{}.PlanBetween(settings, 1200, start, start.Add(time.Hour))
+	if err != ErrNotCalibrated {
+		t.Error("plan without a calibration did not return an error")
+	}
+}
+
+func TestPlanAtRate(t *testing.T) {
+	settings := DefaultSettings()
+	c := withTestCalibration(settings)
+
+	finish := time.Date(2019, time.May, 1, 12, 0, 0, 0, time.UTC)
+	plan, err := c.PlanAtRate(settings, 1200, 40, finish)
+	if err != nil {
+		t.Fatal("could not plan brew:", err)
+	}
+
+	if !plan.StartAt.Equal(finish.Add(-time.Hour)) {
+		t.Error("plan did not start an hour before it finishes:", plan.StartAt)
+	}
+}
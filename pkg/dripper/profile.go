@@ -0,0 +1,195 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// ProfileLinear ramps the drip rate in a straight line from the start rate
+	// to the end rate and then holds the end rate.
+	ProfileLinear = "linear"
+
+	// ProfileStep changes the drip rate at fixed times from a table of steps.
+	ProfileStep = "step"
+
+	// ProfileExponential decays the drip rate from the start rate towards the
+	// end rate, halving the difference between them every period.
+	ProfileExponential = "exponential"
+
+	// profileReportStep is how far a smoothly changing profile has to move the
+	// drip rate before a rate event is emitted, so listeners are not told
+	// about every drip.
+	profileReportStep = 1
+)
+
+// RateStep is one entry in the table of a step profile.
+type RateStep struct {
+	// AfterSeconds is how long after the profile started this step begins.
+	AfterSeconds int64 `json:"afterSeconds"`
+
+	// DripsPerMinute is the drip rate during this step.
+	DripsPerMinute float64 `json:"dripsPerMinute"`
+}
+
+// Profile describes how the drip rate changes over time while dripping.
+type Profile struct {
+	// Type is one of ProfileLinear, ProfileStep or ProfileExponential.
+	Type string `json:"type"`
+
+	// StartDripsPerMinute is the drip rate linear and exponential profiles
+	// start at.
+	StartDripsPerMinute float64 `json:"startDripsPerMinute,omitempty"`
+
+	// EndDripsPerMinute is the drip rate a linear profile reaches and an
+	// exponential profile decays towards.
+	EndDripsPerMinute float64 `json:"endDripsPerMinute,omitempty"`
+
+	// Seconds is how long a linear profile takes to reach its end rate, or
+	// the half-life of an exponential profile.
+	Seconds int64 `json:"seconds,omitempty"`
+
+	// Steps is the table of a step profile, ordered by when each step begins.
+	// The first step must begin straight away.
+	Steps []RateStep `json:"steps,omitempty"`
+}
+
+// Validate ensures the profile only asks for drip rates the dripper supports.
+func (p Profile) Validate() error {
+	switch p.Type {
+	case ProfileLinear, ProfileExponential:
+		if !isValidProfileRate(p.StartDripsPerMinute) || !isValidProfileRate(p.EndDripsPerMinute) {
+			return fmt.Errorf("startDripsPerMinute and endDripsPerMinute must be greater than 0 and must not exceed %v", MaxDripsPerMinute)
+		}
+
+		if p.Seconds <= 0 {
+			return errors.New("seconds must be greater than 0")
+		}
+	case ProfileStep:
+		if len(p.Steps) == 0 || p.Steps[0].AfterSeconds != 0 {
+			return errors.New("steps must not be empty and the first step must begin after 0 seconds")
+		}
+
+		for i, step := range p.Steps {
+			if !isValidProfileRate(step.DripsPerMinute) {
+				return fmt.Errorf("step %d: dripsPerMinute must be greater than 0 and must not exceed %v", i, MaxDripsPerMinute)
+			}
+
+			if i > 0 && step.AfterSeconds <= p.Steps[i-1].AfterSeconds {
+				return fmt.Errorf("step %d: afterSeconds must be greater than the step before it", i)
+			}
+		}
+	default:
+		return fmt.Errorf("type must be one of %q, %q or %q", ProfileLinear, ProfileStep, ProfileExponential)
+	}
+
+	return nil
+}
+
+// RateAt returns the drip rate the profile asks for once it has been running
+// for the supplied duration.
+func (p Profile) RateAt(elapsed time.Duration) float64 {
+	seconds := elapsed.Seconds()
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	switch p.Type {
+	case ProfileLinear:
+		if seconds >= float64(p.Seconds) {
+			return p.EndDripsPerMinute
+		}
+
+		progress := seconds / float64(p.Seconds)
+		return p.StartDripsPerMinute + (p.EndDripsPerMinute-p.StartDripsPerMinute)*progress
+	case ProfileExponential:
+		remaining := math.Pow(0.5, seconds/float64(p.Seconds))
+		return p.EndDripsPerMinute + (p.StartDripsPerMinute-p.EndDripsPerMinute)*remaining
+	case ProfileStep:
+		dpm := 0.0
+		for _, step := range p.Steps {
+			if float64(step.AfterSeconds) > seconds {
+				break
+			}
+
+			dpm = step.DripsPerMinute
+		}
+
+		return dpm
+	}
+
+	return 0
+}
+
+// DripProfile starts the dripper following the supplied profile, as if it had
+// already been following it for the elapsed duration. This lets a profile be
+// continued after a restart.
+func (d *Dripper) DripProfile(profile Profile, elapsed time.Duration) error {
+	err := profile.Validate()
+	if err != nil {
+		return err
+	}
+
+	return d.startDripping(profile.RateAt(elapsed), &profile, elapsed)
+}
+
+// GetProfile returns a copy of the profile the dripper is following and how
+// long it has been following it, or nil if it is dripping at a fixed rate.
+func (d *Dripper) GetProfile() (*Profile, time.Duration) {
+	d.dripsPerMinMutex.Lock()
+	defer d.dripsPerMinMutex.Unlock()
+
+	if d.profile == nil {
+		return nil, 0
+	}
+
+	profile := *d.profile
+	return &profile, time.Since(d.profileStartedAt)
+}
+
+// setProfile replaces the profile the dripper follows. A nil profile makes
+// the dripper drip at a fixed rate.
+func (d *Dripper) setProfile(profile *Profile, elapsed time.Duration) {
+	d.dripsPerMinMutex.Lock()
+	d.profile = profile
+	d.profileStartedAt = time.Now().Add(-elapsed)
+	d.dripsPerMinMutex.Unlock()
+}
+
+// followProfile recomputes the drip rate from the profile the dripper is
+// following and returns the rate to use for the next drip.
+func (d *Dripper) followProfile() float64 {
+	d.dripsPerMinMutex.Lock()
+	if d.profile == nil {
+		dpm := d.dripsPerMin
+		d.dripsPerMinMutex.Unlock()
+		return dpm
+	}
+
+	dpm := d.profile.RateAt(time.Since(d.profileStartedAt))
+	d.dripsPerMin = dpm
+
+	report := dpm != d.reportedDripsPerMin &&
+		(d.profile.Type == ProfileStep || math.Abs(dpm-d.reportedDripsPerMin) >= profileReportStep)
+	if report {
+		d.reportedDripsPerMin = dpm
+	}
+	d.dripsPerMinMutex.Unlock()
+
+	if report {
+		d.emit(EventRate)
+	}
+
+	return dpm
+}
+
+// isValidProfileRate validates that a drip rate in a profile is one the
+// dripper supports.
+func isValidProfileRate(dripsPerMin float64) bool {
+	return dripsPerMin > 0 && dripsPerMin <= MaxDripsPerMinute
+}
@@ -0,0 +1,99 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProfileRateAt(t *testing.T) {
+	linear := Profile{Type: ProfileLinear, StartDripsPerMinute: 120, EndDripsPerMinute: 40, Seconds: 3600}
+	exponential := Profile{Type: ProfileExponential, StartDripsPerMinute: 120, EndDripsPerMinute: 40, Seconds: 3600}
+	step := Profile{Type: ProfileStep, Steps: []RateStep{
+		{AfterSeconds: 0, DripsPerMinute: 120},
+		{AfterSeconds: 1800, DripsPerMinute: 80},
+		{AfterSeconds: 3600, DripsPerMinute: 40},
+	}}
+
+	cases := []struct {
+		profile  Profile
+		elapsed  time.Duration
+		expected float64
+	}{
+		{linear, 0, 120},
+		{linear, 30 * time.Minute, 80},
+		{linear, 2 * time.Hour, 40},
+		{exponential, 0, 120},
+		{exponential, time.Hour, 80},
+		{exponential, 2 * time.Hour, 60},
+		{step, 0, 120},
+		{step, 45 * time.Minute, 80},
+		{step, 3 * time.Hour, 40},
+	}
+
+	for _, c := range cases {
+		actual := c.profile.RateAt(c.elapsed)
+		if math.Abs(actual-c.expected) > 0.001 {
+			t.Errorf("%s profile after %v: expected %v drips per minute, got %v", c.profile.Type, c.elapsed, c.expected, actual)
+		}
+	}
+}
+
+func TestProfileValidateWhenProfileIsInvalid(t *testing.T) {
+	profiles := []Profile{
+		{Type: "sine", StartDripsPerMinute: 120, EndDripsPerMinute: 40, Seconds: 3600},
+		{Type: ProfileLinear, StartDripsPerMinute: 500, EndDripsPerMinute: 40, Seconds: 3600},
+		{Type: ProfileExponential, StartDripsPerMinute: 120, EndDripsPerMinute: 40},
+		{Type: ProfileStep},
+		{Type: ProfileStep, Steps: []RateStep{{AfterSeconds: 60, DripsPerMinute: 40}}},
+		{Type: ProfileStep, Steps: []RateStep{{AfterSeconds: 0, DripsPerMinute: 40}, {AfterSeconds: 0, DripsPerMinute: 20}}},
+	}
+
+	for _, profile := range profiles {
+		err := profile.Validate()
+		if err == nil {
+			t.Errorf("invalid profile %+v did not return an error", profile)
+		}
+	}
+}
+
+func TestDripProfileRecomputesRate(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	profile := Profile{Type: ProfileStep, Steps: []RateStep{
+		{AfterSeconds: 0, DripsPerMinute: 240},
+		{AfterSeconds: 1, DripsPerMinute: 200},
+	}}
+
+	err = d.DripProfile(profile, 0)
+	if err != nil {
+		t.Fatal("could not start profile:", err)
+	}
+	defer d.Off()
+
+	if d.GetDripsPerMinute() != 240 {
+		t.Error("profile did not start at its first step:", d.GetDripsPerMinute())
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if d.GetDripsPerMinute() != 200 {
+		t.Error("profile did not move on to its second step:", d.GetDripsPerMinute())
+	}
+
+	active, elapsed := d.GetProfile()
+	if active == nil || active.Type != ProfileStep || elapsed < time.Second {
+		t.Error("active profile was not reported:", active, elapsed)
+	}
+
+	d.SetDripsPerMinute(40)
+	active, _ = d.GetProfile()
+	if active != nil {
+		t.Error("setting a fixed drip rate did not stop the profile")
+	}
+}
@@ -3,6 +3,12 @@
 
 package dripper
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 const (
 	// DefaultDripDuration is a sane default for the DripDuration configuration
 	// settting.
@@ -14,20 +20,57 @@ const (
 
 	// DefaultRunSpeed is a sane default for the RunSpeed configuration setting.
 	DefaultRunSpeed = 255
+
+	// MaxSpeed is the fastest speed the motor can be set to.
+	MaxSpeed = 255
+
+	// ApplyNow applies new settings to the pump as soon as they are set.
+	ApplyNow = "now"
+
+	// ApplyNextDrip holds new settings back until the dripper starts its next
+	// drip, so the drip in progress finishes with the settings it started
+	// with.
+	ApplyNextDrip = "nextDrip"
 )
 
 // Settings is a configuration object used to configure dripper settings.
-// TODO: this is accessed concurrently, but has no mutex.
+// Missing fields are reported by Validate along with every other field which
+// is not valid.
 type Settings struct {
 	// DripDuration is the time in milliseconds the motor is turned on for in
 	// order to produce one drip at the drip speed.
-	DripDuration int64 `json:"dripDuration" binding:"required"`
+	DripDuration int64 `json:"dripDuration"`
 
 	// DripSpeed is the slowest speed at which the motor still rotates.
-	DripSpeed int32 `json:"dripSpeed" binding:"required"`
+	DripSpeed int32 `json:"dripSpeed"`
 
 	// RunSpeed is the fastest speed the motor will rotate.
-	RunSpeed int32 `json:"runSpeed" binding:"required"`
+	RunSpeed int32 `json:"runSpeed"`
+}
+
+// FieldError describes why a single field of the settings is not valid.
+type FieldError struct {
+	// Field is the JSON name of the field.
+	Field string `json:"field"`
+
+	// Message explains what the field must be.
+	Message string `json:"message"`
+}
+
+// SettingsError is returned when settings are not valid. It lists every field
+// which is not valid, not just the first.
+type SettingsError struct {
+	Fields []FieldError
+}
+
+// Error joins the reasons of every field which is not valid.
+func (e *SettingsError) Error() string {
+	reasons := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		reasons[i] = f.Message
+	}
+
+	return "the settings are not valid: " + strings.Join(reasons, "; ")
 }
 
 // DefaultSettings config returns a configuration object with sane defaults.
@@ -38,3 +81,160 @@ func DefaultSettings() Settings {
 		RunSpeed:     DefaultRunSpeed,
 	}
 }
+
+// MaxDripDuration returns the longest a drip can last while still fitting into
+// the interval between drips at the maximum drip rate.
+func MaxDripDuration() time.Duration {
+	return calcDripInterval(MaxDripsPerMinute)
+}
+
+// Validate ensures the settings are ones the pump can carry out. Each drip must
+// finish before the next one starts at the maximum drip rate, and the pump
+// must not drip faster than it runs.
+func (s Settings) Validate() error {
+	var fields []FieldError
+	invalid := func(field string, format string, a ...interface{}) {
+		fields = append(fields, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	maxDuration := int64(MaxDripDuration() / time.Millisecond)
+	if s.DripDuration <= 0 || calcStopDuration(MaxDripsPerMinute, s.DripDuration) < 0 {
+		invalid("dripDuration", "dripDuration must be between 1 and %d milliseconds so a drip finishes before the next one at %v drips per minute", maxDuration, MaxDripsPerMinute)
+	}
+
+	if s.DripSpeed <= 0 || s.DripSpeed > MaxSpeed {
+		invalid("dripSpeed", "dripSpeed must be between 1 and %d", MaxSpeed)
+	}
+
+	if s.RunSpeed <= 0 || s.RunSpeed > MaxSpeed {
+		invalid("runSpeed", "runSpeed must be between 1 and %d", MaxSpeed)
+	}
+
+	if s.DripSpeed > s.RunSpeed {
+		invalid("dripSpeed", "dripSpeed must not exceed runSpeed")
+	}
+
+	if len(fields) > 0 {
+		return &SettingsError{Fields: fields}
+	}
+
+	return nil
+}
+
+// GetSettings returns the settings the dripper is using.
+func (d *Dripper) GetSettings() Settings {
+	d.settingsMutex.Lock()
+	defer d.settingsMutex.Unlock()
+
+	return d.settings
+}
+
+// GetPendingSettings returns the settings which the dripper will switch to
+// once it can, or nil if there are none.
+func (d *Dripper) GetPendingSettings() *Settings {
+	d.settingsMutex.Lock()
+	defer d.settingsMutex.Unlock()
+
+	if d.pendingSettings == nil {
+		return nil
+	}
+
+	pending := *d.pendingSettings
+	return &pending
+}
+
+// SetSettings changes the settings of the dripper without interrupting it.
+// Settings which are not valid are rejected with a SettingsError.
+// Settings applied now take effect straight away while dripping, and settings
+// applied at the next drip take effect once the drip in progress has
+// finished. In the run state, the time and volume limits are based on the run
+// speed, so new settings are held back until the dripper is next told to run,
+// drip or turn off.
+func (d *Dripper) SetSettings(settings Settings, apply string) error {
+	if apply != ApplyNow && apply != ApplyNextDrip {
+		return fmt.Errorf("apply must be %q or %q", ApplyNow, ApplyNextDrip)
+	}
+
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	state := d.GetState()
+	if state == RUN || (state == DRIP && apply == ApplyNextDrip) {
+		d.volumeMutex.Lock()
+		d.settingsMutex.Lock()
+		d.pendingSettings = &settings
+		d.settingsMutex.Unlock()
+		d.volumeMutex.Unlock()
+
+		return nil
+	}
+
+	d.replaceSettings(settings)
+	d.emit(EventSettings)
+
+	if state == DRIP {
+		return d.setSpeed(settings.DripSpeed)
+	}
+
+	return nil
+}
+
+// applyPendingSettings switches the dripper to its pending settings, if it has
+// any, and reports whether it did.
+func (d *Dripper) applyPendingSettings() bool {
+	if !d.replacePendingSettings() {
+		return false
+	}
+
+	d.emit(EventSettings)
+
+	return true
+}
+
+// replacePendingSettings replaces the settings the dripper uses with its
+// pending settings, if it has any, and reports whether it did. The pending
+// settings are taken and cleared in one step, and settings are only queued
+// while holding the volumeMutex, so newer settings queued meanwhile are never
+// dropped. Water dispensed in the run state so far is counted at the old
+// settings first.
+func (d *Dripper) replacePendingSettings() bool {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	d.settingsMutex.Lock()
+	pending := d.pendingSettings
+	d.pendingSettings = nil
+	d.settingsMutex.Unlock()
+
+	if pending == nil {
+		return false
+	}
+
+	d.accumulateRun()
+
+	d.settingsMutex.Lock()
+	d.settings = *pending
+	d.settingsMutex.Unlock()
+
+	return true
+}
+
+// replaceSettings replaces the settings the dripper uses and drops any
+// pending settings. Water dispensed in the run state so far is counted at the
+// old settings first.
+func (d *Dripper) replaceSettings(settings Settings) {
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	d.accumulateRun()
+
+	d.settingsMutex.Lock()
+	d.settings = settings
+	d.pendingSettings = nil
+	d.settingsMutex.Unlock()
+}
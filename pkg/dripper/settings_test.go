@@ -3,7 +3,9 @@
 package dripper
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDefaultSettingsReturnsDefaultValues(t *testing.T) {
@@ -21,3 +23,188 @@ func TestDefaultSettingsReturnsDefaultValues(t *testing.T) {
 		t.Error("configured duration does not match default")
 	}
 }
+
+func TestSetSettingsNowWhileDripping(t *testing.T) {
+	sim := NewSimulator()
+	d, err := New(DefaultSettings(), sim)
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	err = d.Drip(1)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+	defer d.Off()
+
+	settings := Settings{DripDuration: 100, DripSpeed: 150, RunSpeed: 200}
+	err = d.SetSettings(settings, ApplyNow)
+	if err != nil {
+		t.Fatal("could not set settings:", err)
+	}
+
+	if d.GetSettings() != settings || d.GetPendingSettings() != nil {
+		t.Error("settings were not applied straight away")
+	}
+
+	transitions := sim.Transitions()
+	if transitions[len(transitions)-1].Speed != settings.DripSpeed {
+		t.Error("new drip speed was not applied to the pump")
+	}
+
+	if d.GetState() != DRIP {
+		t.Error("setting the settings interrupted the dripper")
+	}
+}
+
+func TestSetSettingsAtNextDrip(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.settings.DripDuration = 1
+
+	dripped := make(chan struct{}, 1)
+	applied := make(chan Settings, 1)
+	d.AddListener(func(e Event) {
+		switch e.Type {
+		case EventDrip:
+			select {
+			case dripped <- struct{}{}:
+			default:
+			}
+		case EventSettings:
+			applied <- d.GetSettings()
+		}
+	})
+
+	err = d.Drip(120)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+	defer d.Off()
+
+	// The settings are set between drips.
+	<-dripped
+
+	settings := Settings{DripDuration: 2, DripSpeed: 150, RunSpeed: 200}
+	err = d.SetSettings(settings, ApplyNextDrip)
+	if err != nil {
+		t.Fatal("could not set settings:", err)
+	}
+
+	if d.GetSettings() == settings || d.GetPendingSettings() == nil {
+		t.Error("settings were applied before the next drip")
+	}
+
+	select {
+	case actual := <-applied:
+		if actual != settings {
+			t.Error("incorrect settings were applied:", actual)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("settings were not applied at the next drip")
+	}
+
+	if d.GetPendingSettings() != nil {
+		t.Error("pending settings were not cleared once applied")
+	}
+}
+
+func TestSetSettingsHeldBackWhileRunning(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	err = d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	settings := Settings{DripDuration: 100, DripSpeed: 150, RunSpeed: 200}
+	err = d.SetSettings(settings, ApplyNow)
+	if err != nil {
+		t.Fatal("could not set settings:", err)
+	}
+
+	if d.GetSettings() == settings {
+		t.Error("settings were applied while running")
+	}
+
+	err = d.Off()
+	if err != nil {
+		t.Fatal("could not turn dripper off:", err)
+	}
+
+	if d.GetSettings() != settings || d.GetPendingSettings() != nil {
+		t.Error("held back settings were not applied once the dripper turned off")
+	}
+}
+
+func TestSetSettingsWhenApplyIsInvalid(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	err = d.SetSettings(DefaultSettings(), "later")
+	if err == nil {
+		t.Error("invalid apply did not return an error")
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	cases := []struct {
+		settings Settings
+		fields   []string
+	}{
+		{DefaultSettings(), nil},
+		{Settings{DripDuration: -1, DripSpeed: 100, RunSpeed: 255}, []string{"dripDuration"}},
+		{Settings{DripDuration: 300, DripSpeed: 100, RunSpeed: 255}, []string{"dripDuration"}},
+		{Settings{DripDuration: 250, DripSpeed: 256, RunSpeed: 255}, []string{"dripSpeed", "dripSpeed"}},
+		{Settings{DripDuration: 250, DripSpeed: 200, RunSpeed: 100}, []string{"dripSpeed"}},
+		{Settings{}, []string{"dripDuration", "dripSpeed", "runSpeed"}},
+	}
+
+	for _, c := range cases {
+		err := c.settings.Validate()
+		if c.fields == nil {
+			if err != nil {
+				t.Errorf("valid settings %+v returned an error: %v", c.settings, err)
+			}
+			continue
+		}
+
+		settingsErr, ok := err.(*SettingsError)
+		if !ok {
+			t.Errorf("invalid settings %+v did not return a settings error: %v", c.settings, err)
+			continue
+		}
+
+		var fields []string
+		for _, f := range settingsErr.Fields {
+			fields = append(fields, f.Field)
+		}
+
+		if !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("invalid settings %+v: expected fields %v, got %v", c.settings, c.fields, fields)
+		}
+	}
+}
+
+func TestSetSettingsWhenSettingsAreInvalid(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	err = d.SetSettings(Settings{DripDuration: 1000, DripSpeed: 100, RunSpeed: 255}, ApplyNow)
+	if err == nil {
+		t.Error("invalid settings did not return an error")
+	}
+
+	if d.GetSettings() != DefaultSettings() {
+		t.Error("invalid settings were applied")
+	}
+}
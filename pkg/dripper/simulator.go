@@ -0,0 +1,110 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/betterengineering/cold-brew/pkg/dripper/motor"
+	"github.com/sirupsen/logrus"
+)
+
+// maxSimulatorTransitions is the number of transitions the simulator keeps
+// before discarding the oldest ones. This keeps a long running development
+// server from growing without bound.
+const maxSimulatorTransitions = 1000
+
+// Transition is a record of a single change to a simulated motor.
+type Transition struct {
+	// Time is when the transition happened.
+	Time time.Time `json:"time"`
+
+	// Running reports whether the motor is rotating after the transition.
+	Running bool `json:"running"`
+
+	// Speed is the speed of the motor after the transition.
+	Speed int32 `json:"speed"`
+}
+
+// Simulator is a MotorController which does not talk to any hardware. Instead
+// it records every transition of the motor so the dripper can be used on
+// development machines and in CI.
+type Simulator struct {
+	// transitions is the history of motor transitions, oldest first.
+	transitions []Transition
+
+	// running tracks whether the motor is currently rotating.
+	running bool
+
+	// speed tracks the last speed set for the motor.
+	speed int32
+
+	// mutex is used to access the simulator across multiple goroutines.
+	mutex sync.Mutex
+}
+
+// NewSimulator creates a new simulated motor controller.
+func NewSimulator() *Simulator {
+	return &Simulator{}
+}
+
+// Start initializes the simulator. It never fails.
+func (s *Simulator) Start() error {
+	logrus.Info("using simulated motor controller")
+	return nil
+}
+
+// RunMotor simulates starting or releasing the motor.
+func (s *Simulator) RunMotor(dir motor.Direction) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.running = dir != motor.Release
+	s.record()
+
+	return nil
+}
+
+// SetMotorSpeed simulates setting the speed of the motor.
+func (s *Simulator) SetMotorSpeed(speed int32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.speed = speed
+	s.record()
+
+	return nil
+}
+
+// Transitions returns a copy of the recorded motor transitions, oldest first.
+func (s *Simulator) Transitions() []Transition {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	transitions := make([]Transition, len(s.transitions))
+	copy(transitions, s.transitions)
+
+	return transitions
+}
+
+// record appends the current state of the motor to the transition history.
+// The caller must hold the mutex.
+func (s *Simulator) record() {
+	t := Transition{
+		Time:    time.Now(),
+		Running: s.running,
+		Speed:   s.speed,
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"running": t.Running,
+		"speed":   t.Speed,
+	}).Debug("simulated motor transition")
+
+	s.transitions = append(s.transitions, t)
+	if len(s.transitions) > maxSimulatorTransitions {
+		s.transitions = s.transitions[len(s.transitions)-maxSimulatorTransitions:]
+	}
+}
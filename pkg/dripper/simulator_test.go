@@ -0,0 +1,77 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"testing"
+)
+
+func TestSimulatorRecordsTransitions(t *testing.T) {
+	sim := NewSimulator()
+	d, err := New(DefaultSettings(), sim)
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+
+	err = d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	err = d.Off()
+	if err != nil {
+		t.Fatal("could not turn dripper off:", err)
+	}
+
+	transitions := sim.Transitions()
+	if len(transitions) != 3 {
+		t.Fatalf("expected 3 transitions, got %d", len(transitions))
+	}
+
+	if transitions[0].Speed != DefaultRunSpeed || transitions[0].Running {
+		t.Error("run speed was not recorded before the motor started")
+	}
+
+	if !transitions[1].Running {
+		t.Error("motor was not recorded as running")
+	}
+
+	if transitions[2].Running {
+		t.Error("motor was not recorded as stopped")
+	}
+}
+
+func TestSimulatorDiscardsOldTransitions(t *testing.T) {
+	sim := NewSimulator()
+	for i := 0; i < maxSimulatorTransitions+10; i++ {
+		sim.SetMotorSpeed(int32(i))
+	}
+
+	transitions := sim.Transitions()
+	if len(transitions) != maxSimulatorTransitions {
+		t.Fatal("simulator did not cap the number of transitions")
+	}
+
+	if transitions[0].Speed != 10 {
+		t.Error("simulator did not discard the oldest transitions")
+	}
+}
+
+func TestNewMotorControllerWithSimulator(t *testing.T) {
+	pump, err := NewMotorController(DriverSimulator, DefaultDriverOptions())
+	if err != nil {
+		t.Fatal("could not create simulated motor controller:", err)
+	}
+
+	if _, ok := pump.(*Simulator); !ok {
+		t.Error("simulator driver did not return a simulator")
+	}
+}
+
+func TestNewMotorControllerWithUnknownDriver(t *testing.T) {
+	_, err := NewMotorController("foo", DefaultDriverOptions())
+	if err == nil {
+		t.Error("unknown driver did not return an error")
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TripRunDuration means the pump stayed in the run state for longer than
+	// the maximum run duration.
+	TripRunDuration = "maxRunDuration"
+
+	// TripSessionVolume means the dripper dispensed more than the maximum
+	// volume of a session.
+	TripSessionVolume = "maxSessionVolume"
+)
+
+// ErrTripped is returned when the dripper is started after the watchdog turned
+// it off but before it was explicitly turned off.
+var ErrTripped = errors.New("the watchdog turned the dripper off, turn it off before starting it again")
+
+// Limits are the safety limits enforced by the watchdog. A zero limit is not
+// enforced.
+type Limits struct {
+	// MaxRunDuration is the longest the pump may stay in the run state
+	// without being told to do something else.
+	MaxRunDuration time.Duration `json:"maxRunDuration"`
+
+	// MaxSessionVolume is the most millilitres the dripper may dispense in a
+	// single session. It is only enforced while the dripper is calibrated.
+	MaxSessionVolume float64 `json:"maxSessionVolume"`
+}
+
+// Trip records why the watchdog turned the dripper off.
+type Trip struct {
+	// Reason is the limit which was exceeded.
+	Reason string `json:"reason"`
+
+	// Time is when the watchdog turned the dripper off.
+	Time time.Time `json:"time"`
+
+	// SessionVolume is the number of millilitres dispensed in the session
+	// when the watchdog turned the dripper off.
+	SessionVolume float64 `json:"sessionVolume"`
+}
+
+// SetLimits updates the safety limits enforced by the watchdog. The limits
+// apply immediately, including to a run already in progress.
+func (d *Dripper) SetLimits(limits Limits) {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	d.watchdogMutex.Lock()
+	d.limits = limits
+	d.watchdogMutex.Unlock()
+
+	if d.GetState() == RUN {
+		d.armWatchdog()
+	}
+}
+
+// GetLimits returns the safety limits enforced by the watchdog.
+func (d *Dripper) GetLimits() Limits {
+	d.watchdogMutex.Lock()
+	defer d.watchdogMutex.Unlock()
+
+	return d.limits
+}
+
+// GetTrip returns why the watchdog last turned the dripper off, or nil if it
+// has not done so since the dripper was last started.
+func (d *Dripper) GetTrip() *Trip {
+	d.watchdogMutex.Lock()
+	defer d.watchdogMutex.Unlock()
+
+	if d.trip == nil {
+		return nil
+	}
+
+	trip := *d.trip
+	return &trip
+}
+
+// isTripped reports whether the watchdog turned the dripper off and it has not
+// been explicitly turned off since.
+func (d *Dripper) isTripped() bool {
+	d.watchdogMutex.Lock()
+	defer d.watchdogMutex.Unlock()
+
+	return d.tripped
+}
+
+// BeginSession starts counting the volume of a session which lasts until
+// EndSession is called, even if the dripper is turned off in between. Without
+// it, a session starts every time the dripper is turned on from off.
+func (d *Dripper) BeginSession() {
+	volume := d.GetDispensedVolume()
+
+	d.volumeMutex.Lock()
+	d.sessionStart = volume
+	d.sessionOpen = true
+	d.volumeMutex.Unlock()
+}
+
+// EndSession ends a session started with BeginSession.
+func (d *Dripper) EndSession() {
+	d.volumeMutex.Lock()
+	d.sessionOpen = false
+	d.volumeMutex.Unlock()
+}
+
+// GetSessionVolume returns the number of millilitres dispensed in the current
+// session.
+func (d *Dripper) GetSessionVolume() float64 {
+	volume := d.GetDispensedVolume()
+
+	d.volumeMutex.Lock()
+	defer d.volumeMutex.Unlock()
+
+	return volume - d.sessionStart
+}
+
+// startSession starts counting the volume of a new session unless one was
+// started with BeginSession, and clears the previous trip. It is called when
+// the dripper is turned on from off.
+func (d *Dripper) startSession() {
+	volume := d.GetDispensedVolume()
+
+	d.volumeMutex.Lock()
+	if !d.sessionOpen {
+		d.sessionStart = volume
+	}
+	d.volumeMutex.Unlock()
+
+	d.watchdogMutex.Lock()
+	d.trip = nil
+	d.watchdogMutex.Unlock()
+}
+
+// armWatchdog turns the dripper off once the run state has lasted too long or
+// the session would dispense too much water. The caller must hold the
+// controlMutex.
+func (d *Dripper) armWatchdog() {
+	d.disarmWatchdog()
+
+	limits := d.GetLimits()
+	reason := TripRunDuration
+	duration := limits.MaxRunDuration - time.Since(d.runSince)
+	armed := limits.MaxRunDuration > 0
+
+	flow := d.GetCalibration().MillilitresPerSecondAt(d.GetSettings())
+	if limits.MaxSessionVolume > 0 && flow > 0 {
+		remaining := limits.MaxSessionVolume - d.GetSessionVolume()
+		untilFull := time.Duration(remaining / flow * float64(time.Second))
+		if !armed || untilFull < duration {
+			reason = TripSessionVolume
+			duration = untilFull
+			armed = true
+		}
+	}
+
+	if !armed {
+		return
+	}
+
+	generation := d.generation
+	d.watchdogTimer = time.AfterFunc(duration, func() {
+		d.tripWatchdog(generation, reason)
+	})
+}
+
+// disarmWatchdog stops the watchdog timer of the run state. The caller must
+// hold the controlMutex.
+func (d *Dripper) disarmWatchdog() {
+	if d.watchdogTimer != nil {
+		d.watchdogTimer.Stop()
+		d.watchdogTimer = nil
+	}
+}
+
+// sessionLimitReached reports whether the session has dispensed its maximum
+// volume.
+func (d *Dripper) sessionLimitReached() bool {
+	max := d.GetLimits().MaxSessionVolume
+	return max > 0 && d.GetSessionVolume() >= max
+}
+
+// tripWatchdog records why the watchdog stopped the dripper and turns it off.
+// It does nothing if the dripper has been given a newer command since the
+// supplied generation.
+func (d *Dripper) tripWatchdog(generation uint64, reason string) {
+	d.controlMutex.Lock()
+	defer d.controlMutex.Unlock()
+
+	if d.generation != generation {
+		return
+	}
+
+	trip := Trip{
+		Reason:        reason,
+		Time:          time.Now(),
+		SessionVolume: d.GetSessionVolume(),
+	}
+
+	d.watchdogMutex.Lock()
+	d.trip = &trip
+	d.tripped = true
+	d.watchdogMutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"reason":        trip.Reason,
+		"sessionVolume": trip.SessionVolume,
+	}).Warn("watchdog turned the dripper off")
+
+	// Listeners learn about the trip before the dripper turns off so they
+	// can tell it apart from being turned off on purpose.
+	d.emit(EventTrip)
+
+	err := d.off()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("could not turn the dripper off")
+	}
+}
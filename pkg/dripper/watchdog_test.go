@@ -0,0 +1,167 @@
+// Copyright © 2018 Mark Spicer
+// Made available under the MIT license.
+
+package dripper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdogTripsOnRunDuration(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.SetLimits(Limits{MaxRunDuration: 50 * time.Millisecond})
+
+	var trips []Event
+	d.AddListener(func(e Event) {
+		if e.Type == EventTrip {
+			trips = append(trips, e)
+		}
+	})
+
+	err = d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if d.GetState() != OFF {
+		t.Fatal("dripper was not turned off after the maximum run duration")
+	}
+
+	trip := d.GetTrip()
+	if trip == nil || trip.Reason != TripRunDuration {
+		t.Error("trip was not recorded:", trip)
+	}
+
+	if len(trips) != 1 || trips[0].Trip == nil || trips[0].State != RUN {
+		t.Error("trip event was not emitted before turning off")
+	}
+
+	if d.Run() != ErrTripped || d.Drip(60) != ErrTripped || d.GetState() != OFF {
+		t.Fatal("dripper was started again before it was turned off")
+	}
+
+	err = d.Off()
+	if err != nil {
+		t.Fatal("could not turn dripper off:", err)
+	}
+
+	err = d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+	defer d.Off()
+
+	if d.GetTrip() != nil {
+		t.Error("trip was not cleared when the dripper was started again")
+	}
+}
+
+func TestWatchdogKeepsRunDeadlineWhenRunAgain(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.SetLimits(Limits{MaxRunDuration: 150 * time.Millisecond})
+	defer d.Off()
+
+	for i := 0; i < 5; i++ {
+		err = d.Run()
+		if err != nil && err != ErrTripped {
+			t.Fatal("could not run dripper:", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	trip := d.GetTrip()
+	if d.GetState() != OFF || trip == nil || trip.Reason != TripRunDuration {
+		t.Error("running again restarted the maximum run duration:", trip)
+	}
+}
+
+func TestWatchdogDoesNotTripWhenRunIsStopped(t *testing.T) {
+	d, err := New(DefaultSettings(), NewSimulator())
+	if err != nil {
+		t.Fatal("could not create dripper with simulator:", err)
+	}
+	d.SetLimits(Limits{MaxRunDuration: 50 * time.Millisecond})
+
+	err = d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	err = d.Drip(60)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+	defer d.Off()
+
+	time.Sleep(200 * time.Millisecond)
+	if d.GetState() != DRIP || d.GetTrip() != nil {
+		t.Error("watchdog tripped after the dripper left the run state")
+	}
+}
+
+func TestWatchdogTripsOnSessionVolume(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+	d.SetLimits(Limits{MaxSessionVolume: 5})
+
+	err := d.Run()
+	if err != nil {
+		t.Fatal("could not run dripper:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if d.GetState() != OFF {
+		t.Fatal("dripper was not turned off after the maximum session volume")
+	}
+
+	trip := d.GetTrip()
+	if trip == nil || trip.Reason != TripSessionVolume {
+		t.Error("trip was not recorded:", trip)
+	}
+}
+
+func TestWatchdogCountsVolumeAcrossExplicitSession(t *testing.T) {
+	d := withTestCalibratedDripper(t)
+	d.SetLimits(Limits{MaxSessionVolume: 1})
+	d.BeginSession()
+
+	err := d.Drip(MaxDripsPerMinute)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	err = d.Off()
+	if err != nil {
+		t.Fatal("could not turn the dripper off:", err)
+	}
+
+	err = d.Drip(MaxDripsPerMinute)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if d.GetState() != OFF || d.GetTrip() == nil {
+		t.Error("session volume was not counted across the explicit session")
+	}
+
+	d.Off()
+	d.EndSession()
+	err = d.Drip(MaxDripsPerMinute)
+	if err != nil {
+		t.Fatal("could not start dripping:", err)
+	}
+	defer d.Off()
+
+	if d.GetSessionVolume() != 0 {
+		t.Error("a new session did not start after the explicit session ended")
+	}
+}